@@ -17,6 +17,7 @@ function generateInstanceDivs(nodesMap) {
     nodesList.forEach(function (node) {
     	var popoverElement = $("[data-fo-id='" + node.id + "'] .popover");
    		renderInstanceElement(popoverElement, node, "cluster");
+   		renderLagSparkline(popoverElement, node);
     });
     $("[data-fo-id]").each(
         function () {
@@ -40,6 +40,8 @@ $(document).ready(function () {
 	        	incrementClusterProblems(instance.ClusterName, "label-danger")
 	        } else if (instance.replicationLagProblem()) {
 	        	incrementClusterProblems(instance.ClusterName, "label-warning")
+	        } else if (instance.errantTransactionsProblem()) {
+	        	incrementClusterProblems(instance.ClusterName, "label-warning")
 	        }
 	    });
 
@@ -165,6 +165,21 @@ function openNodeModal(node) {
             '<a href="/web/agent/'+node.Key.Hostname+'">'+node.Key.Hostname+'</a>');
     addNodeModalDataAttribute("Long queries",
             '<a href="/web/long-queries?filter='+node.Key.Hostname+'">on '+node.Key.Hostname+'</a>');
+    if (!node.MasterKey.Hostname) {
+        $.get("/api/pseudo-gtid-injection/"+node.Key.Hostname+"/"+node.Key.Port, function (injectionResult) {
+            if (injectionResult.Code != "OK") {
+                return;
+            }
+            var status = injectionResult.Details;
+            var description = "last injected: " + (status.LastInjectedAt || "never");
+            if (status.SkipReason) {
+                description = "skipped (" + status.SkipReason + "); " + description;
+            } else if (status.LastError) {
+                description = "failing: " + status.LastError + "; " + description;
+            }
+            addNodeModalDataAttribute("Pseudo-GTID injection", description);
+        }, "json");
+    }
     
     $('#node_modal [data-btn]').unbind("click");
     
@@ -310,6 +325,7 @@ function normalizeInstanceProblem(instance) {
     instance.notRecentlyCheckedProblem = function() { return !instance.IsRecentlyChecked; }
     instance.notReplicatingProblem = function() { return !instance.replicationRunning && !(instance.isMaster && !instance.isCoMaster); }
     instance.replicationLagProblem = function() { return !instance.replicationLagReasonable; }
+    instance.errantTransactionsProblem = function() { return instance.HasErrantTransactions; }
 
     instance.problem = null;
     instance.problemOrder = 0;
@@ -329,6 +345,9 @@ function normalizeInstanceProblem(instance) {
     } else if (instance.replicationLagProblem()) {
     	instance.problem = "replication_lag";
     	instance.problemOrder = 5;
+    } else if (instance.errantTransactionsProblem()) {
+    	instance.problem = "errant_transactions";
+    	instance.problemOrder = 6;
     }
     instance.hasProblem = (instance.problem != null) ;
     instance.hasConnectivityProblem = (!instance.IsLastCheckValid || !instance.IsRecentlyChecked);
@@ -439,6 +458,37 @@ function normalizeInstances(instances, maintenanceList) {
     return instancesMap;
 }
 
+// renderLagSparkline draws the recent replication lag of an instance, as sampled in its history, onto the
+// instance's sparkline placeholder (see renderInstanceElement)
+function renderLagSparkline(popoverElement, instance) {
+	var sparklineElement = popoverElement.find(".lag-sparkline");
+	if (sparklineElement.length == 0) {
+		return;
+	}
+	$.get("/api/instance-history/"+instance.Key.Hostname+"/"+instance.Key.Port, function (history) {
+		if (!$.isArray(history) || history.length < 2) {
+			return;
+		}
+		var lagValues = history.map(function (entry) {
+			return entry.SlaveLagSeconds.Valid ? entry.SlaveLagSeconds.Int64 : 0;
+		});
+		var width = sparklineElement.width();
+		var height = sparklineElement.height();
+		var x = d3.scale.linear().domain([0, lagValues.length - 1]).range([0, width]);
+		var y = d3.scale.linear().domain([0, Math.max(d3.max(lagValues), 1)]).range([height - 1, 1]);
+		var line = d3.svg.line()
+			.x(function (lag, i) { return x(i); })
+			.y(function (lag) { return y(lag); });
+		d3.select(sparklineElement[0]).selectAll("svg").remove();
+		d3.select(sparklineElement[0]).append("svg")
+			.attr("width", width)
+			.attr("height", height)
+			.append("path")
+			.attr("d", line(lagValues));
+		sparklineElement.attr("title", "Replication lag, last hour. Max: " + d3.max(lagValues) + " seconds");
+	}, "json");
+}
+
 function renderInstanceElement(popoverElement, instance, renderType) {
 	popoverElement.attr("data-nodeid", instance.id);
 	popoverElement.find("h3").html('&nbsp;<div class="pull-left">'+
@@ -456,6 +506,9 @@ function renderInstanceElement(popoverElement, instance, renderType) {
     if (instance.inMaintenanceProblem()) {
     	popoverElement.find("h3 div.pull-right").prepend('<span class="glyphicon glyphicon-wrench" title="Open config dialog"></span> ');
     } 
+    if (instance.errantTransactionsProblem()) {
+    	popoverElement.find("h3 div.pull-right").prepend('<span class="glyphicon glyphicon-flag" title="Errant transactions at '+instance.ErrantBinlogCoordinates.LogFile+':'+instance.ErrantBinlogCoordinates.LogPos+'"></span> ');
+    } 
     
     if (instance.lastCheckInvalidProblem()) {
     	popoverElement.find("h3").addClass("label-fatal");
@@ -468,10 +521,15 @@ function renderInstanceElement(popoverElement, instance, renderType) {
     	popoverElement.find("h3").addClass("label-danger");
     } else if (instance.replicationLagProblem()) {
     	popoverElement.find("h3").addClass("label-warning");
+    } else if (instance.errantTransactionsProblem()) {
+    	popoverElement.find("h3").addClass("label-warning");
     }
 	var statusMessage = instance.SlaveLagSeconds.Int64 + ' seconds lag';
 	if (indicateLastSeenInStatus) {
 		statusMessage = 'seen ' + instance.SecondsSinceLastSeen.Int64 + ' seconds ago';
+		if (instance.LastCheckOutcome == "timeout") {
+			statusMessage += ', check timed out';
+		}
 	}
     var contentHtml = ''
         	+ '<div class="pull-right">' + statusMessage + ' </div>'
@@ -494,6 +552,9 @@ function renderInstanceElement(popoverElement, instance, renderType) {
         	+ 'Problem: <strong>'+instance.problem.replace(/_/g, ' ') + '</strong>'
         + '</p>';
     }  
+    if (renderType == "cluster" && (instance.isCoMaster || !instance.isMaster)) {
+    	contentHtml += '<div class="lag-sparkline" title="Replication lag, last hour"></div>';
+    }  
     
     popoverElement.find(".popover-content").html(contentHtml);
     if (instance.isCandidateMaster) {
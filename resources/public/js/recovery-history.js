@@ -0,0 +1,66 @@
+
+$(document).ready(function () {
+    showLoader();
+    $.get("/api/recovery-history/"+currentPage(), function (recoveries) {
+            displayRecoveries(recoveries);
+    	}, "json");
+    function displayRecoveries(recoveries) {
+        hideLoader();
+        recoveries.forEach(function (recovery) {
+    		var row = jQuery('<tr/>');
+    		jQuery('<td/>', { text: recovery.RecoveryStartTimestamp }).appendTo(row);
+    		jQuery('<td/>', { text: recovery.RecoveryEndTimestamp }).appendTo(row);
+    		jQuery('<td/>', { text: recovery.RecoveryType + (recovery.IsAutomated ? " (automated)" : " (manual)") }).appendTo(row);
+    		jQuery('<td/>', { text: recovery.ClusterName }).appendTo(row);
+    		jQuery('<td/>', { text: recovery.FailedInstanceKey.Hostname+":"+recovery.FailedInstanceKey.Port }).appendTo(row);
+    		var successor = (recovery.SuccessorKey.Hostname ? recovery.SuccessorKey.Hostname+":"+recovery.SuccessorKey.Port : "");
+    		jQuery('<td/>', { text: successor }).appendTo(row);
+    		var affectedSlaves = (recovery.AffectedSlaveKeys || []).map(function (key) {
+    			return key.Hostname+":"+key.Port;
+    		});
+    		jQuery('<td/>', { text: affectedSlaves.join(", ") }).appendTo(row);
+    		jQuery('<td/>', { text: recovery.IsSuccessful ? "yes" : "no" }).appendTo(row);
+    		if (recovery.Acknowledged) {
+    			var acknowledgedText = recovery.AcknowledgedBy + " at " + recovery.AcknowledgedAt;
+    			if (recovery.AcknowledgedComment) {
+    				acknowledgedText += ": " + recovery.AcknowledgedComment;
+    			}
+    			jQuery('<td/>', { text: acknowledgedText }).appendTo(row);
+    		} else {
+    			jQuery('<td/>').append('<button class="btn btn-xs btn-primary" data-command="acknowledge_recovery" data-recovery-id="'+recovery.Id+'">Acknowledge</button>').appendTo(row);
+    		}
+    		row.appendTo('#recovery_history tbody');    		
+    	});
+        if (currentPage() <= 0) {
+        	$("#recovery_history .pager .previous").addClass("disabled");
+        }
+        if (recoveries.length == 0) {
+        	$("#recovery_history .pager .next").addClass("disabled");        	
+        }
+        $("#recovery_history .pager .previous").not(".disabled").find("a").click(function() {
+            window.location.href = "/web/recovery-history/"+(currentPage() - 1);
+        });
+        $("#recovery_history .pager .next").not(".disabled").find("a").click(function() {
+            window.location.href = "/web/recovery-history/"+(currentPage() + 1);
+        });
+        $("#recovery_history .pager .disabled a").click(function() {
+            return false;
+        });
+    }
+    $("body").on("click", "button[data-command=acknowledge_recovery]", function(event) {
+    	var recoveryId = $(event.target).attr("data-recovery-id");
+    	bootbox.prompt("Acknowledge recovery " + recoveryId + "? Please enter a comment", function(comment) {
+			if (comment !== null) {
+		    	showLoader();
+		        $.get("/api/acknowledge-recovery/" + recoveryId + "?comment=" + encodeURIComponent(comment), function (operationResult) {
+					hideLoader();
+					if (operationResult.Code == "ERROR") {
+						addAlert(operationResult.Message)
+					} else {
+						location.reload();
+					}	
+		        }, "json");
+			}
+        });
+    });
+});	
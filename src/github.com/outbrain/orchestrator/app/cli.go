@@ -26,8 +26,18 @@ import (
 	"strings"
 )
 
+// printPlan prints the statements planned by a dry run, one per line, along with the instance each applies to
+func printPlan(plan []inst.PlannedStatement, err error) {
+	if err != nil {
+		log.Fatale(err)
+	}
+	for _, plannedStatement := range plan {
+		fmt.Println(fmt.Sprintf("%s\t%s", plannedStatement.Key.DisplayString(), plannedStatement.Statement))
+	}
+}
+
 // Cli initiates a command line interface, executing requested command.
-func Cli(command string, instance string, sibling string, owner string, reason string) {
+func Cli(command string, instance string, sibling string, owner string, reason string, pattern string, dryRun bool, force bool) {
 
 	instanceKey, err := inst.ParseInstanceKey(instance)
 	if err != nil {
@@ -48,7 +58,7 @@ func Cli(command string, instance string, sibling string, owner string, reason s
 	}
 
 	if len(command) == 0 {
-		log.Fatal("expected command (-c) (discover|forget|continuous|move-up|move-below|make-co-master|match-below|reset-slave|set-read-only|set-writeable|begin-maintenance|end-maintenance|clusters|topology|resolve)")
+		log.Fatal("expected command (-c) (discover|forget|continuous|move-up|move-below|make-co-master|match-below|match-below-offline|make-master|relocate|relocate-slaves|graceful-master-takeover|reset-slave|set-read-only|set-writeable|reset-errant-transactions|begin-maintenance|end-maintenance|clusters|topology|resolve|binlog-purge-advice|purge-binary-logs)")
 	}
 	switch command {
 	case "move-up":
@@ -56,6 +66,10 @@ func Cli(command string, instance string, sibling string, owner string, reason s
 			if instanceKey == nil {
 				log.Fatal("Cannot deduce instance:", instance)
 			}
+			if dryRun {
+				printPlan(inst.PlanMoveUp(instanceKey))
+				return
+			}
 			_, err := inst.MoveUp(instanceKey)
 			if err != nil {
 				log.Errore(err)
@@ -69,6 +83,10 @@ func Cli(command string, instance string, sibling string, owner string, reason s
 			if siblingKey == nil {
 				log.Fatal("Cannot deduce sibling:", sibling)
 			}
+			if dryRun {
+				printPlan(inst.PlanMoveBelow(instanceKey, siblingKey))
+				return
+			}
 			_, err := inst.MoveBelow(instanceKey, siblingKey)
 			if err != nil {
 				log.Errore(err)
@@ -79,6 +97,10 @@ func Cli(command string, instance string, sibling string, owner string, reason s
 			if instanceKey == nil {
 				log.Fatal("Cannot deduce instance:", instance)
 			}
+			if dryRun {
+				printPlan(inst.PlanMakeCoMaster(instanceKey))
+				return
+			}
 			_, err := inst.MakeCoMaster(instanceKey)
 			if err != nil {
 				log.Errore(err)
@@ -92,7 +114,96 @@ func Cli(command string, instance string, sibling string, owner string, reason s
 			if siblingKey == nil {
 				log.Fatal("Cannot deduce sibling:", sibling)
 			}
-			_, err := inst.MatchBelow(instanceKey, siblingKey, true, true)
+			if dryRun {
+				planMatchBelow := inst.PlanMatchBelow
+				if force {
+					planMatchBelow = inst.PlanForceMatchBelow
+				}
+				printPlan(planMatchBelow(instanceKey, siblingKey))
+				return
+			}
+			matchBelow := inst.MatchBelow
+			if force {
+				matchBelow = inst.ForceMatchBelow
+			}
+			_, err := matchBelow(instanceKey, siblingKey, true, true)
+			if err != nil {
+				log.Errore(err)
+			}
+		}
+	case "match-below-offline":
+		{
+			// Here -i and -s list files (comma separated): binary logs, or captured SHOW BINLOG EVENTS output,
+			// of the instance and of the instance to match below, respectively
+			if len(instance) == 0 {
+				log.Fatal("expected instance binary log files (-i)")
+			}
+			if len(sibling) == 0 {
+				log.Fatal("expected sibling binary log files (-s)")
+			}
+			coordinates, err := inst.MatchBelowOffline(strings.Split(instance, ","), strings.Split(sibling, ","))
+			if err != nil {
+				log.Fatale(err)
+			}
+			fmt.Println(fmt.Sprintf("%s:%d", coordinates.LogFile, coordinates.LogPos))
+		}
+	case "make-master":
+		{
+			if instanceKey == nil {
+				log.Fatal("Cannot deduce instance:", instance)
+			}
+			if dryRun {
+				printPlan(inst.PlanMakeMaster(instanceKey))
+				return
+			}
+			_, err := orchestrator.MakeMaster(instanceKey)
+			if err != nil {
+				log.Errore(err)
+			}
+		}
+	case "relocate":
+		{
+			if instanceKey == nil {
+				log.Fatal("Cannot deduce instance:", instance)
+			}
+			if siblingKey == nil {
+				log.Fatal("Cannot deduce target instance:", sibling)
+			}
+			if dryRun {
+				printPlan(inst.PlanRelocate(instanceKey, siblingKey))
+				return
+			}
+			_, err := inst.Relocate(instanceKey, siblingKey)
+			if err != nil {
+				log.Errore(err)
+			}
+		}
+	case "relocate-slaves":
+		{
+			if instanceKey == nil {
+				log.Fatal("Cannot deduce instance:", instance)
+			}
+			if siblingKey == nil {
+				log.Fatal("Cannot deduce target instance:", sibling)
+			}
+			results, err := inst.RelocateSlaves(instanceKey, siblingKey, pattern)
+			for _, result := range results {
+				if result.Success {
+					fmt.Println(fmt.Sprintf("%s\t%s\tok", result.Key.DisplayString(), result.Method))
+				} else {
+					fmt.Println(fmt.Sprintf("%s\t%s\tfailed: %s", result.Key.DisplayString(), result.Method, result.Error))
+				}
+			}
+			if err != nil {
+				log.Errore(err)
+			}
+		}
+	case "graceful-master-takeover":
+		{
+			if instanceKey == nil {
+				log.Fatal("Cannot deduce instance:", instance)
+			}
+			_, err := orchestrator.GracefulMasterTakeover(instanceKey)
 			if err != nil {
 				log.Errore(err)
 			}
@@ -127,6 +238,37 @@ func Cli(command string, instance string, sibling string, owner string, reason s
 				log.Errore(err)
 			}
 		}
+	case "binlog-purge-advice":
+		{
+			if instanceKey == nil {
+				log.Fatal("Cannot deduce instance:", instance)
+			}
+			advice, err := inst.GetBinlogPurgeAdvice(instanceKey)
+			if err != nil {
+				log.Fatale(err)
+			}
+			fmt.Println(fmt.Sprintf("newest consumed: %s\tpurge to: %s", advice.NewestConsumedBinlog, advice.PurgeToBinlog))
+		}
+	case "purge-binary-logs":
+		{
+			if instanceKey == nil {
+				log.Fatal("Cannot deduce instance:", instance)
+			}
+			if dryRun {
+				advice, err := inst.GetBinlogPurgeAdvice(instanceKey)
+				if err != nil {
+					log.Fatale(err)
+				}
+				if advice.HasPurgeableBinaryLogs() {
+					fmt.Println(fmt.Sprintf("%s\tpurge binary logs to '%s'", instanceKey.DisplayString(), advice.PurgeToBinlog))
+				}
+				return
+			}
+			_, err := inst.PurgeBinaryLogs(instanceKey)
+			if err != nil {
+				log.Errore(err)
+			}
+		}
 	case "discover":
 		{
 			if instanceKey == nil {
@@ -141,6 +283,15 @@ func Cli(command string, instance string, sibling string, owner string, reason s
 			}
 			inst.ForgetInstance(instanceKey)
 		}
+	case "reset-errant-transactions":
+		{
+			if instanceKey == nil {
+				log.Fatal("Cannot deduce instance:", instance)
+			}
+			if err := inst.ResetErrantTransactions(instanceKey); err != nil {
+				log.Errore(err)
+			}
+		}
 	case "begin-maintenance":
 		{
 			if instanceKey == nil {
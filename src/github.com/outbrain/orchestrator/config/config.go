@@ -23,6 +23,27 @@ import (
 	"github.com/outbrain/golib/log"
 )
 
+// RecoveryHook is an external command executed upon recovery, with a timeout.
+// Command may contain the placeholders {failedHost}, {failedPort}, {successorHost}, {successorPort}, {clusterName}
+type RecoveryHook struct {
+	Command        string
+	TimeoutSeconds int // Number of seconds after which the command is killed. A non-positive value means no timeout
+}
+
+// SlaveDiscovery selects the method by which slaves are discovered, for instances of clusters matching ClusterFilter.
+// Method is one of:
+// "show-slave-hosts": SHOW SLAVE HOSTS, which relies on slaves' report_host & report_port
+// "processlist": hosts of Binlog Dump connections in the master's processlist
+// "inventory-file": a JSON file mapping masters to their slaves, e.g. {"master:3306": ["slave1:3306", "slave2:3307"]}
+// "inventory-http": a JSON list of slaves, e.g. ["slave1:3306", "slave2:3307"], served on InventoryURL. The URL may
+// contain the placeholders {host}, {port}, {clusterName}
+type SlaveDiscovery struct {
+	ClusterFilter string // Regexp pattern matched against the cluster name
+	Method        string
+	InventoryFile string
+	InventoryURL  string
+}
+
 // Configuration makes for orchestrator configuration input, which can be provided by user via JSON formatted file.
 // Some of the parameteres have reasonable default values, and some (like database credentials) are
 // strictly expected from user.
@@ -36,12 +57,18 @@ type Configuration struct {
 	MySQLOrchestratorUser                      string
 	MySQLOrchestratorPassword                  string
 	MySQLConnectTimeoutSeconds                 int    // Number of seconds before connection is aborted (driver-side)
+	MySQLTopologyQueryTimeoutSeconds           int    // Number of seconds after which a read query of an instance probe is cancelled. 0 means no timeout
+	InstanceProbeTimeoutSeconds                int    // Number of seconds after which reading a topology instance (all queries) is cancelled. 0 means no timeout
 	SlaveLagQuery                              string // custom query to check on slave lg (e.g. heartbeat table)
 	SlaveStartPostWaitMilliseconds             int    // Time to wait after START SLAVE before re-readong instance (give slave chance to connect to master)
+	MasterPosWaitTimeoutSeconds                int    // Number of seconds to wait for a slave to execute up to given coordinates (e.g. on graceful master takeover)
 	DiscoverByShowSlaveHosts                   bool   // Attempt SHOW SLAVE HOSTS before PROCESSLIST
 	InstancePollSeconds                        uint   // Number of seconds between instance reads
 	UnseenInstanceForgetHours                  uint   // Number of hours after which an unseen instance is forgotten
+	InstanceHistoryRetentionHours              uint   // Number of hours for which instance status snapshots are kept. 0 disables history
 	DiscoveryPollSeconds                       int    // Auto/continuous discovery of instances sleep time between polls
+	DiscoveryMaxConcurrency                    uint   // Number of instances probed concurrently by discovery
+	DiscoveryMaxConcurrencyPerHost             uint   // Number of instances on a single host probed concurrently by discovery. 0 for no limit
 	HostnameResolveMethod                      string // Method by which to "normalize" hostname ("none"/"cname")
 	ExpiryHostnameResolvesMinutes              int    // Number of minutes after which to expire hostname-resolves
 	ReasonableReplicationLagSeconds            int    // Abvoe this value is considered a problem
@@ -66,6 +93,24 @@ type Configuration struct {
 	StaleSeedFailMinutes                       uint              // Number of minutes after which a stale (no progress) seed is considered failed.
 	SeedAcceptableBytesDiff                    int64             // Difference in bytes between seed source & target data size that is still considered as successful copy
 	PseudoGTIDPattern                          string            // Pattern to look for in binary logs that makes for a unique entry (pseudo GTID). When empty, Pseudo-GTID based refactoring is disabled.
+	RecoverMasterClusterFilters                []string          // Only do automated master recovery on clusters matching these regexp patterns (e.g. ".*" for all clusters)
+	RecoverIntermediateMasterClusterFilters    []string          // Only do automated intermediate master recovery on clusters matching these regexp patterns (e.g. ".*" for all clusters)
+	RecoveryPeriodBlockMinutes                 int               // Minimal number of minutes between two automated recoveries on same cluster
+	PreRecoveryHooks                           []RecoveryHook    // Hooks to execute before a recovery, in order. A failing hook aborts the recovery
+	PostRecoveryHooks                          []RecoveryHook    // Hooks to execute after a successful recovery, in order
+	PseudoGTIDIndexEnabled                     bool              // When true (and PseudoGTIDPattern is set), pseudo-GTID entries are indexed during discovery, saving binary log scans on match-below
+	ErrantTransactionsCheckEnabled             bool              // When true (and PseudoGTIDPattern is set), slaves are checked during discovery for binlog events their master never had
+	PurgeBinaryLogsRetentionFiles              uint              // Number of binary logs, already consumed by all slaves, to retain when purging binary logs
+	SlaveDiscoveries                           []SlaveDiscovery  // Per cluster slave discovery methods; the first matching entry applies. Clusters matching none follow DiscoverByShowSlaveHosts
+	PseudoGTIDInjectionIntervalSeconds         uint              // Interval between pseudo-GTID injections on masters. 0 disables built-in injection
+	PseudoGTIDInjectionClusterFilters          []string          // Only inject pseudo-GTID on masters of clusters matching these regexp patterns (e.g. ".*" for all clusters)
+	PseudoGTIDInjectionStatement               string            // Statement injected on masters. {uniqueId} is replaced with a unique token. Must match PseudoGTIDPattern
+	ProblemNotificationWebhooks                []string          // URLs to which notifications of opened & resolved instance problems are POSTed as JSON
+	ProblemNotificationSMTPServer              string            // host:port of SMTP server through which problem notifications are mailed. Empty disables mail notifications
+	ProblemNotificationMailFrom                string            // Sender address of problem notification mails
+	ProblemNotificationMailTo                  []string          // Recipients of problem notification mails
+	ProblemNotificationClusterIntervalSeconds  uint              // Minimal number of seconds between two notifications on same cluster. Notifications are held back meanwhile
+	ProblemNotificationTimeoutSeconds          int               // Number of seconds after which sending a notification is aborted
 }
 
 var Config *Configuration = NewConfiguration()
@@ -74,11 +119,17 @@ func NewConfiguration() *Configuration {
 	return &Configuration{
 		ListenAddress:                              ":3000",
 		MySQLConnectTimeoutSeconds:                 5,
+		MySQLTopologyQueryTimeoutSeconds:           10,
+		InstanceProbeTimeoutSeconds:                30,
 		InstancePollSeconds:                        60,
 		UnseenInstanceForgetHours:                  240,
+		InstanceHistoryRetentionHours:              72,
 		SlaveStartPostWaitMilliseconds:             1000,
+		MasterPosWaitTimeoutSeconds:                60,
 		DiscoverByShowSlaveHosts:                   false,
 		DiscoveryPollSeconds:                       5,
+		DiscoveryMaxConcurrency:                    10,
+		DiscoveryMaxConcurrencyPerHost:             2,
 		HostnameResolveMethod:                      "cname",
 		ExpiryHostnameResolvesMinutes:              60,
 		ReasonableReplicationLagSeconds:            10,
@@ -103,6 +154,24 @@ func NewConfiguration() *Configuration {
 		StaleSeedFailMinutes:                       60,
 		SeedAcceptableBytesDiff:                    8192,
 		PseudoGTIDPattern:                          "",
+		RecoverMasterClusterFilters:                []string{},
+		RecoverIntermediateMasterClusterFilters:    []string{},
+		RecoveryPeriodBlockMinutes:                 60,
+		PreRecoveryHooks:                           []RecoveryHook{},
+		PostRecoveryHooks:                          []RecoveryHook{},
+		PseudoGTIDIndexEnabled:                     false,
+		ErrantTransactionsCheckEnabled:             false,
+		PurgeBinaryLogsRetentionFiles:              2,
+		SlaveDiscoveries:                           []SlaveDiscovery{},
+		PseudoGTIDInjectionIntervalSeconds:         0,
+		PseudoGTIDInjectionClusterFilters:          []string{},
+		PseudoGTIDInjectionStatement:               "create or replace view meta.pseudo_gtid_v as select '{uniqueId}' as pseudo_gtid_unique_val from dual",
+		ProblemNotificationWebhooks:                []string{},
+		ProblemNotificationSMTPServer:              "",
+		ProblemNotificationMailFrom:                "orchestrator",
+		ProblemNotificationMailTo:                  []string{},
+		ProblemNotificationClusterIntervalSeconds:  60,
+		ProblemNotificationTimeoutSeconds:          10,
 	}
 }
 
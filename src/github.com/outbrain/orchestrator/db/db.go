@@ -172,6 +172,120 @@ var generateSQL = []string{
 		  KEY resolved_timestamp_idx (resolved_timestamp)
 		) ENGINE=InnoDB DEFAULT CHARSET=ascii
 	`,
+	`
+		CREATE TABLE IF NOT EXISTS topology_recovery (
+		  recovery_id bigint unsigned NOT NULL AUTO_INCREMENT,
+		  hostname varchar(128) NOT NULL,
+		  port smallint(5) unsigned NOT NULL,
+		  cluster_name varchar(128) NOT NULL,
+		  recovery_type varchar(128) NOT NULL,
+		  is_automated tinyint unsigned NOT NULL DEFAULT '0',
+		  start_recovery timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		  end_recovery timestamp NULL DEFAULT NULL,
+		  successor_hostname varchar(128) NOT NULL DEFAULT '',
+		  successor_port smallint(5) unsigned NOT NULL DEFAULT '0',
+		  affected_slave_keys text NOT NULL,
+		  is_successful tinyint unsigned NOT NULL DEFAULT '0',
+		  acknowledged tinyint unsigned NOT NULL DEFAULT '0',
+		  acknowledged_by varchar(128) NOT NULL DEFAULT '',
+		  acknowledged_at timestamp NULL DEFAULT NULL,
+		  acknowledge_comment text NOT NULL,
+		  PRIMARY KEY (recovery_id),
+		  KEY hostname_port_idx (hostname,port,start_recovery),
+		  KEY cluster_name_idx (cluster_name,start_recovery),
+		  KEY start_recovery_idx (start_recovery)
+		) ENGINE=InnoDB DEFAULT CHARSET=ascii
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS pseudo_gtid_index (
+		  hostname varchar(128) NOT NULL,
+		  port smallint(5) unsigned NOT NULL,
+		  entry_hash char(32) NOT NULL,
+		  binary_log_file varchar(128) NOT NULL,
+		  binary_log_pos bigint unsigned NOT NULL,
+		  entry_text text NOT NULL,
+		  indexed_timestamp timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		  PRIMARY KEY (hostname,port,entry_hash),
+		  KEY binary_log_idx (hostname,port,binary_log_file,binary_log_pos),
+		  KEY indexed_timestamp_idx (indexed_timestamp)
+		) ENGINE=InnoDB DEFAULT CHARSET=ascii
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS pseudo_gtid_index_progress (
+		  hostname varchar(128) NOT NULL,
+		  port smallint(5) unsigned NOT NULL,
+		  binary_log_file varchar(128) NOT NULL,
+		  binary_log_pos bigint unsigned NOT NULL,
+		  last_indexed timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		  PRIMARY KEY (hostname,port)
+		) ENGINE=InnoDB DEFAULT CHARSET=ascii
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS errant_transactions_check (
+		  hostname varchar(128) NOT NULL,
+		  port smallint(5) unsigned NOT NULL,
+		  master_host varchar(128) NOT NULL,
+		  master_port smallint(5) unsigned NOT NULL,
+		  binary_log_file varchar(128) NOT NULL,
+		  binary_log_pos bigint unsigned NOT NULL,
+		  master_log_file varchar(128) NOT NULL,
+		  master_log_pos bigint unsigned NOT NULL,
+		  last_checked timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		  PRIMARY KEY (hostname,port)
+		) ENGINE=InnoDB DEFAULT CHARSET=ascii
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS database_instance_history (
+		  history_id bigint unsigned NOT NULL AUTO_INCREMENT,
+		  hostname varchar(128) NOT NULL,
+		  port smallint(5) unsigned NOT NULL,
+		  snapshot_timestamp timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		  check_outcome varchar(32) NOT NULL,
+		  slave_sql_running tinyint(3) unsigned NOT NULL,
+		  slave_io_running tinyint(3) unsigned NOT NULL,
+		  seconds_behind_master bigint(20) unsigned DEFAULT NULL,
+		  slave_lag_seconds bigint(20) unsigned DEFAULT NULL,
+		  binary_log_file varchar(128) NOT NULL,
+		  binary_log_pos bigint(20) unsigned NOT NULL,
+		  master_log_file varchar(128) NOT NULL,
+		  read_master_log_pos bigint(20) unsigned NOT NULL,
+		  relay_master_log_file varchar(128) NOT NULL,
+		  exec_master_log_pos bigint(20) unsigned NOT NULL,
+		  PRIMARY KEY (history_id),
+		  KEY instance_snapshot_idx (hostname,port,snapshot_timestamp),
+		  KEY snapshot_timestamp_idx (snapshot_timestamp)
+		) ENGINE=InnoDB DEFAULT CHARSET=ascii
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS topology_change_event (
+		  event_id bigint unsigned NOT NULL AUTO_INCREMENT,
+		  event_timestamp timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		  event_type varchar(64) NOT NULL,
+		  hostname varchar(128) NOT NULL,
+		  port smallint(5) unsigned NOT NULL,
+		  cluster_name varchar(128) NOT NULL,
+		  previous_value varchar(255) NOT NULL,
+		  new_value varchar(255) NOT NULL,
+		  PRIMARY KEY (event_id),
+		  KEY event_timestamp_idx (event_timestamp),
+		  KEY instance_idx (hostname,port,event_timestamp)
+		) ENGINE=InnoDB DEFAULT CHARSET=ascii
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS topology_change_instance_state (
+		  hostname varchar(128) NOT NULL,
+		  port smallint(5) unsigned NOT NULL,
+		  server_id int(10) unsigned NOT NULL,
+		  version varchar(128) NOT NULL,
+		  read_only tinyint(3) unsigned NOT NULL,
+		  master_host varchar(128) NOT NULL,
+		  master_port smallint(5) unsigned NOT NULL,
+		  master_log_file varchar(128) NOT NULL,
+		  slave_sql_running tinyint(3) unsigned NOT NULL,
+		  slave_io_running tinyint(3) unsigned NOT NULL,
+		  PRIMARY KEY (hostname,port)
+		) ENGINE=InnoDB DEFAULT CHARSET=ascii
+	`,
 }
 
 var generateSQLPatches = []string{
@@ -195,6 +309,61 @@ var generateSQLPatches = []string{
 			database_instance
 			ADD COLUMN last_attempted_check TIMESTAMP AFTER last_checked
 	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN last_read_progress TIMESTAMP NULL DEFAULT NULL AFTER last_attempted_check
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN gtid_mode VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '' AFTER log_slave_updates
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN executed_gtid_set TEXT CHARACTER SET ascii NOT NULL AFTER gtid_mode
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN retrieved_gtid_set TEXT CHARACTER SET ascii NOT NULL AFTER executed_gtid_set
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN relay_log_file varchar(128) CHARACTER SET ascii NOT NULL AFTER exec_master_log_pos
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN relay_log_pos bigint(20) unsigned NOT NULL AFTER relay_log_file
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN has_errant_transactions TINYINT UNSIGNED NOT NULL DEFAULT 0
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN errant_binlog_file varchar(128) CHARACTER SET ascii NOT NULL DEFAULT '' AFTER has_errant_transactions
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN errant_binlog_pos bigint(20) unsigned NOT NULL DEFAULT 0 AFTER errant_binlog_file
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN last_check_outcome varchar(32) CHARACTER SET ascii NOT NULL DEFAULT '' AFTER last_read_progress
+	`,
+	`
+		ALTER TABLE 
+			database_instance
+			ADD COLUMN using_gtid_auto_position TINYINT UNSIGNED NOT NULL DEFAULT 0 AFTER retrieved_gtid_set
+	`,
 }
 
 // OpenTopology returns a DB instance to access a topology instance
@@ -18,6 +18,7 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/auth"
@@ -26,6 +27,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/outbrain/orchestrator/agent"
 	"github.com/outbrain/orchestrator/config"
@@ -66,6 +68,16 @@ type HttpAPI struct{}
 
 var API HttpAPI = HttpAPI{}
 
+const (
+	binlogEventsDefaultLimit = 100
+	binlogEventsMaxLimit     = 10000
+)
+
+const (
+	topologyChangesDefaultLimit = 100
+	topologyChangesMaxLimit     = 1000
+)
+
 func (this *HttpAPI) getProxyAuthUser(req *http.Request) string {
 	for _, user := range req.Header[config.Config.AuthUserHeader] {
 		return user
@@ -73,6 +85,33 @@ func (this *HttpAPI) getProxyAuthUser(req *http.Request) string {
 	return ""
 }
 
+// isDryRun checks whether given request only asks for the plan of an operation, via the "dry-run=1" query parameter
+func (this *HttpAPI) isDryRun(req *http.Request) bool {
+	return req.URL.Query().Get("dry-run") == "1"
+}
+
+// isForced checks whether the request asks to override safety checks (e.g. errant transactions)
+func (this *HttpAPI) isForced(req *http.Request) bool {
+	return req.URL.Query().Get("force") == "1"
+}
+
+// respondWithPlan responds with the statements an operation would execute, or with the error that prevents it
+func (this *HttpAPI) respondWithPlan(r render.Render, plan []inst.PlannedStatement, err error) {
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Dry run: %d statements planned", len(plan)), Details: plan})
+}
+
+// getUserId returns the authenticated user id, if available, depending on configured authentication method.
+func (this *HttpAPI) getUserId(req *http.Request, user auth.User) string {
+	if strings.ToLower(config.Config.AuthenticationMethod) == "proxy" {
+		return this.getProxyAuthUser(req)
+	}
+	return string(user)
+}
+
 // isAuthorizedForAction checks req to see whether authenticated user has write-privileges.
 // This depends on configured authentication method.
 func (this *HttpAPI) isAuthorizedForAction(req *http.Request, user auth.User) bool {
@@ -187,6 +226,27 @@ func (this *HttpAPI) Forget(params martini.Params, r render.Render, req *http.Re
 	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Instance forgotten: %+v", instanceKey)})
 }
 
+// ResetErrantTransactions clears the errant transactions flag of an instance, once its errant transactions
+// have been dealt with
+func (this *HttpAPI) ResetErrantTransactions(params martini.Params, r render.Render, req *http.Request, user auth.User) {
+	if !this.isAuthorizedForAction(req, user) {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: "Unauthorized"})
+		return
+	}
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	if err := inst.ResetErrantTransactions(&instanceKey); err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Errant transactions reset: %+v", instanceKey)})
+}
+
 // Resolve tries to resolve hostname and then checks to see if port is open on that host.
 func (this *HttpAPI) Resolve(params martini.Params, r render.Render, req *http.Request) {
 	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
@@ -292,6 +352,11 @@ func (this *HttpAPI) MoveUp(params martini.Params, r render.Render, req *http.Re
 		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
 	}
+	if this.isDryRun(req) {
+		plan, err := inst.PlanMoveUp(&instanceKey)
+		this.respondWithPlan(r, plan, err)
+		return
+	}
 	instance, err := inst.MoveUp(&instanceKey)
 	if err != nil {
 		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
@@ -313,6 +378,11 @@ func (this *HttpAPI) MakeCoMaster(params martini.Params, r render.Render, req *h
 		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
 	}
+	if this.isDryRun(req) {
+		plan, err := inst.PlanMakeCoMaster(&instanceKey)
+		this.respondWithPlan(r, plan, err)
+		return
+	}
 	instance, err := inst.MakeCoMaster(&instanceKey)
 	if err != nil {
 		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
@@ -360,6 +430,11 @@ func (this *HttpAPI) MoveBelow(params martini.Params, r render.Render, req *http
 		return
 	}
 
+	if this.isDryRun(req) {
+		plan, err := inst.PlanMoveBelow(&instanceKey, &siblingKey)
+		this.respondWithPlan(r, plan, err)
+		return
+	}
 	instance, err := inst.MoveBelow(&instanceKey, &siblingKey)
 	if err != nil {
 		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
@@ -386,7 +461,20 @@ func (this *HttpAPI) MatchBelow(params martini.Params, r render.Render, req *htt
 		return
 	}
 
-	instance, err := inst.MatchBelow(&instanceKey, &belowKey, true, true)
+	if this.isDryRun(req) {
+		planMatchBelow := inst.PlanMatchBelow
+		if this.isForced(req) {
+			planMatchBelow = inst.PlanForceMatchBelow
+		}
+		plan, err := planMatchBelow(&instanceKey, &belowKey)
+		this.respondWithPlan(r, plan, err)
+		return
+	}
+	matchBelow := inst.MatchBelow
+	if this.isForced(req) {
+		matchBelow = inst.ForceMatchBelow
+	}
+	instance, err := matchBelow(&instanceKey, &belowKey, true, true)
 	if err != nil {
 		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -395,6 +483,65 @@ func (this *HttpAPI) MatchBelow(params martini.Params, r render.Render, req *htt
 	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Instance %+v matched below %+v", instanceKey, belowKey), Details: instance})
 }
 
+// Relocate attempts to move an instance below another, wherever the two are in the topology, choosing the
+// refactoring strategy automatically. With "dry-run=1" the plan is returned without being executed.
+func (this *HttpAPI) Relocate(params martini.Params, r render.Render, req *http.Request, user auth.User) {
+	if !this.isAuthorizedForAction(req, user) {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: "Unauthorized"})
+		return
+	}
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	belowKey, err := this.getInstanceKey(params["belowHost"], params["belowPort"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	if this.isDryRun(req) {
+		plan, err := inst.PlanRelocate(&instanceKey, &belowKey)
+		this.respondWithPlan(r, plan, err)
+		return
+	}
+	instance, err := inst.Relocate(&instanceKey, &belowKey)
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Instance %+v relocated below %+v", instanceKey, belowKey), Details: instance})
+}
+
+// RelocateSlaves attempts to move all slaves of given instance below another instance, optionally filtered
+// by a regexp pattern given in the "pattern" query parameter. Results are reported per slave.
+func (this *HttpAPI) RelocateSlaves(params martini.Params, r render.Render, req *http.Request, user auth.User) {
+	if !this.isAuthorizedForAction(req, user) {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: "Unauthorized"})
+		return
+	}
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	belowKey, err := this.getInstanceKey(params["belowHost"], params["belowPort"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	results, err := inst.RelocateSlaves(&instanceKey, &belowKey, req.URL.Query().Get("pattern"))
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error(), Details: results})
+		return
+	}
+
+	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Relocated %d slaves of %+v below %+v", len(results), instanceKey, belowKey), Details: results})
+}
+
 // MakeMaster attempts to make the given instance a master, and match its siblings to be its slaves
 func (this *HttpAPI) MakeMaster(params martini.Params, r render.Render, req *http.Request, user auth.User) {
 	if !this.isAuthorizedForAction(req, user) {
@@ -407,7 +554,12 @@ func (this *HttpAPI) MakeMaster(params martini.Params, r render.Render, req *htt
 		return
 	}
 
-	instance, err := inst.MakeMaster(&instanceKey)
+	if this.isDryRun(req) {
+		plan, err := inst.PlanMakeMaster(&instanceKey)
+		this.respondWithPlan(r, plan, err)
+		return
+	}
+	instance, err := orchestrator.MakeMaster(&instanceKey)
 	if err != nil {
 		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -416,6 +568,28 @@ func (this *HttpAPI) MakeMaster(params martini.Params, r render.Render, req *htt
 	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Instance %+v now made master", instanceKey), Details: instance})
 }
 
+// GracefulMasterTakeover gracefully promotes the given instance in place of its master: the master is set read-only,
+// slaves catch up, siblings and the old master are repointed below the given instance, which is then made writeable.
+func (this *HttpAPI) GracefulMasterTakeover(params martini.Params, r render.Render, req *http.Request, user auth.User) {
+	if !this.isAuthorizedForAction(req, user) {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: "Unauthorized"})
+		return
+	}
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	instance, err := orchestrator.GracefulMasterTakeover(&instanceKey)
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Instance %+v has taken over as master", instanceKey), Details: instance})
+}
+
 // MakeLocalMaster attempts to make the given instance a local master: take over its master by
 // enslaving its siblings and replicating from its grandparent.
 func (this *HttpAPI) MakeLocalMaster(params martini.Params, r render.Render, req *http.Request, user auth.User) {
@@ -429,7 +603,7 @@ func (this *HttpAPI) MakeLocalMaster(params martini.Params, r render.Render, req
 		return
 	}
 
-	instance, err := inst.MakeLocalMaster(&instanceKey)
+	instance, err := orchestrator.MakeLocalMaster(&instanceKey)
 	if err != nil {
 		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
 		return
@@ -633,6 +807,250 @@ func (this *HttpAPI) Problems(params martini.Params, r render.Render, req *http.
 	r.JSON(200, instances)
 }
 
+// ReplicationAnalysis returns list of replication issues, per analyzed master/intermediate master
+func (this *HttpAPI) ReplicationAnalysis(params martini.Params, r render.Render, req *http.Request) {
+	analysis, err := inst.GetReplicationAnalysis()
+
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: fmt.Sprintf("Cannot get analysis: %+v", err)})
+		return
+	}
+
+	r.JSON(200, analysis)
+}
+
+// PseudoGTIDInjectionStatus reports the health of built-in pseudo-GTID injection on given instance
+func (this *HttpAPI) PseudoGTIDInjectionStatus(params martini.Params, r render.Render, req *http.Request) {
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	status, found := orchestrator.ReadPseudoGTIDInjectionStatus(&instanceKey)
+	if !found {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: fmt.Sprintf("No pseudo-GTID injection attempted on %+v", instanceKey)})
+		return
+	}
+
+	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Pseudo-GTID injection status on %+v", instanceKey), Details: status})
+}
+
+// getBinlogCoordinates parses binary log coordinates out of request params
+func (this *HttpAPI) getBinlogCoordinates(logFile string, logPos string) (inst.BinlogCoordinates, error) {
+	pos, err := strconv.ParseInt(logPos, 10, 64)
+	if err != nil {
+		return inst.BinlogCoordinates{}, errors.New(fmt.Sprintf("Invalid binlog position: %s", logPos))
+	}
+	return inst.BinlogCoordinates{LogFile: logFile, LogPos: pos}, nil
+}
+
+// getBinlogEventsLimit reads the "limit" query param, defaulting to binlogEventsDefaultLimit
+func (this *HttpAPI) getBinlogEventsLimit(req *http.Request) int {
+	limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return binlogEventsDefaultLimit
+	}
+	if limit > binlogEventsMaxLimit {
+		return binlogEventsMaxLimit
+	}
+	return limit
+}
+
+// InstanceHistory returns status snapshots of an instance, optionally since a given time (?since=2006-01-02 15:04:05);
+// by default covering the last hour
+func (this *HttpAPI) InstanceHistory(params martini.Params, r render.Render, req *http.Request) {
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	since := req.URL.Query().Get("since")
+	if since != "" {
+		if _, err := time.Parse("2006-01-02 15:04:05", since); err != nil {
+			r.JSON(200, &APIResponse{Code: ERROR, Message: fmt.Sprintf("Invalid since: %s. Expected format is 2006-01-02 15:04:05", since)})
+			return
+		}
+	}
+	history, err := inst.ReadInstanceHistory(&instanceKey, since)
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: fmt.Sprintf("%+v", err)})
+		return
+	}
+
+	r.JSON(200, history)
+}
+
+// getTopologyChangesParams reads the "since-id" and "limit" query params
+func (this *HttpAPI) getTopologyChangesParams(req *http.Request) (sinceEventId int64, limit int) {
+	sinceEventId, err := strconv.ParseInt(req.URL.Query().Get("since-id"), 10, 64)
+	if err != nil || sinceEventId < 0 {
+		sinceEventId = 0
+	}
+	limit, err = strconv.Atoi(req.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = topologyChangesDefaultLimit
+	}
+	if limit > topologyChangesMaxLimit {
+		limit = topologyChangesMaxLimit
+	}
+	return sinceEventId, limit
+}
+
+// TopologyChanges lists detected topology change events following a given event id (?since-id=), oldest first
+func (this *HttpAPI) TopologyChanges(params martini.Params, r render.Render, req *http.Request) {
+	sinceEventId, limit := this.getTopologyChangesParams(req)
+	events, err := inst.ReadTopologyChangeEvents(sinceEventId, limit)
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: fmt.Sprintf("%+v", err)})
+		return
+	}
+
+	r.JSON(200, events)
+}
+
+// TopologyChangesStream streams topology change events as server-sent events, starting after a given event id
+// (?since-id=). The stream is kept open until the client disconnects.
+func (this *HttpAPI) TopologyChangesStream(params martini.Params, w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sinceEventId, limit := this.getTopologyChangesParams(req)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		events, err := inst.ReadTopologyChangeEvents(sinceEventId, limit)
+		if err != nil {
+			return
+		}
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.EventId, event.EventType, data)
+			sinceEventId = event.EventId
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+		}
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DiscoveryMetrics provides counters of the discovery process: queue depth, instances being probed, probe latency
+func (this *HttpAPI) DiscoveryMetrics(params martini.Params, r render.Render, req *http.Request) {
+	r.JSON(200, orchestrator.ReadDiscoveryMetrics())
+}
+
+// BinlogPurgeAdvice tells which binary logs of an instance are no longer required by its slaves
+func (this *HttpAPI) BinlogPurgeAdvice(params martini.Params, r render.Render, req *http.Request) {
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	advice, err := inst.GetBinlogPurgeAdvice(&instanceKey)
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	r.JSON(200, advice)
+}
+
+// PurgeBinaryLogs purges binary logs of an instance which are no longer required by its slaves
+func (this *HttpAPI) PurgeBinaryLogs(params martini.Params, r render.Render, req *http.Request, user auth.User) {
+	if !this.isAuthorizedForAction(req, user) {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: "Unauthorized"})
+		return
+	}
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	advice, err := inst.PurgeBinaryLogs(&instanceKey)
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	if !advice.HasPurgeableBinaryLogs() {
+		r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("No binary logs to purge on %+v", instanceKey), Details: advice})
+		return
+	}
+
+	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Purged binary logs on %+v up to %s", instanceKey, advice.PurgeToBinlog), Details: advice})
+}
+
+// BinlogEvents returns binary log events of an instance, starting given coordinates, both raw and normalized
+func (this *HttpAPI) BinlogEvents(params martini.Params, r render.Render, req *http.Request) {
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	coordinates, err := this.getBinlogCoordinates(params["file"], params["pos"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	events, err := inst.ReadBinlogEvents(&instanceKey, coordinates, this.getBinlogEventsLimit(req))
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	r.JSON(200, events)
+}
+
+// CompareBinlogEvents walks the binary logs of two instances from given coordinates and returns the first diverging events
+func (this *HttpAPI) CompareBinlogEvents(params martini.Params, r render.Render, req *http.Request) {
+	instanceKey, err := this.getInstanceKey(params["host"], params["port"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	instanceCoordinates, err := this.getBinlogCoordinates(params["file"], params["pos"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	otherKey, err := this.getInstanceKey(params["otherHost"], params["otherPort"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	otherCoordinates, err := this.getBinlogCoordinates(params["otherFile"], params["otherPos"])
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	comparison, err := inst.CompareBinlogEvents(&instanceKey, instanceCoordinates, &otherKey, otherCoordinates, this.getBinlogEventsLimit(req))
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	message := fmt.Sprintf("No divergence found in %d events", comparison.ComparedEvents)
+	if comparison.Diverged {
+		message = fmt.Sprintf("Diverged after %d events: %s", comparison.ComparedEvents, comparison.Reason)
+	}
+
+	r.JSON(200, &APIResponse{Code: OK, Message: message, Details: comparison})
+}
+
 // Audit provides list of audit entries by given page number
 func (this *HttpAPI) Audit(params martini.Params, r render.Render, req *http.Request) {
 	page, err := strconv.Atoi(params["page"])
@@ -649,6 +1067,47 @@ func (this *HttpAPI) Audit(params martini.Params, r render.Render, req *http.Req
 	r.JSON(200, audits)
 }
 
+// RecoveryHistory provides list of automated and manual recoveries by given page number
+func (this *HttpAPI) RecoveryHistory(params martini.Params, r render.Render, req *http.Request) {
+	page, err := strconv.Atoi(params["page"])
+	if err != nil || page < 0 {
+		page = 0
+	}
+	recoveries, err := orchestrator.ReadRecentRecoveries(page)
+
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: fmt.Sprintf("%+v", err)})
+		return
+	}
+
+	r.JSON(200, recoveries)
+}
+
+// AcknowledgeRecovery acknowledges given recovery, such that it no longer blocks automated recoveries on its cluster.
+// An optional comment is read from the "comment" query parameter.
+func (this *HttpAPI) AcknowledgeRecovery(params martini.Params, r render.Render, req *http.Request, user auth.User) {
+	if !this.isAuthorizedForAction(req, user) {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: "Unauthorized"})
+		return
+	}
+	recoveryId, err := strconv.ParseInt(params["recoveryId"], 10, 0)
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+	owner := this.getUserId(req, user)
+	if owner == "" {
+		owner = "unknown"
+	}
+	err = orchestrator.AcknowledgeRecovery(recoveryId, owner, req.URL.Query().Get("comment"))
+	if err != nil {
+		r.JSON(200, &APIResponse{Code: ERROR, Message: err.Error()})
+		return
+	}
+
+	r.JSON(200, &APIResponse{Code: OK, Message: fmt.Sprintf("Recovery %d acknowledged", recoveryId), Details: recoveryId})
+}
+
 // LongQueries lists queries running for a long time, on all instances, optionally filtered by
 // arbitrary text
 func (this *HttpAPI) LongQueries(params martini.Params, r render.Render, req *http.Request) {
@@ -989,17 +1448,24 @@ func (this *HttpAPI) Headers(params martini.Params, r render.Render, req *http.R
 // RegisterRequests makes for the de-facto list of known API calls
 func (this *HttpAPI) RegisterRequests(m *martini.ClassicMartini) {
 	m.Get("/api/instance/:host/:port", this.Instance)
+	m.Get("/api/instance-history/:host/:port", this.InstanceHistory)
+	m.Get("/api/topology-changes", this.TopologyChanges)
+	m.Get("/api/topology-changes-stream", this.TopologyChangesStream)
 	m.Get("/api/discover/:host/:port", this.Discover)
 	m.Get("/api/refresh/:host/:port", this.Refresh)
 	m.Get("/api/forget/:host/:port", this.Forget)
+	m.Get("/api/reset-errant-transactions/:host/:port", this.ResetErrantTransactions)
 	m.Get("/api/resolve/:host/:port", this.Resolve)
 	m.Get("/api/move-up/:host/:port", this.MoveUp)
 	m.Get("/api/make-co-master/:host/:port", this.MakeCoMaster)
 	m.Get("/api/reset-slave/:host/:port", this.ResetSlave)
 	m.Get("/api/move-below/:host/:port/:siblingHost/:siblingPort", this.MoveBelow)
 	m.Get("/api/match-below/:host/:port/:belowHost/:belowPort", this.MatchBelow)
+	m.Get("/api/relocate/:host/:port/:belowHost/:belowPort", this.Relocate)
+	m.Get("/api/relocate-slaves/:host/:port/:belowHost/:belowPort", this.RelocateSlaves)
 	m.Get("/api/make-master/:host/:port", this.MakeMaster)
 	m.Get("/api/make-local-master/:host/:port", this.MakeLocalMaster)
+	m.Get("/api/graceful-master-takeover/:host/:port", this.GracefulMasterTakeover)
 	m.Get("/api/begin-maintenance/:host/:port/:owner/:reason", this.BeginMaintenance)
 	m.Get("/api/end-maintenance/:host/:port", this.EndMaintenanceByInstanceKey)
 	m.Get("/api/end-maintenance/:maintenanceKey", this.EndMaintenance)
@@ -1016,10 +1482,20 @@ func (this *HttpAPI) RegisterRequests(m *martini.ClassicMartini) {
 	m.Get("/api/search/:searchString", this.Search)
 	m.Get("/api/search", this.Search)
 	m.Get("/api/problems", this.Problems)
+	m.Get("/api/replication-analysis", this.ReplicationAnalysis)
+	m.Get("/api/discovery-metrics", this.DiscoveryMetrics)
+	m.Get("/api/pseudo-gtid-injection/:host/:port", this.PseudoGTIDInjectionStatus)
+	m.Get("/api/binlog-purge-advice/:host/:port", this.BinlogPurgeAdvice)
+	m.Get("/api/purge-binary-logs/:host/:port", this.PurgeBinaryLogs)
+	m.Get("/api/binlog-events/:host/:port/:file/:pos", this.BinlogEvents)
+	m.Get("/api/compare-binlog-events/:host/:port/:file/:pos/:otherHost/:otherPort/:otherFile/:otherPos", this.CompareBinlogEvents)
 	m.Get("/api/long-queries", this.LongQueries)
 	m.Get("/api/long-queries/:filter", this.LongQueries)
 	m.Get("/api/audit", this.Audit)
 	m.Get("/api/audit/:page", this.Audit)
+	m.Get("/api/recovery-history", this.RecoveryHistory)
+	m.Get("/api/recovery-history/:page", this.RecoveryHistory)
+	m.Get("/api/acknowledge-recovery/:recoveryId", this.AcknowledgeRecovery)
 	m.Get("/api/agents", this.Agents)
 	m.Get("/api/agent/:host", this.Agent)
 	m.Get("/api/agent-umount/:host", this.AgentUnmount)
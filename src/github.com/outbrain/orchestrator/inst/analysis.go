@@ -0,0 +1,54 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+// AnalysisCode is the name of a replication state as concluded by replication analysis
+type AnalysisCode string
+
+const (
+	NoProblem                                 AnalysisCode = "NoProblem"
+	DeadMasterWithoutSlaves                   AnalysisCode = "DeadMasterWithoutSlaves"
+	DeadMaster                                AnalysisCode = "DeadMaster"
+	DeadMasterAndSlaves                       AnalysisCode = "DeadMasterAndSlaves"
+	DeadMasterAndSomeSlaves                   AnalysisCode = "DeadMasterAndSomeSlaves"
+	UnreachableMaster                         AnalysisCode = "UnreachableMaster"
+	AllMasterSlavesNotReplicating             AnalysisCode = "AllMasterSlavesNotReplicating"
+	AllSlavesLagging                          AnalysisCode = "AllSlavesLagging"
+	DeadIntermediateMaster                    AnalysisCode = "DeadIntermediateMaster"
+	DeadIntermediateMasterAndSlaves           AnalysisCode = "DeadIntermediateMasterAndSlaves"
+	DeadIntermediateMasterAndSomeSlaves       AnalysisCode = "DeadIntermediateMasterAndSomeSlaves"
+	UnreachableIntermediateMaster             AnalysisCode = "UnreachableIntermediateMaster"
+	AllIntermediateMasterSlavesNotReplicating AnalysisCode = "AllIntermediateMasterSlavesNotReplicating"
+)
+
+// ReplicationAnalysis notes analysis on replication chain status, per instance
+type ReplicationAnalysis struct {
+	AnalyzedInstanceKey                 InstanceKey
+	AnalyzedInstanceMasterKey           InstanceKey
+	ClusterName                         string
+	IsMaster                            bool
+	LastCheckValid                      bool
+	CountSlaves                         uint
+	CountValidSlaves                    uint
+	CountValidReplicatingSlaves         uint
+	CountSlavesFailingToConnectToMaster uint
+	CountValidNonReadingSlaves          uint
+	CountStaleSlaves                    uint
+	CountLaggingSlaves                  uint
+	Analysis                            AnalysisCode
+	Description                         string
+}
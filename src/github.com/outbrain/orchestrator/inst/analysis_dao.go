@@ -0,0 +1,169 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/db"
+)
+
+// GetReplicationAnalysis will check for replication problems (dead master; unreachable master; etc)
+// It analyzes each instance which is a master (or intermediate master) by combining its own check status
+// with the status reported by its slaves: IO thread state, IO errors and read coordinates progress.
+// Only instances found to have problems are returned.
+func GetReplicationAnalysis() ([]ReplicationAnalysis, error) {
+	result := []ReplicationAnalysis{}
+
+	query := fmt.Sprintf(`
+		select 
+			master_instance.hostname,
+			master_instance.port,
+			master_instance.master_host,
+			master_instance.master_port,
+			master_instance.cluster_name,
+			(master_instance.last_checked <= master_instance.last_seen) is true as is_last_check_valid,
+			master_master_instance.hostname is null as is_master,
+			count(slave_instance.server_id) as count_slaves,
+			ifnull(sum(slave_instance.last_checked <= slave_instance.last_seen), 0) as count_valid_slaves,
+			ifnull(sum(slave_instance.last_checked <= slave_instance.last_seen
+				and slave_instance.slave_io_running != 0), 0) as count_valid_replicating_slaves,
+			ifnull(sum(slave_instance.last_checked <= slave_instance.last_seen
+				and slave_instance.slave_io_running = 0
+				and slave_instance.last_io_error like '%%error %%connecting to master%%'), 0) as count_slaves_failing_to_connect_to_master,
+			ifnull(sum(slave_instance.last_checked <= slave_instance.last_seen
+				and (slave_instance.slave_io_running = 0
+					or slave_instance.last_io_error like '%%error %%connecting to master%%')), 0) as count_valid_non_reading_slaves,
+			ifnull(sum(slave_instance.last_checked <= slave_instance.last_seen
+				and slave_instance.slave_io_running != 0
+				and ifnull(slave_instance.last_read_progress < slave_instance.last_checked, true)), 0) as count_stale_slaves,
+			ifnull(sum(slave_instance.last_checked <= slave_instance.last_seen
+				and slave_instance.slave_lag_seconds > %d), 0) as count_lagging_slaves
+		from 
+			database_instance master_instance
+			left join database_instance master_master_instance on (
+				master_instance.master_host = master_master_instance.hostname 
+				and master_instance.master_port = master_master_instance.port)
+			left join database_instance slave_instance on (
+				slave_instance.master_host = master_instance.hostname 
+				and slave_instance.master_port = master_instance.port)
+		group by
+			master_instance.hostname, 
+			master_instance.port
+		having
+			is_master
+			or count_slaves > 0
+		order by
+			master_instance.cluster_name,
+			is_master desc,
+			master_instance.hostname,
+			master_instance.port
+		`, config.Config.ReasonableReplicationLagSeconds)
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		goto Cleanup
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		a := ReplicationAnalysis{Analysis: NoProblem}
+		a.AnalyzedInstanceKey = InstanceKey{Hostname: m.GetString("hostname"), Port: m.GetInt("port")}
+		a.AnalyzedInstanceMasterKey = InstanceKey{Hostname: m.GetString("master_host"), Port: m.GetInt("master_port")}
+		a.ClusterName = m.GetString("cluster_name")
+		a.LastCheckValid = m.GetBool("is_last_check_valid")
+		a.IsMaster = m.GetBool("is_master")
+		a.CountSlaves = m.GetUint("count_slaves")
+		a.CountValidSlaves = m.GetUint("count_valid_slaves")
+		a.CountValidReplicatingSlaves = m.GetUint("count_valid_replicating_slaves")
+		a.CountSlavesFailingToConnectToMaster = m.GetUint("count_slaves_failing_to_connect_to_master")
+		a.CountValidNonReadingSlaves = m.GetUint("count_valid_non_reading_slaves")
+		a.CountStaleSlaves = m.GetUint("count_stale_slaves")
+		a.CountLaggingSlaves = m.GetUint("count_lagging_slaves")
+
+		analyzeReplication(&a)
+		if a.Analysis != NoProblem {
+			result = append(result, a)
+		}
+		return nil
+	})
+
+Cleanup:
+	if err != nil {
+		log.Errore(err)
+	}
+	return result, err
+}
+
+// analyzeReplication concludes the replication state of an analyzed instance based on its check status
+// and on its slaves' reported status.
+func analyzeReplication(a *ReplicationAnalysis) {
+	// Valid slaves which do not get data from their master: either the IO thread is not running, or it reports
+	// failure to connect to the master. Read coordinates which have not advanced do not count: an idle master
+	// is not a dead master.
+	allValidSlavesNotReading := (a.CountValidSlaves > 0 && a.CountValidNonReadingSlaves == a.CountValidSlaves)
+
+	if a.IsMaster {
+		switch {
+		case !a.LastCheckValid && a.CountSlaves == 0:
+			a.Analysis = DeadMasterWithoutSlaves
+			a.Description = "Master cannot be reached by orchestrator and has no slave"
+		case !a.LastCheckValid && a.CountValidSlaves == 0:
+			a.Analysis = DeadMasterAndSlaves
+			a.Description = "Master cannot be reached by orchestrator and none of its slaves is reachable"
+		case !a.LastCheckValid && allValidSlavesNotReading && a.CountValidSlaves == a.CountSlaves:
+			a.Analysis = DeadMaster
+			a.Description = "Master cannot be reached by orchestrator and none of its slaves is replicating"
+		case !a.LastCheckValid && allValidSlavesNotReading:
+			a.Analysis = DeadMasterAndSomeSlaves
+			a.Description = "Master cannot be reached by orchestrator; some of its slaves are unreachable and none of its slaves is replicating"
+		case !a.LastCheckValid:
+			a.Analysis = UnreachableMaster
+			a.Description = "Master cannot be reached by orchestrator but it has replicating slaves; possibly a network/host issue"
+		case a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0:
+			a.Analysis = AllMasterSlavesNotReplicating
+			a.Description = "Master is reachable but none of its slaves is replicating"
+		case a.CountValidSlaves > 0 && a.CountLaggingSlaves == a.CountValidSlaves:
+			a.Analysis = AllSlavesLagging
+			a.Description = "Master is reachable but all of its slaves are lagging"
+		}
+	} else {
+		switch {
+		case !a.LastCheckValid && a.CountValidSlaves == 0:
+			a.Analysis = DeadIntermediateMasterAndSlaves
+			a.Description = "Intermediate master cannot be reached by orchestrator and none of its slaves is reachable"
+		case !a.LastCheckValid && allValidSlavesNotReading && a.CountValidSlaves == a.CountSlaves:
+			a.Analysis = DeadIntermediateMaster
+			a.Description = "Intermediate master cannot be reached by orchestrator and none of its slaves is replicating"
+		case !a.LastCheckValid && allValidSlavesNotReading:
+			a.Analysis = DeadIntermediateMasterAndSomeSlaves
+			a.Description = "Intermediate master cannot be reached by orchestrator; some of its slaves are unreachable and none of its slaves is replicating"
+		case !a.LastCheckValid:
+			a.Analysis = UnreachableIntermediateMaster
+			a.Description = "Intermediate master cannot be reached by orchestrator but it has replicating slaves; possibly a network/host issue"
+		case a.CountValidSlaves > 0 && a.CountValidReplicatingSlaves == 0:
+			a.Analysis = AllIntermediateMasterSlavesNotReplicating
+			a.Description = "Intermediate master is reachable but none of its slaves is replicating"
+		}
+	}
+	if a.Analysis != NoProblem && a.CountSlavesFailingToConnectToMaster > 0 {
+		a.Description = fmt.Sprintf("%s; %d slaves report failure to connect to master", a.Description, a.CountSlavesFailingToConnectToMaster)
+	}
+	if a.Analysis != NoProblem && a.CountStaleSlaves > 0 {
+		a.Description = fmt.Sprintf("%s; %d slaves have not read from master since last check", a.Description, a.CountStaleSlaves)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type AnalysisTestSuite struct{}
+
+var _ = Suite(&AnalysisTestSuite{})
+
+func (s *AnalysisTestSuite) TestIdleUnreachableMaster(c *C) {
+	// Slaves are connected but have nothing to read: master is alive
+	a := ReplicationAnalysis{IsMaster: true, CountSlaves: 3, CountValidSlaves: 3, CountValidReplicatingSlaves: 3, CountStaleSlaves: 3}
+	analyzeReplication(&a)
+	c.Assert(a.Analysis, Equals, UnreachableMaster)
+}
+
+func (s *AnalysisTestSuite) TestDeadMaster(c *C) {
+	a := ReplicationAnalysis{IsMaster: true, CountSlaves: 3, CountValidSlaves: 3, CountValidNonReadingSlaves: 3, CountSlavesFailingToConnectToMaster: 3}
+	analyzeReplication(&a)
+	c.Assert(a.Analysis, Equals, DeadMaster)
+
+	a = ReplicationAnalysis{IsMaster: true, CountSlaves: 3, CountValidSlaves: 2, CountValidNonReadingSlaves: 2}
+	analyzeReplication(&a)
+	c.Assert(a.Analysis, Equals, DeadMasterAndSomeSlaves)
+}
+
+func (s *AnalysisTestSuite) TestPartiallyReadingSlaves(c *C) {
+	a := ReplicationAnalysis{IsMaster: false, CountSlaves: 2, CountValidSlaves: 2, CountValidReplicatingSlaves: 1, CountValidNonReadingSlaves: 1}
+	analyzeReplication(&a)
+	c.Assert(a.Analysis, Equals, UnreachableIntermediateMaster)
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BinlogPurgeAdvice tells which binary logs of an instance are no longer required by any of its direct slaves,
+// and up to where they may be purged.
+type BinlogPurgeAdvice struct {
+	InstanceKey          InstanceKey
+	BinaryLogs           []string
+	SlaveKeys            []InstanceKey
+	RetentionFiles       uint
+	NewestConsumedBinlog string // Newest binary log fully consumed by all direct slaves; empty when there is none
+	PurgeToBinlog        string // Binary log to PURGE BINARY LOGS TO, retaining RetentionFiles consumed logs; empty when there is nothing to purge
+}
+
+// HasPurgeableBinaryLogs returns true when some binary logs may be purged
+func (this *BinlogPurgeAdvice) HasPurgeableBinaryLogs() bool {
+	return this.PurgeToBinlog != ""
+}
+
+// computeBinlogPurgeAdvice figures out, given an instance's binary logs (in order) and its direct slaves, which is the
+// newest binary log all slaves have fully consumed. A slave is considered to have consumed a binary log once it has
+// executed all of it; this is more conservative than looking at the slave's IO thread.
+// The current (last) binary log is never considered consumed.
+func computeBinlogPurgeAdvice(instanceKey *InstanceKey, binaryLogs []string, slaves [](*Instance), retentionFiles uint) (*BinlogPurgeAdvice, error) {
+	advice := &BinlogPurgeAdvice{InstanceKey: *instanceKey, BinaryLogs: binaryLogs, SlaveKeys: []InstanceKey{}, RetentionFiles: retentionFiles}
+	if len(binaryLogs) == 0 {
+		return advice, errors.New(fmt.Sprintf("No binary logs found on %+v", *instanceKey))
+	}
+	// Index of the oldest binary log still required by any slave
+	requiredIndex := len(binaryLogs) - 1
+	for _, slave := range slaves {
+		advice.SlaveKeys = append(advice.SlaveKeys, slave.Key)
+		slaveCoordinates := slave.ExecBinlogCoordinates
+		if slaveCoordinates.LogFile == "" {
+			return advice, errors.New(fmt.Sprintf("Unknown execution coordinates for slave %+v of %+v", slave.Key, *instanceKey))
+		}
+		slaveRequiredIndex := len(binaryLogs) - 1
+		for i, binaryLog := range binaryLogs {
+			// binary log names are numbered in sequence; they sort by number, not by name
+			if !logFileSmallerThan(binaryLog, slaveCoordinates.LogFile) {
+				slaveRequiredIndex = i
+				break
+			}
+		}
+		if slaveRequiredIndex == 0 && binaryLogs[0] != slaveCoordinates.LogFile {
+			return advice, errors.New(fmt.Sprintf("Slave %+v replicates from %s, which precedes the binary logs of %+v", slave.Key, slaveCoordinates.LogFile, *instanceKey))
+		}
+		if slaveRequiredIndex < requiredIndex {
+			requiredIndex = slaveRequiredIndex
+		}
+	}
+	if requiredIndex > 0 {
+		advice.NewestConsumedBinlog = binaryLogs[requiredIndex-1]
+	}
+	if purgeToIndex := requiredIndex - int(retentionFiles); purgeToIndex > 0 {
+		advice.PurgeToBinlog = binaryLogs[purgeToIndex]
+	}
+	return advice, nil
+}
+
+// verifySlavesAccountedFor checks that each of the slaves connected to an instance is one of its known slaves, matched
+// by hostname and port. The binary logs required by a slave whose position is unknown cannot be told, and so
+// no binary logs may be purged.
+func verifySlavesAccountedFor(instanceKey *InstanceKey, connectedSlaveKeys []InstanceKey, slaves [](*Instance)) error {
+	knownSlaveKeys := make(map[InstanceKey]bool)
+	for _, slave := range slaves {
+		knownSlaveKeys[slave.Key] = true
+	}
+	for _, slaveKey := range connectedSlaveKeys {
+		if !knownSlaveKeys[slaveKey] {
+			return errors.New(fmt.Sprintf("Slave %+v of %+v is not known to orchestrator; cannot tell its position", slaveKey, *instanceKey))
+		}
+	}
+	return nil
+}
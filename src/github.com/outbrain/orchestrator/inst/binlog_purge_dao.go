@@ -0,0 +1,75 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/orchestrator/config"
+)
+
+// GetBinlogPurgeAdvice computes the binary logs of given instance which are no longer required by any of its direct
+// slaves. Slaves are those known to orchestrator as replicating from the instance, connected or not. Any slave
+// connected to the instance but not yet known to orchestrator makes for an error, as its position cannot be told.
+func GetBinlogPurgeAdvice(instanceKey *InstanceKey) (*BinlogPurgeAdvice, error) {
+	instance, err := ReadTopologyInstance(instanceKey)
+	if err != nil {
+		return nil, err
+	}
+	if !instance.LogBinEnabled {
+		return nil, errors.New(fmt.Sprintf("%+v does not have binary logs enabled", *instanceKey))
+	}
+	binaryLogs, err := readBinaryLogs(instanceKey)
+	if err != nil {
+		return nil, err
+	}
+	slaves, err := ReadSlaveInstances(instanceKey)
+	if err != nil {
+		return nil, err
+	}
+	// Slaves are discovered anew: reading the instance does not fail on slave discovery failure
+	connectedSlaveKeys, err := discoverSlaves(context.Background(), instance)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySlavesAccountedFor(instanceKey, connectedSlaveKeys, slaves); err != nil {
+		return nil, err
+	}
+	return computeBinlogPurgeAdvice(instanceKey, binaryLogs, slaves, config.Config.PurgeBinaryLogsRetentionFiles)
+}
+
+// PurgeBinaryLogs purges the binary logs of given instance which are no longer required by any of its direct slaves,
+// retaining the configured number of consumed logs. See GetBinlogPurgeAdvice.
+func PurgeBinaryLogs(instanceKey *InstanceKey) (*BinlogPurgeAdvice, error) {
+	advice, err := GetBinlogPurgeAdvice(instanceKey)
+	if err != nil {
+		return advice, log.Errore(err)
+	}
+	if !advice.HasPurgeableBinaryLogs() {
+		log.Infof("No binary logs to purge on %+v", *instanceKey)
+		return advice, nil
+	}
+	if _, err := ExecInstance(instanceKey, fmt.Sprintf("purge binary logs to '%s'", advice.PurgeToBinlog)); err != nil {
+		return advice, log.Errore(err)
+	}
+	log.Infof("Purged binary logs on %+v up to %s", *instanceKey, advice.PurgeToBinlog)
+
+	AuditOperation("purge-binary-logs", instanceKey, fmt.Sprintf("purged binary logs to %s; newest consumed by slaves: %s; retained: %d", advice.PurgeToBinlog, advice.NewestConsumedBinlog, advice.RetentionFiles))
+	return advice, nil
+}
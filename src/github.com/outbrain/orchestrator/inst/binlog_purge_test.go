@@ -0,0 +1,96 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+var purgeTestMasterKey = InstanceKey{Hostname: "master", Port: 3306}
+var purgeTestBinaryLogs = []string{"mysql-bin.000007", "mysql-bin.000008", "mysql-bin.000009", "mysql-bin.000010", "mysql-bin.000011", "mysql-bin.000012"}
+
+func purgeTestSlave(hostname string, execLogFile string) *Instance {
+	slave := NewInstance()
+	slave.Key = InstanceKey{Hostname: hostname, Port: 3306}
+	slave.MasterKey = purgeTestMasterKey
+	slave.ExecBinlogCoordinates = BinlogCoordinates{LogFile: execLogFile, LogPos: 1024}
+	return slave
+}
+
+type BinlogPurgeTestSuite struct{}
+
+var _ = Suite(&BinlogPurgeTestSuite{})
+
+func (s *BinlogPurgeTestSuite) TestLaggingSlaveLimitsPurge(c *C) {
+	slaves := [](*Instance){purgeTestSlave("s1", "mysql-bin.000012"), purgeTestSlave("s2", "mysql-bin.000010")}
+	advice, err := computeBinlogPurgeAdvice(&purgeTestMasterKey, purgeTestBinaryLogs, slaves, 0)
+	c.Assert(err, IsNil)
+	c.Assert(advice.NewestConsumedBinlog, Equals, "mysql-bin.000009")
+	c.Assert(advice.PurgeToBinlog, Equals, "mysql-bin.000010")
+}
+
+func (s *BinlogPurgeTestSuite) TestRetention(c *C) {
+	slaves := [](*Instance){purgeTestSlave("s1", "mysql-bin.000012"), purgeTestSlave("s2", "mysql-bin.000010")}
+	advice, err := computeBinlogPurgeAdvice(&purgeTestMasterKey, purgeTestBinaryLogs, slaves, 2)
+	c.Assert(err, IsNil)
+	c.Assert(advice.NewestConsumedBinlog, Equals, "mysql-bin.000009")
+	c.Assert(advice.PurgeToBinlog, Equals, "mysql-bin.000008")
+
+	advice, err = computeBinlogPurgeAdvice(&purgeTestMasterKey, purgeTestBinaryLogs, slaves, 3)
+	c.Assert(err, IsNil)
+	c.Assert(advice.HasPurgeableBinaryLogs(), Equals, false)
+}
+
+func (s *BinlogPurgeTestSuite) TestCurrentBinlogNeverConsumed(c *C) {
+	advice, err := computeBinlogPurgeAdvice(&purgeTestMasterKey, purgeTestBinaryLogs, [](*Instance){}, 0)
+	c.Assert(err, IsNil)
+	c.Assert(advice.NewestConsumedBinlog, Equals, "mysql-bin.000011")
+	c.Assert(advice.PurgeToBinlog, Equals, "mysql-bin.000012")
+}
+
+func (s *BinlogPurgeTestSuite) TestSlaveBehindPurgedBinlogs(c *C) {
+	slaves := [](*Instance){purgeTestSlave("s1", "mysql-bin.000003")}
+	_, err := computeBinlogPurgeAdvice(&purgeTestMasterKey, purgeTestBinaryLogs, slaves, 0)
+	c.Assert(err, NotNil)
+}
+
+func (s *BinlogPurgeTestSuite) TestSlaveAheadOfListedBinlogs(c *C) {
+	// Master rotated after its binary logs were listed
+	slaves := [](*Instance){purgeTestSlave("s1", "mysql-bin.000013")}
+	advice, err := computeBinlogPurgeAdvice(&purgeTestMasterKey, purgeTestBinaryLogs, slaves, 1)
+	c.Assert(err, IsNil)
+	c.Assert(advice.PurgeToBinlog, Equals, "mysql-bin.000011")
+}
+
+func (s *BinlogPurgeTestSuite) TestBinaryLogsSortByNumber(c *C) {
+	binaryLogs := []string{"mysql-bin.999998", "mysql-bin.999999", "mysql-bin.1000000", "mysql-bin.1000001"}
+	slaves := [](*Instance){purgeTestSlave("s1", "mysql-bin.1000000"), purgeTestSlave("s2", "mysql-bin.1000001")}
+	advice, err := computeBinlogPurgeAdvice(&purgeTestMasterKey, binaryLogs, slaves, 0)
+	c.Assert(err, IsNil)
+	c.Assert(advice.NewestConsumedBinlog, Equals, "mysql-bin.999999")
+	c.Assert(advice.PurgeToBinlog, Equals, "mysql-bin.1000000")
+}
+
+func (s *BinlogPurgeTestSuite) TestSlavesAccountedFor(c *C) {
+	slaves := [](*Instance){purgeTestSlave("s1", "mysql-bin.000012"), purgeTestSlave("s2", "mysql-bin.000010")}
+	connectedSlaveKeys := []InstanceKey{{Hostname: "s1", Port: 3306}, {Hostname: "s2", Port: 3306}}
+	c.Assert(verifySlavesAccountedFor(&purgeTestMasterKey, connectedSlaveKeys, slaves), IsNil)
+
+	// A second slave on a known host
+	connectedSlaveKeys = append(connectedSlaveKeys, InstanceKey{Hostname: "s2", Port: 3307})
+	c.Assert(verifySlavesAccountedFor(&purgeTestMasterKey, connectedSlaveKeys, slaves), NotNil)
+}
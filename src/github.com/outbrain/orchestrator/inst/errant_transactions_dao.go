@@ -0,0 +1,356 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/db"
+	"sync"
+	"time"
+)
+
+// binlogEventsCache caches chunks of binary log events by instance and starting coordinates.
+// Events are copied in and out of the cache, since BinlogEventCursor normalizes the events it reads in place.
+type binlogEventsCache struct {
+	sync.Mutex
+	entries map[string]binlogEventsCacheEntry
+}
+
+type binlogEventsCacheEntry struct {
+	events  []BinlogEvent
+	expires time.Time
+}
+
+func newBinlogEventsCache() *binlogEventsCache {
+	return &binlogEventsCache{entries: make(map[string]binlogEventsCacheEntry)}
+}
+
+func binlogEventsCacheKey(instanceKey *InstanceKey, coordinates BinlogCoordinates) string {
+	return fmt.Sprintf("%s:%d:%s:%d", instanceKey.Hostname, instanceKey.Port, coordinates.LogFile, coordinates.LogPos)
+}
+
+// get returns the events cached for given instance and coordinates, unless expired
+func (this *binlogEventsCache) get(instanceKey *InstanceKey, coordinates BinlogCoordinates, now time.Time) ([]BinlogEvent, bool) {
+	this.Lock()
+	defer this.Unlock()
+
+	entry, found := this.entries[binlogEventsCacheKey(instanceKey, coordinates)]
+	if !found || now.After(entry.expires) {
+		return nil, false
+	}
+	return append([]BinlogEvent{}, entry.events...), true
+}
+
+// put caches events for given instance and coordinates, and evicts expired entries
+func (this *binlogEventsCache) put(instanceKey *InstanceKey, coordinates BinlogCoordinates, events []BinlogEvent, now time.Time, ttl time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+
+	for key, entry := range this.entries {
+		if now.After(entry.expires) {
+			delete(this.entries, key)
+		}
+	}
+	this.entries[binlogEventsCacheKey(instanceKey, coordinates)] = binlogEventsCacheEntry{events: append([]BinlogEvent{}, events...), expires: now.Add(ttl)}
+}
+
+// masterBinlogEventsCache holds the master binary log events read by errant transactions checks. The slaves of
+// a master are checked on every poll, typically from the same master coordinates; they share a single read.
+var masterBinlogEventsCache = newBinlogEventsCache()
+
+// isImmutableBinlogEventsChunk checks whether a chunk of events read up to limit events can no longer change:
+// a full chunk, or one ending in a rotated binary log, as binary logs are only ever appended to.
+// A chunk ending in the last binary log may yet grow, and is not to be cached.
+func isImmutableBinlogEventsChunk(events []BinlogEvent, limit int, binlogs []string) bool {
+	if len(events) == 0 {
+		return false
+	}
+	if len(events) >= limit {
+		return true
+	}
+	return len(binlogs) > 0 && logFileSmallerThan(events[len(events)-1].Coordinates.LogFile, binlogs[len(binlogs)-1])
+}
+
+// getNextMasterBinlogEventsChunk is getNextBinlogEventsChunk on a master, via masterBinlogEventsCache
+func getNextMasterBinlogEventsChunk(master *Instance, startingCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+	if events, found := masterBinlogEventsCache.get(&master.Key, startingCoordinates, time.Now()); found {
+		return events, nil
+	}
+	events, err := getNextBinlogEventsChunk(master, startingCoordinates)
+	if err != nil {
+		return events, err
+	}
+	if isImmutableBinlogEventsChunk(events, binlogEventsChunkSize, master.GetBinaryLogs()) {
+		ttl := 2 * time.Duration(config.Config.InstancePollSeconds) * time.Second
+		masterBinlogEventsCache.put(&master.Key, startingCoordinates, events, time.Now(), ttl)
+	}
+	return events, nil
+}
+
+// errantTransactionsCheckInapplicableReason explains why a slave's binary logs cannot be compared event by event
+// with its master's, or returns an empty string when they can. With different binlog formats the slave logs the
+// master's changes as different events altogether. Differences in checksums and row events versions are allowed
+// for by BinlogEvent.VerifyMatches.
+func errantTransactionsCheckInapplicableReason(instance *Instance, master *Instance) string {
+	if instance.Binlog_format != master.Binlog_format {
+		return fmt.Sprintf("binlog_format is %s on %+v and %s on its master %+v", instance.Binlog_format, instance.Key, master.Binlog_format, master.Key)
+	}
+	return ""
+}
+
+// errantTransactionsCheckProgress marks how far a slave's binary logs have been verified against its master's
+type errantTransactionsCheckProgress struct {
+	MasterKey         InstanceKey
+	Coordinates       BinlogCoordinates
+	MasterCoordinates BinlogCoordinates
+}
+
+// readErrantTransactionsCheckProgress reads the twin coordinates up to which the given slave was last verified
+func readErrantTransactionsCheckProgress(instanceKey *InstanceKey) (*errantTransactionsCheckProgress, bool, error) {
+	progress := &errantTransactionsCheckProgress{}
+	found := false
+	query := `
+		select 
+			master_host,
+			master_port,
+			binary_log_file,
+			binary_log_pos,
+			master_log_file,
+			master_log_pos
+		from 
+			errant_transactions_check
+		where
+			hostname = ?
+			and port = ?
+		`
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return progress, found, log.Errore(err)
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		progress.MasterKey.Hostname = m.GetString("master_host")
+		progress.MasterKey.Port = m.GetInt("master_port")
+		progress.Coordinates.LogFile = m.GetString("binary_log_file")
+		progress.Coordinates.LogPos = m.GetInt64("binary_log_pos")
+		progress.MasterCoordinates.LogFile = m.GetString("master_log_file")
+		progress.MasterCoordinates.LogPos = m.GetInt64("master_log_pos")
+		found = true
+		return nil
+	}, instanceKey.Hostname, instanceKey.Port)
+	if err != nil {
+		return progress, found, log.Errore(err)
+	}
+	return progress, found, nil
+}
+
+// writeErrantTransactionsCheckProgress persists the twin coordinates up to which the given slave has been verified
+func writeErrantTransactionsCheckProgress(instanceKey *InstanceKey, progress *errantTransactionsCheckProgress) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	_, err = sqlutils.Exec(db, `
+			insert into errant_transactions_check (
+				hostname, port, master_host, master_port, binary_log_file, binary_log_pos, master_log_file, master_log_pos, last_checked
+			) values (
+				?, ?, ?, ?, ?, ?, ?, ?, NOW()
+			) on duplicate key update
+				master_host=values(master_host), master_port=values(master_port), 
+				binary_log_file=values(binary_log_file), binary_log_pos=values(binary_log_pos), 
+				master_log_file=values(master_log_file), master_log_pos=values(master_log_pos), 
+				last_checked=values(last_checked)
+			`,
+		instanceKey.Hostname,
+		instanceKey.Port,
+		progress.MasterKey.Hostname,
+		progress.MasterKey.Port,
+		progress.Coordinates.LogFile,
+		progress.Coordinates.LogPos,
+		progress.MasterCoordinates.LogFile,
+		progress.MasterCoordinates.LogPos,
+	)
+	return log.Errore(err)
+}
+
+// getErrantTransactionsCheckStartCoordinates returns the twin coordinates on slave & master from which to look for
+// errant transactions: where the previous check left off, if still applicable, or else the last pseudo-GTID entry
+// shared by both.
+func getErrantTransactionsCheckStartCoordinates(instance *Instance, master *Instance) (*BinlogCoordinates, *BinlogCoordinates, error) {
+	progress, found, err := readErrantTransactionsCheckProgress(&instance.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if found && progress.MasterKey.Equals(&master.Key) && hasBinaryLog(instance, progress.Coordinates.LogFile) && hasBinaryLog(master, progress.MasterCoordinates.LogFile) {
+		return &progress.Coordinates, &progress.MasterCoordinates, nil
+	}
+
+	instancePseudoGtidCoordinates, instancePseudoGtidText, err := GetLastPseudoGTIDEntryInInstance(instance)
+	if err != nil {
+		return nil, nil, err
+	}
+	masterPseudoGtidCoordinates, err := SearchPseudoGTIDEntryInInstance(master, instancePseudoGtidText)
+	if err != nil {
+		return nil, nil, err
+	}
+	return instancePseudoGtidCoordinates, masterPseudoGtidCoordinates, nil
+}
+
+// FindErrantTransactions looks for events in the given slave's own binary logs which have no counterpart in its
+// master's binary logs. Such events are writes made directly on the slave (errant transactions), and are lost or
+// conflicting once the slave is repointed.
+// The first check starts at the last pseudo-GTID entry shared by slave & master; subsequent checks pick up where
+// the previous one left off, so that errant events are not missed once newer pseudo-GTID entries are injected.
+// Returns the first errant event found, or nil if there are none.
+func FindErrantTransactions(instance *Instance) (*BinlogEvent, error) {
+	if !instance.IsSlave() {
+		return nil, errors.New(fmt.Sprintf("FindErrantTransactions: %+v is not a slave", instance.Key))
+	}
+	if !instance.HasReplicatedEventsInBinlogs() {
+		return nil, errors.New(fmt.Sprintf("FindErrantTransactions: %+v does not log replicated events into its binary logs", instance.Key))
+	}
+	instanceBinlogs, err := readBinaryLogs(&instance.Key)
+	if err != nil {
+		return nil, err
+	}
+	instance.SetBinaryLogs(instanceBinlogs)
+	master, found, err := ReadInstance(&instance.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New(fmt.Sprintf("FindErrantTransactions: master %+v of %+v is unknown", instance.MasterKey, instance.Key))
+	}
+	if reason := errantTransactionsCheckInapplicableReason(instance, master); reason != "" {
+		return nil, errors.New(fmt.Sprintf("FindErrantTransactions: cannot compare events: %s", reason))
+	}
+	masterBinlogs, err := readBinaryLogs(&master.Key)
+	if err != nil {
+		return nil, err
+	}
+	master.SetBinaryLogs(masterBinlogs)
+
+	instanceStartCoordinates, masterStartCoordinates, err := getErrantTransactionsCheckStartCoordinates(instance, master)
+	if err != nil {
+		return nil, err
+	}
+	instanceCursor := NewBinlogEventCursor(*instanceStartCoordinates, func(binlogCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+		return getNextBinlogEventsChunk(instance, binlogCoordinates)
+	})
+	masterCursor := NewBinlogEventCursor(*masterStartCoordinates, func(binlogCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+		return getNextMasterBinlogEventsChunk(master, binlogCoordinates)
+	})
+	errantEvent, instanceCoordinates, masterCoordinates, err := findErrantBinlogEvent(&instanceCursor, &masterCursor)
+	if err != nil {
+		return nil, err
+	}
+	if errantEvent != nil {
+		return errantEvent, nil
+	}
+	if instanceCoordinates == nil {
+		// No new events since last check; still keep track of where we started from
+		instanceCoordinates, masterCoordinates = instanceStartCoordinates, masterStartCoordinates
+	}
+	progress := &errantTransactionsCheckProgress{MasterKey: master.Key, Coordinates: *instanceCoordinates, MasterCoordinates: *masterCoordinates}
+	return nil, writeErrantTransactionsCheckProgress(&instance.Key, progress)
+}
+
+// CheckErrantTransactions looks for errant transactions on the given slave and persists the outcome, which then
+// shows as a problem and blocks match-below for that slave.
+// Once found, errant transactions stay flagged until reset (see ResetErrantTransactions): later checks, starting
+// past newer pseudo-GTID entries or past purged binary logs, would no longer see them.
+// A slave whose binary logs are not comparable with its master's is skipped.
+func CheckErrantTransactions(instance *Instance) error {
+	if known, found, err := ReadInstance(&instance.Key); err == nil && found && known.HasErrantTransactions {
+		log.Debugf("Skipping errant transactions check on %+v: errant transactions at %+v are flagged until reset", instance.Key, known.ErrantBinlogCoordinates)
+		return nil
+	}
+	if master, found, err := ReadInstance(&instance.MasterKey); err == nil && found {
+		if reason := errantTransactionsCheckInapplicableReason(instance, master); reason != "" {
+			log.Debugf("Skipping errant transactions check on %+v: %s", instance.Key, reason)
+			return nil
+		}
+	}
+	errantEvent, err := FindErrantTransactions(instance)
+	if err != nil {
+		// Inconclusive; previous outcome is kept
+		return log.Errore(err)
+	}
+	errantCoordinates := BinlogCoordinates{}
+	if errantEvent != nil {
+		errantCoordinates = errantEvent.Coordinates
+		log.Warningf("Errant transaction found on %+v at %+v: %s", instance.Key, errantCoordinates, errantEvent.Info)
+	}
+	return writeErrantTransactions(&instance.Key, errantEvent != nil, errantCoordinates)
+}
+
+// ResetErrantTransactions clears the errant transactions flag of given slave, once its errant transactions have been
+// dealt with. Checking restarts at the last pseudo-GTID entry shared by slave & master, where errant transactions
+// which still follow that entry are found again.
+func ResetErrantTransactions(instanceKey *InstanceKey) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	_, err = sqlutils.Exec(db, `
+			delete
+				from errant_transactions_check
+			where
+				hostname = ? and port = ?`,
+		instanceKey.Hostname,
+		instanceKey.Port,
+	)
+	if err != nil {
+		return log.Errore(err)
+	}
+	if err := writeErrantTransactions(instanceKey, false, BinlogCoordinates{}); err != nil {
+		return err
+	}
+	AuditOperation("reset-errant-transactions", instanceKey, "")
+	return nil
+}
+
+// writeErrantTransactions persists the outcome of an errant transactions check
+func writeErrantTransactions(instanceKey *InstanceKey, hasErrantTransactions bool, errantCoordinates BinlogCoordinates) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	_, err = sqlutils.Exec(db, `
+			update database_instance set
+				has_errant_transactions = ?,
+				errant_binlog_file = ?,
+				errant_binlog_pos = ?
+			where
+				hostname = ?
+				and port = ?
+			`,
+		hasErrantTransactions,
+		errantCoordinates.LogFile,
+		errantCoordinates.LogPos,
+		instanceKey.Hostname,
+		instanceKey.Port,
+	)
+	return log.Errore(err)
+}
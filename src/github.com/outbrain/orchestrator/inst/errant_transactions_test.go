@@ -0,0 +1,94 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type ErrantTransactionsTestSuite struct{}
+
+var _ = Suite(&ErrantTransactionsTestSuite{})
+
+func (s *ErrantTransactionsTestSuite) TestBinlogEventsCache(c *C) {
+	cache := newBinlogEventsCache()
+	masterKey := InstanceKey{Hostname: "master", Port: 3306}
+	otherKey := InstanceKey{Hostname: "other", Port: 3306}
+	coordinates := BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 1024}
+	events := []BinlogEvent{{Coordinates: coordinates, NextEventPos: 1100, EventType: "Query", Info: "BEGIN"}}
+	now := time.Now()
+
+	_, found := cache.get(&masterKey, coordinates, now)
+	c.Assert(found, Equals, false)
+
+	cache.put(&masterKey, coordinates, events, now, time.Minute)
+	cachedEvents, found := cache.get(&masterKey, coordinates, now.Add(time.Second))
+	c.Assert(found, Equals, true)
+	c.Assert(cachedEvents, DeepEquals, events)
+
+	// Cached events are not affected by changes to events read off the cache
+	cachedEvents[0].Info = "COMMIT"
+	cachedEvents, _ = cache.get(&masterKey, coordinates, now)
+	c.Assert(cachedEvents[0].Info, Equals, "BEGIN")
+
+	_, found = cache.get(&otherKey, coordinates, now)
+	c.Assert(found, Equals, false)
+	_, found = cache.get(&masterKey, BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 1100}, now)
+	c.Assert(found, Equals, false)
+
+	_, found = cache.get(&masterKey, coordinates, now.Add(2*time.Minute))
+	c.Assert(found, Equals, false)
+
+	// Expired entries are evicted
+	cache.put(&otherKey, coordinates, events, now.Add(2*time.Minute), time.Minute)
+	c.Assert(len(cache.entries), Equals, 1)
+}
+
+func (s *ErrantTransactionsTestSuite) TestIsImmutableBinlogEventsChunk(c *C) {
+	binlogs := []string{"mysql-bin.999999", "mysql-bin.1000000"}
+	event := func(logFile string) BinlogEvent {
+		return BinlogEvent{Coordinates: BinlogCoordinates{LogFile: logFile, LogPos: 4}, NextEventPos: 120}
+	}
+
+	c.Assert(isImmutableBinlogEventsChunk([]BinlogEvent{}, 2, binlogs), Equals, false)
+	c.Assert(isImmutableBinlogEventsChunk([]BinlogEvent{event("mysql-bin.1000000")}, 2, binlogs), Equals, false)
+	c.Assert(isImmutableBinlogEventsChunk([]BinlogEvent{event("mysql-bin.1000000"), event("mysql-bin.1000000")}, 2, binlogs), Equals, true)
+	c.Assert(isImmutableBinlogEventsChunk([]BinlogEvent{event("mysql-bin.999999")}, 2, binlogs), Equals, true)
+}
+
+func (s *ErrantTransactionsTestSuite) TestErrantTransactionsCheckInapplicableReason(c *C) {
+	instance := NewInstance()
+	instance.Binlog_format = "ROW"
+	master := NewInstance()
+	master.Binlog_format = "ROW"
+	c.Assert(errantTransactionsCheckInapplicableReason(instance, master), Equals, "")
+
+	master.Binlog_format = "STATEMENT"
+	c.Assert(errantTransactionsCheckInapplicableReason(instance, master), Not(Equals), "")
+}
+
+func (s *ErrantTransactionsTestSuite) TestVerifyNoErrantTransactions(c *C) {
+	instance := NewInstance()
+	instance.Key = InstanceKey{Hostname: "slave", Port: 3306}
+	c.Assert(verifyNoErrantTransactions(instance, false), IsNil)
+
+	instance.HasErrantTransactions = true
+	instance.ErrantBinlogCoordinates = BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 400}
+	c.Assert(verifyNoErrantTransactions(instance, false), NotNil)
+	c.Assert(verifyNoErrantTransactions(instance, true), IsNil)
+}
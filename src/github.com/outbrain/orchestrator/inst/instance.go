@@ -103,6 +103,34 @@ func (this *BinlogCoordinates) SmallerThan(other *BinlogCoordinates) bool {
 	return false
 }
 
+// logFileNumber returns the numeric suffix of a binary or relay log file name, e.g. 12 for "mysql-bin.000012"
+func logFileNumber(logFile string) (int, error) {
+	dotIndex := strings.LastIndex(logFile, ".")
+	if dotIndex < 0 {
+		return 0, errors.New(fmt.Sprintf("Unexpected log file name: %s", logFile))
+	}
+	fileNum, err := strconv.Atoi(logFile[dotIndex+1:])
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Unexpected log file name: %s", logFile))
+	}
+	return fileNum, nil
+}
+
+// logFileSmallerThan compares binary or relay log file names by their numeric suffix, which, unlike the names
+// themselves, keeps sorting in order past the suffix width (e.g. "mysql-bin.999999" < "mysql-bin.1000000").
+// Names not ending with a number are compared as strings.
+func logFileSmallerThan(logFile string, other string) bool {
+	fileNum, err := logFileNumber(logFile)
+	if err != nil {
+		return logFile < other
+	}
+	otherFileNum, err := logFileNumber(other)
+	if err != nil {
+		return logFile < other
+	}
+	return fileNum < otherFileNum
+}
+
 // InstanceKeyMap is a convenience struct for listing InstanceKey-s
 type InstanceKeyMap map[InstanceKey]bool
 
@@ -130,12 +158,17 @@ type Instance struct {
 	Binlog_format          string
 	LogBinEnabled          bool
 	LogSlaveUpdatesEnabled bool
+	GTIDMode               string
+	ExecutedGtidSet        string
+	RetrievedGtidSet       string
+	UsingGTIDAutoPosition  bool
 	SelfBinlogCoordinates  BinlogCoordinates
 	MasterKey              InstanceKey
 	Slave_SQL_Running      bool
 	Slave_IO_Running       bool
 	ReadBinlogCoordinates  BinlogCoordinates
 	ExecBinlogCoordinates  BinlogCoordinates
+	RelaylogCoordinates    BinlogCoordinates
 	LastSQLError           string
 	LastIOError            string
 	SecondsBehindMaster    sql.NullInt64
@@ -143,7 +176,11 @@ type Instance struct {
 	SlaveHosts             InstanceKeyMap
 	ClusterName            string
 
+	HasErrantTransactions   bool
+	ErrantBinlogCoordinates BinlogCoordinates
+
 	IsLastCheckValid     bool
+	LastCheckOutcome     string
 	IsUpToDate           bool
 	IsRecentlyChecked    bool
 	SecondsSinceLastSeen sql.NullInt64
@@ -190,6 +227,17 @@ func (this *Instance) IsSlave() bool {
 	return this.MasterKey.Hostname != "" && this.MasterKey.Port != 0 && this.MasterKey.Port != InvalidPort && this.ReadBinlogCoordinates.LogFile != ""
 }
 
+// HasReplicatedEventsInBinlogs returns true when this instance writes the events it replicates into its own binary logs.
+// Otherwise replicated events can only be found in its relay logs.
+func (this *Instance) HasReplicatedEventsInBinlogs() bool {
+	return this.LogBinEnabled && this.LogSlaveUpdatesEnabled
+}
+
+// IsGTIDEnabled returns true when this instance runs with gtid_mode=ON (MySQL 5.6 and above)
+func (this *Instance) IsGTIDEnabled() bool {
+	return this.GTIDMode == "ON"
+}
+
 // SlaveRunning returns true when this instance's status is of a replicating slave.
 func (this *Instance) SlaveRunning() bool {
 	return this.IsSlave() && this.Slave_SQL_Running && this.Slave_IO_Running
@@ -272,7 +320,7 @@ func (this *Instance) CanReplicateFrom(other *Instance) (bool, error) {
 	if this.IsSmallerMajorVersion(other) {
 		return false, errors.New(fmt.Sprintf("instance %+v has version %s, which is lower than %s on %+v ", this.Key, this.Version, other.Version, other.Key))
 	}
-	if this.LogBinEnabled && this.LogSlaveUpdatesEnabled {
+	if this.HasReplicatedEventsInBinlogs() {
 		if this.Binlog_format == "STATEMENT" && (other.Binlog_format == "ROW" || other.Binlog_format == "MIXED") {
 			return false, errors.New(fmt.Sprintf("Cannot replicate from ROW/MIXED binlog format on %+v to STATEMENT on %+v", other.Key, this.Key))
 		}
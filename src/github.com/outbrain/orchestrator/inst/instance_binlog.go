@@ -18,7 +18,10 @@ package inst
 
 import (
 	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
 	"regexp"
+	"strings"
 )
 
 // Event entries may contains table IDs (can be different for same tables on different servers)
@@ -28,20 +31,29 @@ import (
 var eventInfoTransformations map[*regexp.Regexp]string = map[*regexp.Regexp]string{
 	regexp.MustCompile(`(.*) [/][*].*?[*][/](.*$)`): "$1 $2",
 	regexp.MustCompile(`(COMMIT) .*$`):              "$1",
-	regexp.MustCompile(`(table_id:) [0-9]+ (.*$)`):  "$1 ### $2",
+	regexp.MustCompile(`(table_id:) [0-9]+(.*$)`):   "$1 ###$2",
 }
 
 var skippedEventTypes map[string]bool = map[string]bool{
-	"Format_desc": true,
-	"Stop":        true,
-	"Rotate":      true,
+	"Format_desc":    true,
+	"Stop":           true,
+	"Rotate":         true,
+	"Previous_gtids": true,
 }
 
+// binlogEventChecksumLength is the size of the checksum appended to each event with binlog_checksum=CRC32
+const binlogEventChecksumLength int64 = 4
+
+// Row based events only show the table_id in their Info. The table name is found in the Table_map event preceding them.
+var tableMapEventInfoRegexp = regexp.MustCompile(`table_id: ([0-9]+) [(](.*)[)]`)
+var rowEventInfoRegexp = regexp.MustCompile(`table_id: ([0-9]+)`)
+
 type BinlogEvent struct {
 	Coordinates  BinlogCoordinates
 	NextEventPos int64
 	EventType    string
 	Info         string
+	TableName    string
 }
 
 //
@@ -56,12 +68,84 @@ func (this *BinlogEvent) NormalizeInfo() {
 	}
 }
 
+// NormalizedBinlogEvent presents a binlog event as read from the binary logs along with its normalized info
+type NormalizedBinlogEvent struct {
+	BinlogEvent
+	NormalizedInfo string
+}
+
+// BinlogEventsComparison is the result of walking the binary logs of two instances side by side.
+// When Diverged, InstanceEvent & OtherEvent are the first pair of mismatching events; either may be nil
+// when the respective binary logs have run out first.
+type BinlogEventsComparison struct {
+	InstanceKey    InstanceKey
+	OtherKey       InstanceKey
+	ComparedEvents int
+	Diverged       bool
+	Reason         string
+	InstanceEvent  *BinlogEvent
+	OtherEvent     *BinlogEvent
+}
+
+// Length returns the size in bytes of this event
+func (this *BinlogEvent) Length() int64 {
+	return this.NextEventPos - this.Coordinates.LogPos
+}
+
+// IsTableMapEvent returns true for a row based replication Table_map event
+func (this *BinlogEvent) IsTableMapEvent() bool {
+	return this.EventType == "Table_map"
+}
+
+// IsRowEvent returns true for a row based replication rows event (write, update or delete rows, in any version)
+func (this *BinlogEvent) IsRowEvent() bool {
+	return strings.HasPrefix(this.EventType, "Write_rows") || strings.HasPrefix(this.EventType, "Update_rows") || strings.HasPrefix(this.EventType, "Delete_rows")
+}
+
+// NormalizedEventType returns the event type regardless of the row events version: the same rows event is listed
+// as e.g. "Write_rows_v1" or "Write_rows" depending on server version and log_bin_use_v1_row_events
+func (this *BinlogEvent) NormalizedEventType() string {
+	eventType := strings.TrimSuffix(this.EventType, "_v1")
+	return strings.TrimSuffix(eventType, "_v2")
+}
+
+// lengthMatches checks that this event and the other event are of the same length, allowing for a checksum
+// logged by one server and not by the other
+func (this *BinlogEvent) lengthMatches(other *BinlogEvent) bool {
+	diff := this.Length() - other.Length()
+	return diff == 0 || diff == binlogEventChecksumLength || diff == -binlogEventChecksumLength
+}
+
+// VerifyMatches checks that this event and the other event are the same event, as logged on two different servers.
+// Normalized Info is always compared, as is the (version agnostic) event type. Row based events show no row data in
+// their Info, and so two different row events on the same table look identical; for those, the event length and
+// table name are compared as well. Lengths are only comparable for rows events of the same version, and may differ
+// by the length of a checksum.
+func (this *BinlogEvent) VerifyMatches(other *BinlogEvent) error {
+	if this.NormalizedEventType() != other.NormalizedEventType() {
+		return errors.New(fmt.Sprintf("Mismatching event types: %+v <-> %+v", this.EventType, other.EventType))
+	}
+	if this.Info != other.Info {
+		return errors.New(fmt.Sprintf("Mismatching entries: %+v <-> %+v", this.Info, other.Info))
+	}
+	if this.IsTableMapEvent() || this.IsRowEvent() {
+		if this.TableName != other.TableName {
+			return errors.New(fmt.Sprintf("Mismatching tables on %+v: %+v <-> %+v", this.EventType, this.TableName, other.TableName))
+		}
+	}
+	if this.IsRowEvent() && this.EventType == other.EventType && !this.lengthMatches(other) {
+		return errors.New(fmt.Sprintf("Mismatching event lengths on %+v %+v: %+v <-> %+v", this.EventType, this.TableName, this.Length(), other.Length()))
+	}
+	return nil
+}
+
 //
 type BinlogEventCursor struct {
 	cachedEvents      []BinlogEvent
 	currentEventIndex int
 	fetchNextEvents   func(BinlogCoordinates) ([]BinlogEvent, error)
 	nextCoordinates   BinlogCoordinates
+	tableMapNames     map[string]string
 }
 
 // fetchNextEventsFunc expected to return events starting at a given position, and automatically fetch those from next
@@ -74,6 +158,7 @@ func NewBinlogEventCursor(startCoordinates BinlogCoordinates, fetchNextEventsFun
 		cachedEvents:      events,
 		currentEventIndex: -1,
 		fetchNextEvents:   fetchNextEventsFunc,
+		tableMapNames:     make(map[string]string),
 	}
 }
 
@@ -121,10 +206,37 @@ func (this *BinlogEventCursor) NextRealEvent() (*BinlogEvent, error) {
 		// but we really don't expect a huge sequence of those.
 		return this.NextRealEvent()
 	}
+	this.resolveTableName(event)
 	event.NormalizeInfo()
 	return event, err
 }
 
+// normalizedEvent presents given event, as returned by NextEvent, in both raw and normalized form
+func (this *BinlogEventCursor) normalizedEvent(event *BinlogEvent) NormalizedBinlogEvent {
+	normalizedEvent := NormalizedBinlogEvent{BinlogEvent: *event}
+	this.resolveTableName(&normalizedEvent.BinlogEvent)
+	normalized := normalizedEvent.BinlogEvent
+	normalized.NormalizeInfo()
+	normalizedEvent.NormalizedInfo = normalized.Info
+	return normalizedEvent
+}
+
+// resolveTableName sets the table name of row based events. It must be called before the event's Info is
+// normalized, since normalization removes the table_id.
+func (this *BinlogEventCursor) resolveTableName(event *BinlogEvent) {
+	if event.IsTableMapEvent() {
+		if submatch := tableMapEventInfoRegexp.FindStringSubmatch(event.Info); submatch != nil {
+			this.tableMapNames[submatch[1]] = submatch[2]
+			event.TableName = submatch[2]
+		}
+	}
+	if event.IsRowEvent() {
+		if submatch := rowEventInfoRegexp.FindStringSubmatch(event.Info); submatch != nil {
+			event.TableName = this.tableMapNames[submatch[1]]
+		}
+	}
+}
+
 // NextCoordinates return the binlog coordinates of the next entry as yet unprocessed by the cursor.
 // Moreover, when the cursor terminates (consumes last entry), these coordinates indicate what will be the futuristic
 // coordinates of the next binlog entry.
@@ -136,3 +248,133 @@ func (this *BinlogEventCursor) NextCoordinates() (BinlogCoordinates, error) {
 	}
 	return this.nextCoordinates, nil
 }
+
+// matchBinlogEventCursors iterates the events of both cursors in parallel, expecting them to match, until instanceCursor
+// runs out of events. It returns the next coordinates of both cursors at that point.
+// If otherCursor runs out of events first, the instance is more advanced than the other, which is an error.
+func matchBinlogEventCursors(instanceCursor *BinlogEventCursor, otherCursor *BinlogEventCursor) (*BinlogCoordinates, *BinlogCoordinates, error) {
+	for {
+		// Exhaust binlogs on instance. While iterating them, also iterate the otherInstance binlogs.
+		// We expect entries on both to match, sequentially, until instance's binlogs are exhausted.
+		var instanceEvent BinlogEvent
+		{
+			event, err := instanceCursor.NextRealEvent()
+			if err != nil {
+				return nil, nil, err
+			}
+			if event == nil {
+				// end of binary logs for instance:
+				targetMatchCoordinates, err := otherCursor.NextCoordinates()
+				if err != nil {
+					return nil, nil, err
+				}
+				instanceCoordinates, _ := instanceCursor.NextCoordinates()
+				return &instanceCoordinates, &targetMatchCoordinates, nil
+			}
+			instanceEvent = *event
+			log.Debugf("%+v %+v; %+v", event.Coordinates, event.EventType, event.Info)
+		}
+		{
+			event, err := otherCursor.NextRealEvent()
+			if err != nil {
+				return nil, nil, err
+			}
+			if event == nil {
+				// end of binary logs for otherInstance: this is unexpected and means instance is more advanced
+				// than otherInstance
+				return nil, nil, errors.New("Unexpected end of binary logs for assumed master. This means the instance which attempted to be a slave was more advanced. Try the other way round")
+			}
+			log.Debugf("%+v %+v; %+v", event.Coordinates, event.EventType, event.Info)
+			// Verify things are sane:
+			if err := instanceEvent.VerifyMatches(event); err != nil {
+				return nil, nil, errors.New(fmt.Sprintf("Aborting: %+v", err))
+			}
+		}
+	}
+}
+
+// compareBinlogEventCursors iterates the events of both cursors in parallel, the same way matchBinlogEventCursors does,
+// and stops at the first pair of diverging events, or once limit events are compared, or once both cursors run out.
+func compareBinlogEventCursors(instanceCursor *BinlogEventCursor, otherCursor *BinlogEventCursor, limit int) (*BinlogEventsComparison, error) {
+	comparison := &BinlogEventsComparison{}
+	for comparison.ComparedEvents < limit {
+		instanceEvent, err := instanceCursor.NextRealEvent()
+		if err != nil {
+			return comparison, err
+		}
+		otherEvent, err := otherCursor.NextRealEvent()
+		if err != nil {
+			return comparison, err
+		}
+		if instanceEvent == nil && otherEvent == nil {
+			break
+		}
+		comparison.InstanceEvent, comparison.OtherEvent = nil, nil
+		if instanceEvent != nil {
+			instanceEventCopy := *instanceEvent
+			comparison.InstanceEvent = &instanceEventCopy
+		}
+		if otherEvent != nil {
+			otherEventCopy := *otherEvent
+			comparison.OtherEvent = &otherEventCopy
+		}
+		switch {
+		case instanceEvent == nil:
+			comparison.Reason = "Instance binary logs ran out"
+		case otherEvent == nil:
+			comparison.Reason = "Other binary logs ran out"
+		default:
+			if err := instanceEvent.VerifyMatches(otherEvent); err != nil {
+				comparison.Reason = err.Error()
+			}
+		}
+		if comparison.Reason != "" {
+			comparison.Diverged = true
+			return comparison, nil
+		}
+		comparison.ComparedEvents++
+	}
+	comparison.InstanceEvent = nil
+	comparison.OtherEvent = nil
+	return comparison, nil
+}
+
+// findErrantBinlogEvent iterates the events of a slave (slaveCursor) and of its master (masterCursor), starting at
+// twin coordinates (e.g. a pseudo-GTID entry shared by both). Any event the slave has logged is expected to match
+// the master's events, in order; the slave may lag behind, but not have events of its own.
+// It returns the first slave event which has no counterpart in the master's stream, or nil if there is none. In the
+// latter case it also returns the twin coordinates following the last matched events, or nil if no events were read.
+func findErrantBinlogEvent(slaveCursor *BinlogEventCursor, masterCursor *BinlogEventCursor) (*BinlogEvent, *BinlogCoordinates, *BinlogCoordinates, error) {
+	matchedEvents := 0
+	for {
+		slaveEvent, err := slaveCursor.NextRealEvent()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if slaveEvent == nil {
+			// Slave's binary logs exhausted, all matched
+			break
+		}
+		masterEvent, err := masterCursor.NextRealEvent()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if masterEvent == nil || slaveEvent.VerifyMatches(masterEvent) != nil {
+			errantEvent := *slaveEvent
+			return &errantEvent, nil, nil, nil
+		}
+		matchedEvents++
+	}
+	if matchedEvents == 0 {
+		return nil, nil, nil, nil
+	}
+	slaveCoordinates, err := slaveCursor.NextCoordinates()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	masterCoordinates, err := masterCursor.NextCoordinates()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return nil, &slaveCoordinates, &masterCoordinates, nil
+}
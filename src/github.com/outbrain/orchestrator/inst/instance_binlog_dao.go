@@ -17,6 +17,7 @@
 package inst
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/outbrain/golib/log"
@@ -29,52 +30,51 @@ import (
 const binlogEventsChunkSize int = 100000
 
 // Try and find the last position of a pseudo GTID query entry in the given binary log.
-// Also return the full text of that entry
+// Also return the full text of that entry.
+// This scans the entire binary log, from its beginning.
 func GetLastPseudoGTIDEntryInBinlog(instanceKey *InstanceKey, binlog string) (BinlogCoordinates, string, error) {
-	binlogCoordinates := BinlogCoordinates{LogFile: binlog, LogPos: 0}
-	db, err := db.OpenTopology(instanceKey.Hostname, instanceKey.Port)
+	pseudoGTIDRegexp, err := regexp.Compile(config.Config.PseudoGTIDPattern)
 	if err != nil {
-		return binlogCoordinates, "", err
+		return BinlogCoordinates{LogFile: binlog, LogPos: 0}, "", err
 	}
+	return searchLastPseudoGTIDEntryForward(binlog, pseudoGTIDRegexp, func(offset int, count int) ([]BinlogEvent, error) {
+		return readBinlogEventsPage(instanceKey, binlog, offset, count)
+	})
+}
 
-	moreRowsExpected := true
-	step := 0
-
-	entryText := ""
-	for moreRowsExpected {
-		query := fmt.Sprintf("show binlog events in '%s' LIMIT %d,%d", binlog, (step * binlogEventsChunkSize), binlogEventsChunkSize)
-
-		moreRowsExpected = false
-		err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
-			moreRowsExpected = true
-			binlogEntryInfo := m.GetString("Info")
-			if matched, _ := regexp.MatchString(config.Config.PseudoGTIDPattern, binlogEntryInfo); matched {
-				binlogCoordinates.LogPos = m.GetInt64("Pos")
-				entryText = binlogEntryInfo
-				// Found a match. But we keep searching: we're interested in the LAST entry, and, alas,
-				// we can only search in ASCENDING order...
-			}
-			return nil
-		})
-		if err != nil {
-			return binlogCoordinates, "", err
-		}
-		step++
+// GetLastPseudoGTIDEntryInBinlogBackwards is like GetLastPseudoGTIDEntryInBinlog, only it searches the binary log
+// backwards, starting near its end, and stops at the first matching entry it finds.
+func GetLastPseudoGTIDEntryInBinlogBackwards(instanceKey *InstanceKey, binlog string) (BinlogCoordinates, string, error) {
+	pseudoGTIDRegexp, err := regexp.Compile(config.Config.PseudoGTIDPattern)
+	if err != nil {
+		return BinlogCoordinates{LogFile: binlog, LogPos: 0}, "", err
 	}
-
-	if binlogCoordinates.LogPos == 0 {
-		return binlogCoordinates, "", errors.New(fmt.Sprintf("Cannot find pseudo GTID entry in binlog '%s'", binlog))
+	binlogSize, err := readBinaryLogSize(instanceKey, binlog)
+	if err != nil {
+		return BinlogCoordinates{LogFile: binlog, LogPos: 0}, "", err
 	}
-	return binlogCoordinates, entryText, err
+	readEventsFrom := func(coordinates BinlogCoordinates, count int) ([]BinlogEvent, error) {
+		return readBinlogEventsFrom(instanceKey, coordinates, count)
+	}
+	readEventsPage := func(offset int, count int) ([]BinlogEvent, error) {
+		return readBinlogEventsPage(instanceKey, binlog, offset, count)
+	}
+	return searchLastPseudoGTIDEntryBackwards(binlog, binlogSize, binlogReverseSearchWindowSize, pseudoGTIDRegexp, readEventsFrom, readEventsPage)
 }
 
 func GetLastPseudoGTIDEntryInInstance(instance *Instance) (*BinlogCoordinates, string, error) {
+	if isPseudoGTIDIndexEnabled() {
+		if coordinates, entryText, found, err := ReadLastIndexedPseudoGTIDEntry(instance); found && err == nil {
+			log.Debugf("Found indexed pseudo gtid entry in %+v: %+v", instance.Key, *coordinates)
+			return coordinates, entryText, nil
+		}
+	}
 	// Look for last GTID in instance:
 	instanceBinlogs := instance.GetBinaryLogs()
 
 	for i := len(instanceBinlogs) - 1; i >= 0; i-- {
 		log.Debugf("Searching for latest pseudo gtid entry in binlog %+v of %+v", instanceBinlogs[i], instance.Key)
-		resultCoordinates, entryInfo, err := GetLastPseudoGTIDEntryInBinlog(&instance.Key, instanceBinlogs[i])
+		resultCoordinates, entryInfo, err := GetLastPseudoGTIDEntryInBinlogBackwards(&instance.Key, instanceBinlogs[i])
 		if resultCoordinates.LogPos != 0 && err == nil {
 			log.Debugf("Found pseudo gtid entry in %+v: %+v", instance.Key, resultCoordinates)
 			return &resultCoordinates, entryInfo, err
@@ -97,7 +97,7 @@ func SearchPseudoGTIDEntryInBinlog(instanceKey *InstanceKey, binlog string, entr
 	for moreRowsExpected {
 		query := fmt.Sprintf("show binlog events in '%s' LIMIT %d,%d", binlog, (step * binlogEventsChunkSize), binlogEventsChunkSize)
 		moreRowsExpected = false
-		err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		err = queryTopologyRowsMap(context.Background(), db, query, func(m sqlutils.RowMap) error {
 			if binlogCoordinates.LogPos != 0 {
 				return nil
 				// moreRowsExpected reamins false, this quits the loop
@@ -122,6 +122,12 @@ func SearchPseudoGTIDEntryInBinlog(instanceKey *InstanceKey, binlog string, entr
 }
 
 func SearchPseudoGTIDEntryInInstance(instance *Instance, entryText string) (*BinlogCoordinates, error) {
+	if isPseudoGTIDIndexEnabled() {
+		if coordinates, found, err := ReadIndexedPseudoGTIDEntryCoordinates(instance, entryText); found && err == nil {
+			log.Debugf("Matched indexed entry in %+v: %+v", instance.Key, *coordinates)
+			return coordinates, nil
+		}
+	}
 	// Look for GTID entry in other-instance:
 	binlogs := instance.GetBinaryLogs()
 	for i := len(binlogs) - 1; i >= 0; i-- {
@@ -135,15 +141,52 @@ func SearchPseudoGTIDEntryInInstance(instance *Instance, entryText string) (*Bin
 	return nil, log.Errorf("Cannot match pseudo GTID entry in binlogs of %+v", instance.Key)
 }
 
-// Read (as much as possible of) a chink of binary log events starting the given startingCoordinates
-func readBinlogEventsChunk(instanceKey *InstanceKey, startingCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+// readBinaryLogSize returns the size in bytes of the given binary log, as listed by SHOW BINARY LOGS
+func readBinaryLogSize(instanceKey *InstanceKey, binlog string) (int64, error) {
+	var binlogSize int64 = 0
+	found := false
+	db, err := db.OpenTopology(instanceKey.Hostname, instanceKey.Port)
+	if err != nil {
+		return binlogSize, err
+	}
+	err = queryTopologyRowsMap(context.Background(), db, "show binary logs", func(m sqlutils.RowMap) error {
+		if m.GetString("Log_name") == binlog {
+			binlogSize = m.GetInt64("File_size")
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		return binlogSize, err
+	}
+	if !found {
+		return binlogSize, errors.New(fmt.Sprintf("Cannot find binary log '%s' on %+v", binlog, *instanceKey))
+	}
+	return binlogSize, nil
+}
+
+// readBinaryLogs returns the names of the binary logs of the given instance, as listed by SHOW BINARY LOGS
+func readBinaryLogs(instanceKey *InstanceKey) ([]string, error) {
+	binlogs := []string{}
+	db, err := db.OpenTopology(instanceKey.Hostname, instanceKey.Port)
+	if err != nil {
+		return binlogs, err
+	}
+	err = queryTopologyRowsMap(context.Background(), db, "show binary logs", func(m sqlutils.RowMap) error {
+		binlogs = append(binlogs, m.GetString("Log_name"))
+		return nil
+	})
+	return binlogs, err
+}
+
+// readBinlogEvents reads binary log events as returned by the given SHOW BINLOG EVENTS query
+func readBinlogEvents(instanceKey *InstanceKey, query string) ([]BinlogEvent, error) {
 	events := []BinlogEvent{}
 	db, err := db.OpenTopology(instanceKey.Hostname, instanceKey.Port)
 	if err != nil {
 		return events, err
 	}
-	query := fmt.Sprintf("show binlog events in '%s' FROM %d LIMIT %d", startingCoordinates.LogFile, startingCoordinates.LogPos, binlogEventsChunkSize)
-	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+	err = queryTopologyRowsMap(context.Background(), db, query, func(m sqlutils.RowMap) error {
 		binlogEvent := BinlogEvent{}
 		binlogEvent.Coordinates.LogFile = m.GetString("Log_name")
 		binlogEvent.Coordinates.LogPos = m.GetInt64("Pos")
@@ -157,10 +200,32 @@ func readBinlogEventsChunk(instanceKey *InstanceKey, startingCoordinates BinlogC
 	return events, err
 }
 
+// readBinlogEventsPage reads count binary log events, skipping the first offset events of the given binary log
+func readBinlogEventsPage(instanceKey *InstanceKey, binlog string, offset int, count int) ([]BinlogEvent, error) {
+	query := fmt.Sprintf("show binlog events in '%s' LIMIT %d,%d", binlog, offset, count)
+	return readBinlogEvents(instanceKey, query)
+}
+
+// readBinlogEventsFrom reads up to count binary log events starting the given coordinates
+func readBinlogEventsFrom(instanceKey *InstanceKey, startingCoordinates BinlogCoordinates, count int) ([]BinlogEvent, error) {
+	query := fmt.Sprintf("show binlog events in '%s' FROM %d LIMIT %d", startingCoordinates.LogFile, startingCoordinates.LogPos, count)
+	return readBinlogEvents(instanceKey, query)
+}
+
+// Read (as much as possible of) a chink of binary log events starting the given startingCoordinates
+func readBinlogEventsChunk(instanceKey *InstanceKey, startingCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+	return readBinlogEventsFrom(instanceKey, startingCoordinates, binlogEventsChunkSize)
+}
+
 // Return the next chunk of binlog events; skip to next binary log file if need be; return empty result only
 // if reached end of binary logs
 func getNextBinlogEventsChunk(instance *Instance, startingCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
-	events, err := readBinlogEventsChunk(&instance.Key, startingCoordinates)
+	return getNextBinlogEvents(instance, startingCoordinates, binlogEventsChunkSize)
+}
+
+// getNextBinlogEvents is like getNextBinlogEventsChunk, reading up to given number of events
+func getNextBinlogEvents(instance *Instance, startingCoordinates BinlogCoordinates, limit int) ([]BinlogEvent, error) {
+	events, err := readBinlogEventsFrom(&instance.Key, startingCoordinates, limit)
 	if err != nil {
 		return events, err
 	}
@@ -170,13 +235,57 @@ func getNextBinlogEventsChunk(instance *Instance, startingCoordinates BinlogCoor
 	// events are empty
 	if nextBinlogFile, err := instance.GetNextBinaryLog(startingCoordinates.LogFile); err == nil {
 		nextCoordinates := BinlogCoordinates{LogFile: nextBinlogFile, LogPos: 0}
-		return getNextBinlogEventsChunk(instance, nextCoordinates)
+		return getNextBinlogEvents(instance, nextCoordinates, limit)
 	}
 	// No more log file. We return the empty array: but no error, since there is no error; we've just reached the end.
 	// This behaviour is strictly expected by BinlogEventCursor
 	return events, nil
 }
 
+// binlogEventsSource is where match-below reads the binary logs of an instance from: the live instance, or
+// binary logs taken offline (see OfflineBinlogEvents)
+type binlogEventsSource interface {
+	// GetLastPseudoGTIDEntry returns the coordinates and text of the last pseudo-GTID entry in the binary logs
+	GetLastPseudoGTIDEntry() (*BinlogCoordinates, string, error)
+	// SearchPseudoGTIDEntry returns the coordinates of the given pseudo-GTID entry in the binary logs
+	SearchPseudoGTIDEntry(entryText string) (*BinlogCoordinates, error)
+	// FetchNextEvents is as expected by BinlogEventCursor
+	FetchNextEvents(startingCoordinates BinlogCoordinates) ([]BinlogEvent, error)
+	// EndCoordinates returns the coordinates following the last event
+	EndCoordinates() BinlogCoordinates
+}
+
+// instanceBinlogEvents is the binlogEventsSource of a live instance
+type instanceBinlogEvents struct {
+	instance *Instance
+}
+
+func (this *instanceBinlogEvents) GetLastPseudoGTIDEntry() (*BinlogCoordinates, string, error) {
+	return GetLastPseudoGTIDEntryInInstance(this.instance)
+}
+
+func (this *instanceBinlogEvents) SearchPseudoGTIDEntry(entryText string) (*BinlogCoordinates, error) {
+	return SearchPseudoGTIDEntryInInstance(this.instance, entryText)
+}
+
+// FetchNextEvents reads the instance's binary logs; or, if the instance does not log replicated events, its
+// relay logs, which is where its replicated events are found
+func (this *instanceBinlogEvents) FetchNextEvents(startingCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+	if !this.instance.HasReplicatedEventsInBinlogs() {
+		return getNextRelaylogEventsChunk(this.instance, startingCoordinates)
+	}
+	return getNextBinlogEventsChunk(this.instance, startingCoordinates)
+}
+
+// EndCoordinates returns the instance's master status; or, if the instance does not log replicated events, its
+// relay log execution point
+func (this *instanceBinlogEvents) EndCoordinates() BinlogCoordinates {
+	if !this.instance.HasReplicatedEventsInBinlogs() {
+		return this.instance.RelaylogCoordinates
+	}
+	return this.instance.SelfBinlogCoordinates
+}
+
 // GetNextBinlogCoordinatesToMatch is given a twin-coordinates couple for a would-be slave (instanceKey) and another
 // instance (otherKey).
 // This is part of the match-below process, and is the heart of the operation: matching the binlog events starting
@@ -187,61 +296,78 @@ func getNextBinlogEventsChunk(instance *Instance, startingCoordinates BinlogCoor
 // Otherwise "instance" will point to the *next* binlog entry in "other"
 func GetNextBinlogCoordinatesToMatch(instance *Instance, instanceCoordinates BinlogCoordinates,
 	other *Instance, otherCoordinates BinlogCoordinates) (*BinlogCoordinates, error) {
+	return getNextBinlogCoordinatesToMatch(&instanceBinlogEvents{instance: instance}, instanceCoordinates, &instanceBinlogEvents{instance: other}, otherCoordinates)
+}
 
-	fetchNextEvents := func(binlogCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
-		return getNextBinlogEventsChunk(instance, binlogCoordinates)
-	}
-	instanceCursor := NewBinlogEventCursor(instanceCoordinates, fetchNextEvents)
+// getNextBinlogCoordinatesToMatch is GetNextBinlogCoordinatesToMatch over any binlog events source
+func getNextBinlogCoordinatesToMatch(instanceEvents binlogEventsSource, instanceCoordinates BinlogCoordinates,
+	otherEvents binlogEventsSource, otherCoordinates BinlogCoordinates) (*BinlogCoordinates, error) {
 
-	fetchOtherNextEvents := func(binlogCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
-		return getNextBinlogEventsChunk(other, binlogCoordinates)
+	instanceCursor := NewBinlogEventCursor(instanceCoordinates, instanceEvents.FetchNextEvents)
+	otherCursor := NewBinlogEventCursor(otherCoordinates, otherEvents.FetchNextEvents)
+
+	instanceNextCoordinates, targetMatchCoordinates, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	if err != nil {
+		return nil, log.Errore(err)
 	}
-	otherCursor := NewBinlogEventCursor(otherCoordinates, fetchOtherNextEvents)
+	instanceEndCoordinates := instanceEvents.EndCoordinates()
+	if !instanceNextCoordinates.Equals(&instanceEndCoordinates) {
+		return nil, log.Errorf("Unexpected problem: instance binlog iteration did not end with current master status. Ended with: %+v, self coordinates: %+v", *instanceNextCoordinates, instanceEndCoordinates)
+	}
+	log.Debugf("Reached end of binary logs for instance, at %+v. Other coordinates: %+v", *instanceNextCoordinates, *targetMatchCoordinates)
+	return targetMatchCoordinates, nil
+}
 
-	for {
-		// Exhaust binlogs on instance. While iterating them, also iterate the otherInstance binlogs.
-		// We expect entries on both to match, sequentially, until instance's binlogs are exhausted.
-		var instanceEventInfo string
-		var otherEventInfo string
-		{
-			event, err := instanceCursor.NextRealEvent()
-			if err != nil {
-				return nil, log.Errore(err)
-			}
-			if event == nil {
-				// end of binary logs for instance:
-				targetMatchCoordinates, err := otherCursor.NextCoordinates()
-				if err != nil {
-					return nil, log.Errore(err)
-				}
-				instanceCoordinates, _ := instanceCursor.NextCoordinates()
-				if !instanceCoordinates.Equals(&instance.SelfBinlogCoordinates) {
-					return nil, log.Errorf("Unexpected problem: instance binlog iteration did not end with current master status. Ended with: %+v, self coordinates: %+v", instanceCoordinates, instance.SelfBinlogCoordinates)
-				}
-				log.Debugf("Reached end of binary logs for instance, at %+v. Other coordinates: %+v", instanceCoordinates, targetMatchCoordinates)
-				return &targetMatchCoordinates, nil
-			}
-			instanceEventInfo = event.Info
-			log.Debugf("%+v %+v; %+v", event.Coordinates, event.EventType, event.Info)
-		}
-		{
-			event, err := otherCursor.NextRealEvent()
-			if err != nil {
-				return nil, log.Errore(err)
-			}
-			if event == nil {
-				// end of binary logs for otherInstance: this is unexpected and means instance is more advanced
-				// than otherInstance
-				return nil, log.Error("Unexpected end of binary logs for assumed master. This means the instance which attempted to be a slave was more advanced. Try the other way round")
-			}
-			otherEventInfo = event.Info
-			log.Debugf("%+v %+v; %+v", event.Coordinates, event.EventType, event.Info)
+// ReadBinlogEvents reads up to limit events from the binary logs of the given instance, starting the given
+// coordinates and skipping to following binary logs if need be. Events are presented both raw and normalized,
+// the latter being what match-below compares.
+func ReadBinlogEvents(instanceKey *InstanceKey, startingCoordinates BinlogCoordinates, limit int) ([]NormalizedBinlogEvent, error) {
+	events := []NormalizedBinlogEvent{}
+	instance, err := ReadTopologyInstance(instanceKey)
+	if err != nil {
+		return events, log.Errore(err)
+	}
+	fetchNextEvents := func(binlogCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+		return getNextBinlogEvents(instance, binlogCoordinates, limit)
+	}
+	cursor := NewBinlogEventCursor(startingCoordinates, fetchNextEvents)
+	for len(events) < limit {
+		event, err := cursor.NextEvent()
+		if err != nil {
+			return events, log.Errore(err)
 		}
-		// Verify things are sane:
-		if instanceEventInfo != otherEventInfo {
-			return nil, log.Errorf("Mismatching entries, aborting: %+v <-> %+v", instanceEventInfo, otherEventInfo)
+		if event == nil {
+			break
 		}
+		events = append(events, cursor.normalizedEvent(event))
 	}
+	return events, nil
+}
 
-	return nil, log.Error("GetNextBinlogCoordinatesToMatch: unexpected termination")
+// CompareBinlogEvents walks the binary logs of two instances, starting the given coordinates on each, in the same
+// manner match-below does, and reports the first pair of diverging events, if any within limit events.
+func CompareBinlogEvents(instanceKey *InstanceKey, instanceCoordinates BinlogCoordinates,
+	otherKey *InstanceKey, otherCoordinates BinlogCoordinates, limit int) (*BinlogEventsComparison, error) {
+
+	instance, err := ReadTopologyInstance(instanceKey)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	other, err := ReadTopologyInstance(otherKey)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	instanceCursor := NewBinlogEventCursor(instanceCoordinates, func(binlogCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+		return getNextBinlogEvents(instance, binlogCoordinates, limit)
+	})
+	otherCursor := NewBinlogEventCursor(otherCoordinates, func(binlogCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+		return getNextBinlogEvents(other, binlogCoordinates, limit)
+	})
+	comparison, err := compareBinlogEventCursors(&instanceCursor, &otherCursor, limit)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	comparison.InstanceKey = *instanceKey
+	comparison.OtherKey = *otherKey
+	return comparison, nil
 }
@@ -0,0 +1,510 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/orchestrator/config"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	binlogEventHeaderLength    int64  = 19
+	formatDescriptionEventType byte   = 15
+	binlogChecksumAlgCRC32     byte   = 1
+	binlogChecksumLength       int    = 4
+	rowsEventStatementEndFlag  uint16 = 0x0001
+	suppressUseEventFlag       uint16 = 0x0008
+)
+
+var binlogFileMagic = []byte{0xfe, 0x62, 0x69, 0x6e}
+
+// binlogEventTypeNames maps binary log event type codes onto the names presented by SHOW BINLOG EVENTS
+var binlogEventTypeNames map[byte]string = map[byte]string{
+	1:  "Start_v3",
+	2:  "Query",
+	3:  "Stop",
+	4:  "Rotate",
+	5:  "Intvar",
+	6:  "Load",
+	8:  "Create_file",
+	9:  "Append_block",
+	10: "Exec_load",
+	11: "Delete_file",
+	12: "New_load",
+	13: "RAND",
+	14: "User var",
+	15: "Format_desc",
+	16: "Xid",
+	17: "Begin_load_query",
+	18: "Execute_load_query",
+	19: "Table_map",
+	23: "Write_rows_v1",
+	24: "Update_rows_v1",
+	25: "Delete_rows_v1",
+	26: "Incident",
+	27: "Heartbeat",
+	28: "Ignorable",
+	29: "Rows_query",
+	30: "Write_rows",
+	31: "Update_rows",
+	32: "Delete_rows",
+	33: "Gtid",
+	34: "Anonymous_Gtid",
+	35: "Previous_gtids",
+}
+
+// binlogFormatDescription is what we need to know from a format description event in order to parse the
+// events following it
+type binlogFormatDescription struct {
+	serverVersion     string
+	binlogVersion     uint16
+	postHeaderLengths []byte
+	checksumLength    int
+}
+
+func (this *binlogFormatDescription) postHeaderLength(eventType byte) int {
+	if int(eventType) < 1 || int(eventType) > len(this.postHeaderLengths) {
+		return 0
+	}
+	return int(this.postHeaderLengths[eventType-1])
+}
+
+// isChecksumAwareVersion checks whether given server version (5.6.1 and above) writes a checksum algorithm
+// into format description events
+func isChecksumAwareVersion(serverVersion string) bool {
+	tokens := strings.Split(strings.SplitN(serverVersion, "-", 2)[0], ".")
+	versionNumbers := []int{}
+	for _, token := range tokens {
+		number, err := strconv.Atoi(token)
+		if err != nil {
+			break
+		}
+		versionNumbers = append(versionNumbers, number)
+	}
+	for len(versionNumbers) < 3 {
+		versionNumbers = append(versionNumbers, 0)
+	}
+	minimalVersion := []int{5, 6, 1}
+	for i := range minimalVersion {
+		if versionNumbers[i] != minimalVersion[i] {
+			return versionNumbers[i] > minimalVersion[i]
+		}
+	}
+	return true
+}
+
+func readUint48(data []byte) uint64 {
+	return uint64(binary.LittleEndian.Uint32(data[0:4])) | uint64(binary.LittleEndian.Uint16(data[4:6]))<<32
+}
+
+func parseFormatDescriptionEvent(body []byte) (*binlogFormatDescription, error) {
+	if len(body) < 57 {
+		return nil, errors.New("Format description event too short")
+	}
+	formatDescription := &binlogFormatDescription{
+		binlogVersion: binary.LittleEndian.Uint16(body[0:2]),
+		serverVersion: string(bytes.TrimRight(body[2:52], "\x00")),
+	}
+	postHeaderLengths := body[57:]
+	if isChecksumAwareVersion(formatDescription.serverVersion) && len(postHeaderLengths) >= 1+binlogChecksumLength {
+		// checksum algorithm, followed by the checksum of this very event
+		checksumAlg := postHeaderLengths[len(postHeaderLengths)-1-binlogChecksumLength]
+		postHeaderLengths = postHeaderLengths[:len(postHeaderLengths)-1-binlogChecksumLength]
+		if checksumAlg == binlogChecksumAlgCRC32 {
+			formatDescription.checksumLength = binlogChecksumLength
+		}
+	}
+	formatDescription.postHeaderLengths = postHeaderLengths
+	return formatDescription, nil
+}
+
+// binlogEventInfo formats the body of an event the way SHOW BINLOG EVENTS presents it in the Info column.
+// Only event types of interest to orchestrator are presented.
+func binlogEventInfo(eventType string, eventFlags uint16, body []byte, postHeaderLength int) string {
+	switch eventType {
+	case "Query":
+		if len(body) < 13 || postHeaderLength < 13 {
+			return ""
+		}
+		dbLength := int(body[8])
+		statusVarsLength := int(binary.LittleEndian.Uint16(body[11:13]))
+		offset := postHeaderLength + statusVarsLength
+		if offset+dbLength+1 > len(body) {
+			return ""
+		}
+		db := string(body[offset : offset+dbLength])
+		query := string(body[offset+dbLength+1:])
+		if db != "" && eventFlags&suppressUseEventFlag == 0 {
+			return fmt.Sprintf("use `%s`; %s", db, query)
+		}
+		return query
+	case "Xid":
+		if len(body) < 8 {
+			return ""
+		}
+		return fmt.Sprintf("COMMIT /* xid=%d */", binary.LittleEndian.Uint64(body[0:8]))
+	case "Rotate":
+		if len(body) < 8 {
+			return ""
+		}
+		return fmt.Sprintf("%s;pos=%d", string(body[8:]), binary.LittleEndian.Uint64(body[0:8]))
+	case "Table_map":
+		tableIdLength := 6
+		if postHeaderLength == 6 {
+			tableIdLength = 4
+		}
+		if len(body) < postHeaderLength+1 || postHeaderLength < tableIdLength {
+			return ""
+		}
+		tableId := uint64(binary.LittleEndian.Uint32(body[0:4]))
+		if tableIdLength == 6 {
+			tableId = readUint48(body[0:6])
+		}
+		offset := postHeaderLength
+		dbLength := int(body[offset])
+		if offset+1+dbLength+2 > len(body) {
+			return ""
+		}
+		db := string(body[offset+1 : offset+1+dbLength])
+		offset = offset + 1 + dbLength + 1
+		tableLength := int(body[offset])
+		if offset+1+tableLength > len(body) {
+			return ""
+		}
+		table := string(body[offset+1 : offset+1+tableLength])
+		return fmt.Sprintf("table_id: %d (%s.%s)", tableId, db, table)
+	case "Write_rows", "Update_rows", "Delete_rows", "Write_rows_v1", "Update_rows_v1", "Delete_rows_v1":
+		if len(body) < 8 {
+			return ""
+		}
+		info := fmt.Sprintf("table_id: %d", readUint48(body[0:6]))
+		if binary.LittleEndian.Uint16(body[6:8])&rowsEventStatementEndFlag != 0 {
+			info = info + " flags: STMT_END_F"
+		}
+		return info
+	}
+	return ""
+}
+
+// ParseBinlog parses the content of a binary log file into binlog events, as SHOW BINLOG EVENTS would present them.
+// A truncated last event (e.g. a binary log copied while being written to) is ignored.
+// The binary log is read event by event; it is never held in memory as a whole.
+func ParseBinlog(logName string, reader io.Reader) ([]BinlogEvent, error) {
+	events := []BinlogEvent{}
+	bufferedReader, ok := reader.(*bufio.Reader)
+	if !ok {
+		bufferedReader = bufio.NewReader(reader)
+	}
+	magic := make([]byte, len(binlogFileMagic))
+	if _, err := io.ReadFull(bufferedReader, magic); err != nil || !bytes.Equal(magic, binlogFileMagic) {
+		return events, errors.New(fmt.Sprintf("%s is not a binary log", logName))
+	}
+	formatDescription := &binlogFormatDescription{}
+	pos := int64(len(binlogFileMagic))
+	header := make([]byte, binlogEventHeaderLength)
+	for {
+		if _, err := io.ReadFull(bufferedReader, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return events, err
+		}
+		eventTypeCode := header[4]
+		eventSize := int64(binary.LittleEndian.Uint32(header[9:13]))
+		if eventSize < binlogEventHeaderLength {
+			return events, errors.New(fmt.Sprintf("Invalid event size %d in %s at %d", eventSize, logName, pos))
+		}
+		body := make([]byte, eventSize-binlogEventHeaderLength)
+		if _, err := io.ReadFull(bufferedReader, body); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return events, err
+		}
+		eventType, found := binlogEventTypeNames[eventTypeCode]
+		if !found {
+			eventType = fmt.Sprintf("Unknown_%d", eventTypeCode)
+		}
+		info := ""
+		if eventTypeCode == formatDescriptionEventType {
+			var err error
+			if formatDescription, err = parseFormatDescriptionEvent(body); err != nil {
+				return events, err
+			}
+			info = fmt.Sprintf("Server ver: %s, Binlog ver: %d", formatDescription.serverVersion, formatDescription.binlogVersion)
+		} else {
+			if len(body) >= formatDescription.checksumLength {
+				body = body[:len(body)-formatDescription.checksumLength]
+			}
+			info = binlogEventInfo(eventType, binary.LittleEndian.Uint16(header[17:19]), body, formatDescription.postHeaderLength(eventTypeCode))
+		}
+		events = append(events, BinlogEvent{
+			Coordinates:  BinlogCoordinates{LogFile: logName, LogPos: pos},
+			NextEventPos: pos + eventSize,
+			EventType:    eventType,
+			Info:         info,
+		})
+		pos += eventSize
+	}
+	return events, nil
+}
+
+// unescapeBatchValue reverses the escaping applied by the mysql command line client in batch (tab separated) mode
+func unescapeBatchValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var buffer bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) {
+			i++
+			switch value[i] {
+			case 'n':
+				buffer.WriteByte('\n')
+			case 't':
+				buffer.WriteByte('\t')
+			case '0':
+				buffer.WriteByte(0)
+			default:
+				buffer.WriteByte(value[i])
+			}
+			continue
+		}
+		buffer.WriteByte(value[i])
+	}
+	return buffer.String()
+}
+
+// ParseBinlogEventsDump parses a captured SHOW BINLOG EVENTS output, as produced by the mysql command line
+// client in batch mode (tab separated, with a header line), into binlog events.
+func ParseBinlogEventsDump(reader io.Reader) ([]BinlogEvent, error) {
+	events := []BinlogEvent{}
+	bufferedReader := bufio.NewReader(reader)
+	columns := map[string]int{}
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := bufferedReader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return events, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			fields := strings.Split(line, "\t")
+			if len(columns) == 0 {
+				for i, field := range fields {
+					columns[field] = i
+				}
+				for _, column := range []string{"Log_name", "Pos", "Event_type", "End_log_pos", "Info"} {
+					if _, found := columns[column]; !found {
+						return events, errors.New(fmt.Sprintf("Binlog events dump: missing column %s in header", column))
+					}
+				}
+			} else {
+				if len(fields) < len(columns) {
+					return events, errors.New(fmt.Sprintf("Binlog events dump: unexpected number of fields in line %d", lineNumber))
+				}
+				event := BinlogEvent{}
+				event.Coordinates.LogFile = fields[columns["Log_name"]]
+				event.EventType = fields[columns["Event_type"]]
+				event.Info = unescapeBatchValue(fields[columns["Info"]])
+				if event.Coordinates.LogPos, err = strconv.ParseInt(fields[columns["Pos"]], 10, 64); err != nil {
+					return events, errors.New(fmt.Sprintf("Binlog events dump: invalid Pos in line %d", lineNumber))
+				}
+				if event.NextEventPos, err = strconv.ParseInt(fields[columns["End_log_pos"]], 10, 64); err != nil {
+					return events, errors.New(fmt.Sprintf("Binlog events dump: invalid End_log_pos in line %d", lineNumber))
+				}
+				events = append(events, event)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return events, nil
+}
+
+// OfflineBinlogEvents is a binlog events source based on saved binary logs (or captured SHOW BINLOG EVENTS output)
+// rather than on a live server. It allows for matching & searching binary logs of instances which are no longer
+// available, and for testing without MySQL.
+type OfflineBinlogEvents struct {
+	binaryLogs []string
+	events     map[string][]BinlogEvent
+}
+
+// NewOfflineBinlogEvents creates an events source from given events, which may span multiple binary logs
+func NewOfflineBinlogEvents(events []BinlogEvent) *OfflineBinlogEvents {
+	offlineEvents := &OfflineBinlogEvents{events: make(map[string][]BinlogEvent)}
+	for _, event := range events {
+		if _, found := offlineEvents.events[event.Coordinates.LogFile]; !found {
+			offlineEvents.binaryLogs = append(offlineEvents.binaryLogs, event.Coordinates.LogFile)
+		}
+		offlineEvents.events[event.Coordinates.LogFile] = append(offlineEvents.events[event.Coordinates.LogFile], event)
+	}
+	sort.Strings(offlineEvents.binaryLogs)
+	for _, binlog := range offlineEvents.binaryLogs {
+		binlogEvents := offlineEvents.events[binlog]
+		sort.Sort(binlogEventsByPos(binlogEvents))
+	}
+	return offlineEvents
+}
+
+type binlogEventsByPos []BinlogEvent
+
+func (this binlogEventsByPos) Len() int      { return len(this) }
+func (this binlogEventsByPos) Swap(i, j int) { this[i], this[j] = this[j], this[i] }
+func (this binlogEventsByPos) Less(i, j int) bool {
+	return this[i].Coordinates.LogPos < this[j].Coordinates.LogPos
+}
+
+// ReadOfflineBinlogEvents reads given files, each being either a binary log or a captured SHOW BINLOG EVENTS output.
+// Binary logs are named after their file names.
+func ReadOfflineBinlogEvents(paths []string) (*OfflineBinlogEvents, error) {
+	events := []BinlogEvent{}
+	for _, path := range paths {
+		fileEvents, err := readOfflineBinlogEventsFile(path)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, fileEvents...)
+	}
+	return NewOfflineBinlogEvents(events), nil
+}
+
+func readOfflineBinlogEventsFile(path string) ([]BinlogEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	bufferedReader := bufio.NewReader(file)
+	magic, _ := bufferedReader.Peek(len(binlogFileMagic))
+	if bytes.Equal(magic, binlogFileMagic) {
+		return ParseBinlog(filepath.Base(path), bufferedReader)
+	}
+	return ParseBinlogEventsDump(bufferedReader)
+}
+
+// GetBinaryLogs returns the names of the binary logs in this source
+func (this *OfflineBinlogEvents) GetBinaryLogs() []string {
+	return this.binaryLogs
+}
+
+// EndCoordinates returns the coordinates following the last event in this source
+func (this *OfflineBinlogEvents) EndCoordinates() BinlogCoordinates {
+	if len(this.binaryLogs) == 0 {
+		return BinlogCoordinates{}
+	}
+	binlogEvents := this.events[this.binaryLogs[len(this.binaryLogs)-1]]
+	return binlogEvents[len(binlogEvents)-1].NextBinlogCoordinates()
+}
+
+// FetchNextEvents is the offline counterpart of getNextBinlogEventsChunk, and can be used by BinlogEventCursor.
+// It returns the next chunk of events starting the given coordinates, skipping to the next binary log if need be,
+// and an empty result upon reaching the end of binary logs.
+func (this *OfflineBinlogEvents) FetchNextEvents(startingCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+	binlogEvents := this.events[startingCoordinates.LogFile]
+	i := sort.Search(len(binlogEvents), func(i int) bool {
+		return binlogEvents[i].Coordinates.LogPos >= startingCoordinates.LogPos
+	})
+	if i < len(binlogEvents) {
+		end := i + binlogEventsChunkSize
+		if end > len(binlogEvents) {
+			end = len(binlogEvents)
+		}
+		return binlogEvents[i:end], nil
+	}
+	for j, binlog := range this.binaryLogs {
+		if binlog == startingCoordinates.LogFile && j+1 < len(this.binaryLogs) {
+			return this.FetchNextEvents(BinlogCoordinates{LogFile: this.binaryLogs[j+1], LogPos: 0})
+		}
+	}
+	return []BinlogEvent{}, nil
+}
+
+// readEventsPage reads events of a single binary log by their ordinal offset, as in SHOW BINLOG EVENTS ... LIMIT offset,count
+func (this *OfflineBinlogEvents) readEventsPage(binlog string, offset int, count int) ([]BinlogEvent, error) {
+	binlogEvents := this.events[binlog]
+	if offset >= len(binlogEvents) {
+		return []BinlogEvent{}, nil
+	}
+	end := offset + count
+	if end > len(binlogEvents) {
+		end = len(binlogEvents)
+	}
+	return binlogEvents[offset:end], nil
+}
+
+// GetLastPseudoGTIDEntry is the offline counterpart of GetLastPseudoGTIDEntryInInstance
+func (this *OfflineBinlogEvents) GetLastPseudoGTIDEntry() (*BinlogCoordinates, string, error) {
+	pseudoGTIDRegexp, err := regexp.Compile(config.Config.PseudoGTIDPattern)
+	if err != nil {
+		return nil, "", err
+	}
+	for i := len(this.binaryLogs) - 1; i >= 0; i-- {
+		binlog := this.binaryLogs[i]
+		resultCoordinates, entryText, err := searchLastPseudoGTIDEntryForward(binlog, pseudoGTIDRegexp, func(offset int, count int) ([]BinlogEvent, error) {
+			return this.readEventsPage(binlog, offset, count)
+		})
+		if err == nil {
+			return &resultCoordinates, entryText, nil
+		}
+	}
+	return nil, "", errors.New("Cannot find pseudo GTID entry in offline binary logs")
+}
+
+// SearchPseudoGTIDEntry is the offline counterpart of SearchPseudoGTIDEntryInInstance
+func (this *OfflineBinlogEvents) SearchPseudoGTIDEntry(entryText string) (*BinlogCoordinates, error) {
+	for i := len(this.binaryLogs) - 1; i >= 0; i-- {
+		binlogEvents := this.events[this.binaryLogs[i]]
+		for j := range binlogEvents {
+			if binlogEvents[j].Info == entryText {
+				return &binlogEvents[j].Coordinates, nil
+			}
+		}
+	}
+	return nil, errors.New("Cannot match pseudo GTID entry in offline binary logs")
+}
+
+// MatchOfflineBinlogEvents runs the match-below logic on offline binlog events: it finds the coordinates in
+// otherEvents at which the instance whose binary logs are instanceEvents would continue replicating.
+func MatchOfflineBinlogEvents(instanceEvents *OfflineBinlogEvents, otherEvents *OfflineBinlogEvents) (*BinlogCoordinates, error) {
+	return matchBinlogEventsSources(instanceEvents, otherEvents)
+}
+
+// MatchBelowOffline reads the binary logs (or captured SHOW BINLOG EVENTS output) of an instance and of another
+// instance from given files, and returns the coordinates in the latter at which the former would continue replicating
+func MatchBelowOffline(instancePaths []string, otherPaths []string) (*BinlogCoordinates, error) {
+	instanceEvents, err := ReadOfflineBinlogEvents(instancePaths)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	otherEvents, err := ReadOfflineBinlogEvents(otherPaths)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	return MatchOfflineBinlogEvents(instanceEvents, otherEvents)
+}
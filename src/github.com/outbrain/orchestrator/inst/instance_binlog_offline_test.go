@@ -0,0 +1,327 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/outbrain/orchestrator/config"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing/iotest"
+)
+
+const offlinePseudoGTIDPattern = "drop view if exists `meta`.`_pseudo_gtid_hint__"
+
+// useOfflinePseudoGTIDPattern configures the pseudo-GTID pattern of the offline fixtures, and returns a function
+// restoring the previously configured pattern
+func useOfflinePseudoGTIDPattern() func() {
+	pseudoGTIDPattern := config.Config.PseudoGTIDPattern
+	config.Config.PseudoGTIDPattern = offlinePseudoGTIDPattern
+	return func() { config.Config.PseudoGTIDPattern = pseudoGTIDPattern }
+}
+
+// fixtureBinlogWriter writes a binary log, in the v4 format, into a memory buffer
+type fixtureBinlogWriter struct {
+	buffer   bytes.Buffer
+	checksum bool
+}
+
+func newFixtureBinlogWriter(serverVersion string, checksum bool) *fixtureBinlogWriter {
+	writer := &fixtureBinlogWriter{checksum: checksum}
+	writer.buffer.Write(binlogFileMagic)
+
+	body := []byte{4, 0}
+	version := make([]byte, 50)
+	copy(version, serverVersion)
+	body = append(body, version...)
+	body = append(body, 0, 0, 0, 0, byte(binlogEventHeaderLength))
+	postHeaderLengths := make([]byte, 35)
+	postHeaderLengths[2-1] = 13
+	postHeaderLengths[4-1] = 8
+	postHeaderLengths[19-1] = 8
+	for _, eventType := range []byte{30, 31, 32} {
+		postHeaderLengths[eventType-1] = 10
+	}
+	body = append(body, postHeaderLengths...)
+	if checksum {
+		body = append(body, binlogChecksumAlgCRC32)
+	} else {
+		body = append(body, 0)
+	}
+	// The format description event's own checksum
+	body = append(body, 0, 0, 0, 0)
+	writer.writeRawEvent(formatDescriptionEventType, 0, body)
+	return writer
+}
+
+func (this *fixtureBinlogWriter) writeRawEvent(eventType byte, flags uint16, body []byte) {
+	size := binlogEventHeaderLength + int64(len(body))
+	header := make([]byte, binlogEventHeaderLength)
+	header[4] = eventType
+	binary.LittleEndian.PutUint32(header[5:9], 1)
+	binary.LittleEndian.PutUint32(header[9:13], uint32(size))
+	binary.LittleEndian.PutUint32(header[13:17], uint32(int64(this.buffer.Len())+size))
+	binary.LittleEndian.PutUint16(header[17:19], flags)
+	this.buffer.Write(header)
+	this.buffer.Write(body)
+}
+
+func (this *fixtureBinlogWriter) writeEvent(eventType byte, flags uint16, body []byte) {
+	if this.checksum {
+		body = append(body, 0xde, 0xad, 0xbe, 0xef)
+	}
+	this.writeRawEvent(eventType, flags, body)
+}
+
+func (this *fixtureBinlogWriter) writeQuery(db string, query string) {
+	body := make([]byte, 13)
+	body[8] = byte(len(db))
+	statusVars := []byte{0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(body[11:13], uint16(len(statusVars)))
+	body = append(body, statusVars...)
+	body = append(body, db...)
+	body = append(body, 0)
+	body = append(body, query...)
+	this.writeEvent(2, 0, body)
+}
+
+func (this *fixtureBinlogWriter) writeRowTransaction(tableId uint64, db string, table string, rowsEventType byte, rowsData []byte, xid uint64) {
+	tableIdBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(tableIdBytes, tableId)
+
+	begin := make([]byte, 13)
+	begin[8] = byte(len(db))
+	begin = append(begin, db...)
+	begin = append(begin, 0)
+	begin = append(begin, "BEGIN"...)
+	this.writeEvent(2, suppressUseEventFlag, begin)
+
+	tableMap := append([]byte{}, tableIdBytes[0:6]...)
+	tableMap = append(tableMap, 1, 0, byte(len(db)))
+	tableMap = append(tableMap, db...)
+	tableMap = append(tableMap, 0, byte(len(table)))
+	tableMap = append(tableMap, table...)
+	tableMap = append(tableMap, 0, 1, 3, 0)
+	this.writeEvent(19, 0, tableMap)
+
+	rows := append([]byte{}, tableIdBytes[0:6]...)
+	rows = append(rows, byte(rowsEventStatementEndFlag), 0, 2, 0)
+	rows = append(rows, rowsData...)
+	this.writeEvent(rowsEventType, 0, rows)
+
+	xidBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(xidBytes, xid)
+	this.writeEvent(16, 0, xidBytes)
+}
+
+func (this *fixtureBinlogWriter) writeRotate(nextBinlog string) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, 4)
+	body = append(body, nextBinlog...)
+	this.writeEvent(4, 0, body)
+}
+
+// formatBinlogEventsDump formats events the way the mysql client presents SHOW BINLOG EVENTS in batch mode
+func formatBinlogEventsDump(events []BinlogEvent) string {
+	lines := []string{"Log_name\tPos\tEvent_type\tServer_id\tEnd_log_pos\tInfo"}
+	for _, event := range events {
+		info := strings.Replace(strings.Replace(event.Info, "\\", "\\\\", -1), "\n", "\\n", -1)
+		lines = append(lines, fmt.Sprintf("%s\t%d\t%s\t1\t%d\t%s", event.Coordinates.LogFile, event.Coordinates.LogPos, event.EventType, event.NextEventPos, info))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+type OfflineBinlogTestSuite struct{}
+
+var _ = Suite(&OfflineBinlogTestSuite{})
+
+func (s *OfflineBinlogTestSuite) TestParseBinlog(c *C) {
+	for _, checksum := range []bool{true, false} {
+		writer := newFixtureBinlogWriter("5.6.22-log", checksum)
+		writer.writeQuery("meta", "drop view if exists `meta`.`_pseudo_gtid_hint__0001`")
+		writer.writeRowTransaction(72, "test", "t1", 30, []byte{1, 2, 3, 4}, 1403)
+		writer.writeRotate("mysql-bin.000018")
+
+		events, err := ParseBinlog("mysql-bin.000017", &writer.buffer)
+		c.Assert(err, IsNil)
+		c.Assert(len(events), Equals, 7)
+
+		expected := []struct{ eventType, info string }{
+			{"Format_desc", "Server ver: 5.6.22-log, Binlog ver: 4"},
+			{"Query", "use `meta`; drop view if exists `meta`.`_pseudo_gtid_hint__0001`"},
+			{"Query", "BEGIN"},
+			{"Table_map", "table_id: 72 (test.t1)"},
+			{"Write_rows", "table_id: 72 flags: STMT_END_F"},
+			{"Xid", "COMMIT /* xid=1403 */"},
+			{"Rotate", "mysql-bin.000018;pos=4"},
+		}
+		pos := int64(4)
+		for i, event := range events {
+			c.Assert(event.EventType, Equals, expected[i].eventType)
+			c.Assert(event.Info, Equals, expected[i].info)
+			c.Assert(event.Coordinates, Equals, BinlogCoordinates{LogFile: "mysql-bin.000017", LogPos: pos})
+			pos = event.NextEventPos
+		}
+	}
+}
+
+func (s *OfflineBinlogTestSuite) TestParseBinlogStreamed(c *C) {
+	writer := newFixtureBinlogWriter("5.6.22-log", true)
+	writer.writeQuery("meta", "drop view if exists `meta`.`_pseudo_gtid_hint__0001`")
+	writer.writeRowTransaction(72, "test", "t1", 30, []byte{1, 2, 3, 4}, 1403)
+	data := writer.buffer.Bytes()
+
+	expectedEvents, err := ParseBinlog("mysql-bin.000017", bytes.NewReader(data))
+	c.Assert(err, IsNil)
+	events, err := ParseBinlog("mysql-bin.000017", iotest.OneByteReader(bytes.NewReader(data)))
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, expectedEvents)
+
+	events, err = ParseBinlog("mysql-bin.000017", iotest.DataErrReader(bytes.NewReader(data)))
+	c.Assert(err, IsNil)
+	c.Assert(events, DeepEquals, expectedEvents)
+}
+
+func (s *OfflineBinlogTestSuite) TestParseBinlogTruncated(c *C) {
+	writer := newFixtureBinlogWriter("5.6.22-log", true)
+	writer.writeQuery("meta", "drop view if exists `meta`.`_pseudo_gtid_hint__0001`")
+	writer.writeRowTransaction(72, "test", "t1", 30, []byte{1, 2, 3, 4}, 1403)
+	data := writer.buffer.Bytes()
+
+	events, err := ParseBinlog("mysql-bin.000017", bytes.NewReader(data[:len(data)-10]))
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 5)
+
+	_, err = ParseBinlog("mysql-bin.000017", strings.NewReader("not a binlog"))
+	c.Assert(err, NotNil)
+}
+
+func (s *OfflineBinlogTestSuite) TestParseBinlogEventsDump(c *C) {
+	dump := "Log_name\tPos\tEvent_type\tServer_id\tEnd_log_pos\tInfo\n" +
+		"mysql-bin.000017\t4\tFormat_desc\t1\t120\tServer ver: 5.6.22-log, Binlog ver: 4\n" +
+		"mysql-bin.000017\t120\tQuery\t1\t251\tuse `test`; insert into t values ('a\\tb')\\n/* multi line */\n" +
+		"mysql-bin.000017\t251\tXid\t1\t282\tCOMMIT /* xid=12 */\n"
+	events, err := ParseBinlogEventsDump(strings.NewReader(dump))
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 3)
+	c.Assert(events[1].Coordinates, Equals, BinlogCoordinates{LogFile: "mysql-bin.000017", LogPos: 120})
+	c.Assert(events[1].NextEventPos, Equals, int64(251))
+	c.Assert(events[1].EventType, Equals, "Query")
+	c.Assert(events[1].Info, Equals, "use `test`; insert into t values ('a\tb')\n/* multi line */")
+
+	_, err = ParseBinlogEventsDump(strings.NewReader("Log_name\tPos\n"))
+	c.Assert(err, NotNil)
+}
+
+// offlineTopology creates binlogs of a slave, which has executed a single transaction following a pseudo-GTID
+// entry, and of its sibling, which has logged the same at different positions, then some more.
+// The slave's binary logs span two files.
+func offlineTopology(siblingRowsData []byte) (*OfflineBinlogEvents, *OfflineBinlogEvents, BinlogCoordinates) {
+	slaveWriter := newFixtureBinlogWriter("5.6.22-log", true)
+	slaveWriter.writeRowTransaction(72, "test", "t0", 30, []byte{9}, 1401)
+	slaveWriter.writeQuery("meta", "drop view if exists `meta`.`_pseudo_gtid_hint__0002`")
+	slaveWriter.writeRotate("mysql-bin.000018")
+	slaveEvents, _ := ParseBinlog("mysql-bin.000017", &slaveWriter.buffer)
+	slaveWriter = newFixtureBinlogWriter("5.6.22-log", true)
+	slaveWriter.writeRowTransaction(72, "test", "t1", 30, []byte{1, 2, 3, 4}, 1402)
+	moreSlaveEvents, _ := ParseBinlog("mysql-bin.000018", &slaveWriter.buffer)
+	slaveEvents = append(slaveEvents, moreSlaveEvents...)
+
+	siblingWriter := newFixtureBinlogWriter("5.6.22-log", true)
+	siblingWriter.writeQuery("meta", "drop view if exists `meta`.`_pseudo_gtid_hint__0001`")
+	siblingWriter.writeRowTransaction(1013, "test", "t0", 30, []byte{9}, 5101)
+	siblingWriter.writeQuery("meta", "drop view if exists `meta`.`_pseudo_gtid_hint__0002`")
+	siblingWriter.writeRowTransaction(1013, "test", "t1", 30, siblingRowsData, 5102)
+	siblingMatchPos := int64(siblingWriter.buffer.Len())
+	siblingWriter.writeRowTransaction(1014, "test", "t2", 32, []byte{5, 6}, 5103)
+	siblingEvents, _ := ParseBinlog("mysql-bin.000242", &siblingWriter.buffer)
+
+	// Sibling binlogs are available as captured SHOW BINLOG EVENTS output
+	siblingEvents, _ = ParseBinlogEventsDump(strings.NewReader(formatBinlogEventsDump(siblingEvents)))
+
+	return NewOfflineBinlogEvents(slaveEvents), NewOfflineBinlogEvents(siblingEvents), BinlogCoordinates{LogFile: "mysql-bin.000242", LogPos: siblingMatchPos}
+}
+
+func (s *OfflineBinlogTestSuite) TestMatchOfflineBinlogEvents(c *C) {
+	defer useOfflinePseudoGTIDPattern()()
+	slaveEvents, siblingEvents, expectedCoordinates := offlineTopology([]byte{1, 2, 3, 4})
+
+	c.Assert(slaveEvents.GetBinaryLogs(), DeepEquals, []string{"mysql-bin.000017", "mysql-bin.000018"})
+	coordinates, err := MatchOfflineBinlogEvents(slaveEvents, siblingEvents)
+	c.Assert(err, IsNil)
+	c.Assert(*coordinates, Equals, expectedCoordinates)
+}
+
+func (s *OfflineBinlogTestSuite) TestMatchOfflineBinlogEventsMismatch(c *C) {
+	defer useOfflinePseudoGTIDPattern()()
+	// Same table, same event types, different row data
+	slaveEvents, siblingEvents, _ := offlineTopology([]byte{1, 2, 3, 4, 5, 6})
+
+	_, err := MatchOfflineBinlogEvents(slaveEvents, siblingEvents)
+	c.Assert(err, NotNil)
+}
+
+func (s *OfflineBinlogTestSuite) TestMatchOfflineBinlogEventsSlaveMoreAdvanced(c *C) {
+	defer useOfflinePseudoGTIDPattern()()
+	slaveEvents, siblingEvents, _ := offlineTopology([]byte{1, 2, 3, 4})
+
+	// The other way round: the sibling is more advanced than the slave
+	_, err := MatchOfflineBinlogEvents(siblingEvents, slaveEvents)
+	c.Assert(err, NotNil)
+}
+
+func (s *OfflineBinlogTestSuite) TestMatchBelowOffline(c *C) {
+	defer useOfflinePseudoGTIDPattern()()
+	slaveEvents, siblingEvents, expectedCoordinates := offlineTopology([]byte{1, 2, 3, 4})
+
+	dir, err := ioutil.TempDir("", "orchestrator-offline-binlogs")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	// Slave binary logs as files
+	slavePaths := []string{}
+	for _, binlog := range []string{"mysql-bin.000017", "mysql-bin.000018"} {
+		writer := newFixtureBinlogWriter("5.6.22-log", true)
+		if binlog == "mysql-bin.000017" {
+			writer.writeRowTransaction(72, "test", "t0", 30, []byte{9}, 1401)
+			writer.writeQuery("meta", "drop view if exists `meta`.`_pseudo_gtid_hint__0002`")
+			writer.writeRotate("mysql-bin.000018")
+		} else {
+			writer.writeRowTransaction(72, "test", "t1", 30, []byte{1, 2, 3, 4}, 1402)
+		}
+		path := filepath.Join(dir, binlog)
+		c.Assert(ioutil.WriteFile(path, writer.buffer.Bytes(), 0644), IsNil)
+		slavePaths = append(slavePaths, path)
+	}
+	fileEvents, err := ReadOfflineBinlogEvents(slavePaths)
+	c.Assert(err, IsNil)
+	c.Assert(fileEvents, DeepEquals, slaveEvents)
+
+	// Sibling binary logs as captured SHOW BINLOG EVENTS output
+	siblingPath := filepath.Join(dir, "sibling-binlog-events.txt")
+	siblingDump := formatBinlogEventsDump(siblingEvents.events["mysql-bin.000242"])
+	c.Assert(ioutil.WriteFile(siblingPath, []byte(siblingDump), 0644), IsNil)
+
+	coordinates, err := MatchBelowOffline(slavePaths, []string{siblingPath})
+	c.Assert(err, IsNil)
+	c.Assert(*coordinates, Equals, expectedCoordinates)
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+const (
+	binlogFirstEventPos                int64 = 4
+	binlogEventHeaderSize              int64 = 19
+	binlogReverseSearchWindowSize      int64 = 1024 * 1024
+	binlogReverseSearchEventsChunkSize int   = 1000
+	binlogOffsetProbeLimit             int64 = 512
+	binlogOffsetProbeMaxCount          int   = 2048
+	binlogOffsetProbeEventsCount       int   = 2
+)
+
+// searchLastPseudoGTIDEntryForward scans a binary log from its very beginning, in pages of events, and returns
+// the last entry matching the given pattern.
+// readEventsPage is expected to behave like SHOW BINLOG EVENTS IN ... LIMIT offset,count
+func searchLastPseudoGTIDEntryForward(binlog string, pattern *regexp.Regexp, readEventsPage func(offset int, count int) ([]BinlogEvent, error)) (BinlogCoordinates, string, error) {
+	binlogCoordinates := BinlogCoordinates{LogFile: binlog, LogPos: 0}
+	entryText := ""
+	for step := 0; ; step++ {
+		events, err := readEventsPage(step*binlogEventsChunkSize, binlogEventsChunkSize)
+		if err != nil {
+			return binlogCoordinates, "", err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if pattern.MatchString(event.Info) {
+				binlogCoordinates.LogPos = event.Coordinates.LogPos
+				entryText = event.Info
+				// Found a match. But we keep searching: we're interested in the LAST entry, and, alas,
+				// we can only search in ASCENDING order...
+			}
+		}
+	}
+	if binlogCoordinates.LogPos == 0 {
+		return binlogCoordinates, "", errors.New(fmt.Sprintf("Cannot find pseudo GTID entry in binlog '%s'", binlog))
+	}
+	return binlogCoordinates, entryText, nil
+}
+
+// isValidBinlogEventsChain checks that the given events, read at given position, make for a consistent sequence
+// of binary log events. This is how we tell an actual event position from an arbitrary offset within the binary log.
+func isValidBinlogEventsChain(events []BinlogEvent, startPos int64) bool {
+	if len(events) == 0 {
+		return false
+	}
+	expectedPos := startPos
+	for _, event := range events {
+		if event.Coordinates.LogPos != expectedPos {
+			return false
+		}
+		if event.NextEventPos <= event.Coordinates.LogPos {
+			return false
+		}
+		expectedPos = event.NextEventPos
+	}
+	return true
+}
+
+// probeBinlogEventPosition looks for the first actual event position at or after fromPos, and before toPos.
+// An arbitrary offset within a binary log is typically not the beginning of an event; reading from such offset
+// either fails or returns garbage. We therefore probe offset by offset, up to binlogOffsetProbeLimit bytes, and
+// no more than maxProbes probes. It returns the number of probes made.
+func probeBinlogEventPosition(binlog string, fromPos int64, toPos int64, maxProbes int, readEventsFrom func(BinlogCoordinates, int) ([]BinlogEvent, error)) (int64, int, bool) {
+	probes := 0
+	for pos := fromPos; pos < toPos && pos < fromPos+binlogOffsetProbeLimit && probes < maxProbes; pos++ {
+		probes++
+		events, err := readEventsFrom(BinlogCoordinates{LogFile: binlog, LogPos: pos}, binlogOffsetProbeEventsCount)
+		if err == nil && isValidBinlogEventsChain(events, pos) {
+			return pos, probes, true
+		}
+	}
+	return 0, probes, false
+}
+
+// windowEventsReadCount returns the number of events to read from eventPos so as not to read far past windowEnd:
+// no more than could possibly fit in the remainder of the window, and no more than binlogReverseSearchEventsChunkSize
+func windowEventsReadCount(eventPos int64, windowEnd int64) int {
+	count := int((windowEnd-eventPos)/binlogEventHeaderSize) + 1
+	if count > binlogReverseSearchEventsChunkSize {
+		count = binlogReverseSearchEventsChunkSize
+	}
+	return count
+}
+
+// searchLastPseudoGTIDEntryBackwards returns the last entry in a binary log matching the given pattern. Rather than scanning
+// the binary log from its beginning, it starts near the end of the log (as per binlogSize) and steps backwards in
+// windows of windowSize bytes, stopping at the first window which contains a matching entry.
+// Should a window start within an event larger than the probe range, or the probes budget run out, the search falls
+// back to scanning forward.
+// readEventsFrom is expected to behave like SHOW BINLOG EVENTS IN ... FROM pos LIMIT count;
+// readEventsPage is expected to behave like SHOW BINLOG EVENTS IN ... LIMIT offset,count
+func searchLastPseudoGTIDEntryBackwards(binlog string, binlogSize int64, windowSize int64, pattern *regexp.Regexp, readEventsFrom func(BinlogCoordinates, int) ([]BinlogEvent, error), readEventsPage func(offset int, count int) ([]BinlogEvent, error)) (BinlogCoordinates, string, error) {
+	binlogCoordinates := BinlogCoordinates{LogFile: binlog, LogPos: 0}
+	windowStart := binlogSize
+	windowEnd := binlogSize
+	probesBudget := binlogOffsetProbeMaxCount
+	for windowEnd > binlogFirstEventPos {
+		windowStart = windowStart - windowSize
+		if windowStart < binlogFirstEventPos {
+			windowStart = binlogFirstEventPos
+		}
+		if windowStart > binlogFirstEventPos {
+			eventPos, probes, found := probeBinlogEventPosition(binlog, windowStart, windowEnd, probesBudget, readEventsFrom)
+			probesBudget -= probes
+			if !found {
+				return searchLastPseudoGTIDEntryForward(binlog, pattern, readEventsPage)
+			}
+			windowStart = eventPos
+		}
+
+		entryText := ""
+		for eventPos := windowStart; eventPos < windowEnd; {
+			events, err := readEventsFrom(BinlogCoordinates{LogFile: binlog, LogPos: eventPos}, windowEventsReadCount(eventPos, windowEnd))
+			if err != nil {
+				return binlogCoordinates, "", err
+			}
+			if len(events) == 0 {
+				break
+			}
+			for _, event := range events {
+				if event.Coordinates.LogPos >= windowEnd {
+					break
+				}
+				if event.NextEventPos <= event.Coordinates.LogPos {
+					return binlogCoordinates, "", errors.New(fmt.Sprintf("Unexpected event end position in binlog '%s': %+v", binlog, event))
+				}
+				if pattern.MatchString(event.Info) {
+					binlogCoordinates.LogPos = event.Coordinates.LogPos
+					entryText = event.Info
+				}
+				eventPos = event.NextEventPos
+			}
+		}
+		if binlogCoordinates.LogPos != 0 {
+			return binlogCoordinates, entryText, nil
+		}
+		windowEnd = windowStart
+	}
+	return binlogCoordinates, "", errors.New(fmt.Sprintf("Cannot find pseudo GTID entry in binlog '%s'", binlog))
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"errors"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"math/rand"
+	"regexp"
+	"sort"
+)
+
+// fakeBinlog simulates a single binary log, answering SHOW BINLOG EVENTS queries the way a MySQL server does:
+// reading from an offset which is not an event position is an error.
+type fakeBinlog struct {
+	name   string
+	events []BinlogEvent
+}
+
+var fakePseudoGTIDRegexp = regexp.MustCompile(`^drop view if exists .*?`)
+
+// newFakeBinlog generates numEvents events of random sizes, making every pseudoGTIDEvery-th event a pseudo-GTID entry.
+// A pseudoGTIDEvery of 0 means no pseudo-GTID entries. Every hugeEventEvery-th event is far larger than the probe range.
+func newFakeBinlog(seed int64, numEvents int, pseudoGTIDEvery int, hugeEventEvery int) *fakeBinlog {
+	random := rand.New(rand.NewSource(seed))
+	binlog := &fakeBinlog{name: "mysql-bin.000042"}
+	pos := binlogFirstEventPos
+	for i := 0; i < numEvents; i++ {
+		size := int64(20 + random.Intn(400))
+		info := fmt.Sprintf("insert into test.t values (%d)", i)
+		eventType := "Query"
+		if i == 0 {
+			eventType = "Format_desc"
+			info = "Server ver: 5.6.22-log, Binlog ver: 4"
+		} else if pseudoGTIDEvery > 0 && i%pseudoGTIDEvery == 0 {
+			info = fmt.Sprintf("drop view if exists `meta`.`_pseudo_gtid_hint__%d`", i)
+		} else if hugeEventEvery > 0 && i%hugeEventEvery == 0 {
+			size = 8 * binlogOffsetProbeLimit
+		}
+		event := BinlogEvent{
+			Coordinates:  BinlogCoordinates{LogFile: binlog.name, LogPos: pos},
+			NextEventPos: pos + size,
+			EventType:    eventType,
+			Info:         info,
+		}
+		binlog.events = append(binlog.events, event)
+		pos += size
+	}
+	return binlog
+}
+
+func (this *fakeBinlog) size() int64 {
+	return this.events[len(this.events)-1].NextEventPos
+}
+
+func (this *fakeBinlog) readEventsPage(offset int, count int) ([]BinlogEvent, error) {
+	if offset >= len(this.events) {
+		return []BinlogEvent{}, nil
+	}
+	end := offset + count
+	if end > len(this.events) {
+		end = len(this.events)
+	}
+	return this.events[offset:end], nil
+}
+
+func (this *fakeBinlog) readEventsFrom(coordinates BinlogCoordinates, count int) ([]BinlogEvent, error) {
+	if coordinates.LogFile != this.name {
+		return nil, errors.New("Could not find target log")
+	}
+	if coordinates.LogPos >= this.size() {
+		return []BinlogEvent{}, nil
+	}
+	i := sort.Search(len(this.events), func(i int) bool { return this.events[i].Coordinates.LogPos >= coordinates.LogPos })
+	if i == len(this.events) || this.events[i].Coordinates.LogPos != coordinates.LogPos {
+		return nil, errors.New("Wrong offset or I/O error")
+	}
+	end := i + count
+	if end > len(this.events) {
+		end = len(this.events)
+	}
+	return this.events[i:end], nil
+}
+
+type BinlogSearchTestSuite struct{}
+
+var _ = Suite(&BinlogSearchTestSuite{})
+
+func (s *BinlogSearchTestSuite) assertSameSearchResult(c *C, binlog *fakeBinlog, windowSize int64) {
+	forwardCoordinates, forwardEntry, forwardErr := searchLastPseudoGTIDEntryForward(binlog.name, fakePseudoGTIDRegexp, binlog.readEventsPage)
+	backwardsCoordinates, backwardsEntry, backwardsErr := searchLastPseudoGTIDEntryBackwards(binlog.name, binlog.size(), windowSize, fakePseudoGTIDRegexp, binlog.readEventsFrom, binlog.readEventsPage)
+
+	c.Assert(backwardsErr == nil, Equals, forwardErr == nil)
+	c.Assert(backwardsCoordinates.Equals(&forwardCoordinates), Equals, true)
+	c.Assert(backwardsEntry, Equals, forwardEntry)
+}
+
+func (s *BinlogSearchTestSuite) TestSearchBackwardsLargeBinlog(c *C) {
+	binlog := newFakeBinlog(1, 300000, 5000, 0)
+	s.assertSameSearchResult(c, binlog, binlogReverseSearchWindowSize)
+	s.assertSameSearchResult(c, binlog, 64*1024)
+}
+
+func (s *BinlogSearchTestSuite) TestSearchBackwardsHugeEvents(c *C) {
+	binlog := newFakeBinlog(2, 200000, 7919, 13)
+	s.assertSameSearchResult(c, binlog, binlogReverseSearchWindowSize)
+	s.assertSameSearchResult(c, binlog, 2*binlogOffsetProbeLimit)
+}
+
+func (s *BinlogSearchTestSuite) TestSearchBackwardsEntryAtBeginning(c *C) {
+	binlog := newFakeBinlog(3, 250000, 0, 0)
+	binlog.events[1].Info = "drop view if exists `meta`.`_pseudo_gtid_hint__first`"
+	s.assertSameSearchResult(c, binlog, 64*1024)
+
+	coordinates, entry, err := searchLastPseudoGTIDEntryBackwards(binlog.name, binlog.size(), 64*1024, fakePseudoGTIDRegexp, binlog.readEventsFrom, binlog.readEventsPage)
+	c.Assert(err, IsNil)
+	c.Assert(coordinates.LogPos, Equals, binlog.events[1].Coordinates.LogPos)
+	c.Assert(entry, Equals, binlog.events[1].Info)
+}
+
+func (s *BinlogSearchTestSuite) TestSearchBackwardsNoEntry(c *C) {
+	binlog := newFakeBinlog(4, 100000, 0, 17)
+	s.assertSameSearchResult(c, binlog, binlogReverseSearchWindowSize)
+
+	_, _, err := searchLastPseudoGTIDEntryBackwards(binlog.name, binlog.size(), binlogReverseSearchWindowSize, fakePseudoGTIDRegexp, binlog.readEventsFrom, binlog.readEventsPage)
+	c.Assert(err, NotNil)
+}
+
+func (s *BinlogSearchTestSuite) TestSearchBackwardsStopsAtFirstMatch(c *C) {
+	binlog := newFakeBinlog(5, 300000, 1000, 0)
+	readPositions := []int64{}
+	readEventsFrom := func(coordinates BinlogCoordinates, count int) ([]BinlogEvent, error) {
+		readPositions = append(readPositions, coordinates.LogPos)
+		return binlog.readEventsFrom(coordinates, count)
+	}
+	coordinates, _, err := searchLastPseudoGTIDEntryBackwards(binlog.name, binlog.size(), binlogReverseSearchWindowSize, fakePseudoGTIDRegexp, readEventsFrom, binlog.readEventsPage)
+	c.Assert(err, IsNil)
+	c.Assert(coordinates.LogPos, Equals, binlog.events[299000].Coordinates.LogPos)
+	for _, pos := range readPositions {
+		c.Assert(pos >= binlog.size()-2*binlogReverseSearchWindowSize, Equals, true)
+	}
+}
+
+func (s *BinlogSearchTestSuite) TestSearchBackwardsBoundedReads(c *C) {
+	binlog := newFakeBinlog(6, 300000, 1000, 0)
+	readEventsFrom := func(coordinates BinlogCoordinates, count int) ([]BinlogEvent, error) {
+		c.Assert(count <= binlogReverseSearchEventsChunkSize, Equals, true)
+		return binlog.readEventsFrom(coordinates, count)
+	}
+	pageReads := 0
+	readEventsPage := func(offset int, count int) ([]BinlogEvent, error) {
+		pageReads++
+		return binlog.readEventsPage(offset, count)
+	}
+	coordinates, _, err := searchLastPseudoGTIDEntryBackwards(binlog.name, binlog.size(), binlogReverseSearchWindowSize, fakePseudoGTIDRegexp, readEventsFrom, readEventsPage)
+	c.Assert(err, IsNil)
+	c.Assert(pageReads, Equals, 0)
+	c.Assert(coordinates.LogPos, Equals, binlog.events[299000].Coordinates.LogPos)
+
+	c.Assert(windowEventsReadCount(1000, 1000+binlogEventHeaderSize*10), Equals, 11)
+	c.Assert(windowEventsReadCount(1000, 1000+binlogReverseSearchWindowSize), Equals, binlogReverseSearchEventsChunkSize)
+}
+
+func (s *BinlogSearchTestSuite) TestSearchBackwardsProbesFallBackToForward(c *C) {
+	binlog := newFakeBinlog(7, 20000, 3001, 1)
+	probes := 0
+	readEventsFrom := func(coordinates BinlogCoordinates, count int) ([]BinlogEvent, error) {
+		if count == binlogOffsetProbeEventsCount {
+			probes++
+		}
+		return binlog.readEventsFrom(coordinates, count)
+	}
+	pageReads := 0
+	readEventsPage := func(offset int, count int) ([]BinlogEvent, error) {
+		pageReads++
+		return binlog.readEventsPage(offset, count)
+	}
+	coordinates, entry, err := searchLastPseudoGTIDEntryBackwards(binlog.name, binlog.size(), binlogReverseSearchWindowSize, fakePseudoGTIDRegexp, readEventsFrom, readEventsPage)
+	c.Assert(err, IsNil)
+	c.Assert(coordinates.LogPos, Equals, binlog.events[18006].Coordinates.LogPos)
+	c.Assert(entry, Equals, binlog.events[18006].Info)
+	c.Assert(probes <= binlogOffsetProbeMaxCount, Equals, true)
+	c.Assert(pageReads > 0, Equals, true)
+}
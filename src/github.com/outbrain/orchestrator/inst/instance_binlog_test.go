@@ -0,0 +1,258 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+// fixtureEvent describes a binlog event in a fixture stream; positions are computed when building the stream
+type fixtureEvent struct {
+	eventType string
+	info      string
+	length    int64
+}
+
+// newFixtureCursor builds a cursor over a stream of events laid out sequentially in a single binary log
+func newFixtureCursor(logFile string, startPos int64, fixtureEvents []fixtureEvent) BinlogEventCursor {
+	events := []BinlogEvent{}
+	pos := startPos
+	for _, fixture := range fixtureEvents {
+		events = append(events, BinlogEvent{
+			Coordinates:  BinlogCoordinates{LogFile: logFile, LogPos: pos},
+			NextEventPos: pos + fixture.length,
+			EventType:    fixture.eventType,
+			Info:         fixture.info,
+		})
+		pos += fixture.length
+	}
+	fetchNextEvents := func(coordinates BinlogCoordinates) ([]BinlogEvent, error) {
+		for i := range events {
+			if events[i].Coordinates.LogPos >= coordinates.LogPos {
+				return events[i:], nil
+			}
+		}
+		return []BinlogEvent{}, nil
+	}
+	return NewBinlogEventCursor(BinlogCoordinates{LogFile: logFile, LogPos: startPos}, fetchNextEvents)
+}
+
+const fixturePseudoGTID = "use `meta`; drop view if exists `meta`.`_pseudo_gtid_hint__53e62ef1`"
+
+// rowTransaction returns the events of a single row based transaction on given table
+func rowTransaction(tableId string, tableName string, rowsEventType string, rowsLength int64) []fixtureEvent {
+	return []fixtureEvent{
+		{"Query", "BEGIN", 80},
+		{"Table_map", "table_id: " + tableId + " (" + tableName + ")", 52},
+		{rowsEventType, "table_id: " + tableId + " flags: STMT_END_F", rowsLength},
+		{"Xid", "COMMIT /* xid=" + tableId + "0 */", 31},
+	}
+}
+
+func fixtureStream(transactions ...[]fixtureEvent) []fixtureEvent {
+	stream := []fixtureEvent{{"Query", fixturePseudoGTID, 170}}
+	for _, transaction := range transactions {
+		stream = append(stream, transaction...)
+	}
+	return stream
+}
+
+type BinlogEventMatchTestSuite struct{}
+
+var _ = Suite(&BinlogEventMatchTestSuite{})
+
+func (s *BinlogEventMatchTestSuite) TestMatchIdenticalRowEvents(c *C) {
+	// Same events, logged at different positions with different table ids
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 1000, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+		rowTransaction("72", "test.t2", "Update_rows", 95),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 5000, fixtureStream(
+		rowTransaction("1413", "test.t1", "Write_rows", 60),
+		rowTransaction("1414", "test.t2", "Update_rows", 95),
+		rowTransaction("1415", "test.t3", "Delete_rows", 40),
+	))
+	instanceCoordinates, otherCoordinates, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, IsNil)
+	c.Assert(*instanceCoordinates, Equals, BinlogCoordinates{LogFile: "mysql-bin.000010", LogPos: 1000 + 170 + 2*(80+52+31) + 60 + 95})
+	c.Assert(*otherCoordinates, Equals, BinlogCoordinates{LogFile: "mysql-bin.000234", LogPos: 5000 + 170 + 2*(80+52+31) + 60 + 95})
+}
+
+func (s *BinlogEventMatchTestSuite) TestMismatchRowEventLength(c *C) {
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 62),
+	))
+	_, _, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, NotNil)
+}
+
+func (s *BinlogEventMatchTestSuite) TestMatchRowEventsWithChecksum(c *C) {
+	// Other server logs checksums: each of its events is 4 bytes longer
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 64),
+	))
+	_, _, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, IsNil)
+}
+
+func (s *BinlogEventMatchTestSuite) TestMatchRowEventsOfDifferentVersions(c *C) {
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows_v1", 58),
+		rowTransaction("72", "test.t2", "Update_rows_v1", 93),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+		rowTransaction("72", "test.t2", "Update_rows", 95),
+	))
+	_, _, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, IsNil)
+
+	instanceCursor = newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows_v1", 58),
+	))
+	otherCursor = newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Delete_rows", 60),
+	))
+	_, _, err = matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, NotNil)
+}
+
+func (s *BinlogEventMatchTestSuite) TestMismatchRowEventType(c *C) {
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Delete_rows", 60),
+	))
+	_, _, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, NotNil)
+}
+
+func (s *BinlogEventMatchTestSuite) TestMismatchRowEventTable(c *C) {
+	// Same table ids, different tables
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("71", "test.t2", "Write_rows", 60),
+	))
+	_, _, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, NotNil)
+}
+
+func (s *BinlogEventMatchTestSuite) TestMismatchRowEventTableViaEarlierTableMap(c *C) {
+	// Table ids map to different tables on both servers; the rows event itself only shows the table id
+	instanceTransaction := []fixtureEvent{
+		{"Query", "BEGIN", 80},
+		{"Table_map", "table_id: 71 (test.t1)", 52},
+		{"Table_map", "table_id: 72 (test.t2)", 52},
+		{"Write_rows", "table_id: 71", 60},
+		{"Write_rows", "table_id: 72 flags: STMT_END_F", 60},
+		{"Xid", "COMMIT /* xid=711 */", 31},
+	}
+	otherTransaction := []fixtureEvent{
+		{"Query", "BEGIN", 80},
+		{"Table_map", "table_id: 81 (test.t1)", 52},
+		{"Table_map", "table_id: 82 (test.t2)", 52},
+		{"Write_rows", "table_id: 82", 60},
+		{"Write_rows", "table_id: 81 flags: STMT_END_F", 60},
+		{"Xid", "COMMIT /* xid=811 */", 31},
+	}
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(instanceTransaction))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(otherTransaction))
+	_, _, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, NotNil)
+}
+
+func (s *BinlogEventMatchTestSuite) TestInstanceMoreAdvanced(c *C) {
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+		rowTransaction("72", "test.t2", "Update_rows", 95),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+	))
+	_, _, err := matchBinlogEventCursors(&instanceCursor, &otherCursor)
+	c.Assert(err, NotNil)
+}
+
+func (s *BinlogEventMatchTestSuite) TestCompareReportsFirstDivergence(c *C) {
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+		rowTransaction("72", "test.t2", "Update_rows", 95),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+		rowTransaction("72", "test.t2", "Update_rows", 101),
+	))
+	comparison, err := compareBinlogEventCursors(&instanceCursor, &otherCursor, 100)
+	c.Assert(err, IsNil)
+	c.Assert(comparison.Diverged, Equals, true)
+	c.Assert(comparison.ComparedEvents, Equals, 7)
+	c.Assert(comparison.InstanceEvent.EventType, Equals, "Update_rows")
+	c.Assert(comparison.OtherEvent.Length(), Equals, int64(101))
+}
+
+func (s *BinlogEventMatchTestSuite) TestCompareIdentical(c *C) {
+	instanceCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+	))
+	otherCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("81", "test.t1", "Write_rows", 60),
+	))
+	comparison, err := compareBinlogEventCursors(&instanceCursor, &otherCursor, 100)
+	c.Assert(err, IsNil)
+	c.Assert(comparison.Diverged, Equals, false)
+	c.Assert(comparison.ComparedEvents, Equals, 5)
+}
+
+func (s *BinlogEventMatchTestSuite) TestErrantEventOnSlave(c *C) {
+	slaveCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+		rowTransaction("72", "test.local", "Write_rows", 60),
+	))
+	masterCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("81", "test.t1", "Write_rows", 60),
+		rowTransaction("82", "test.t2", "Write_rows", 60),
+	))
+	errantEvent, _, _, err := findErrantBinlogEvent(&slaveCursor, &masterCursor)
+	c.Assert(err, IsNil)
+	c.Assert(errantEvent, NotNil)
+	c.Assert(errantEvent.EventType, Equals, "Table_map")
+	c.Assert(errantEvent.TableName, Equals, "test.local")
+}
+
+func (s *BinlogEventMatchTestSuite) TestNoErrantEventOnLaggingSlave(c *C) {
+	slaveCursor := newFixtureCursor("mysql-bin.000010", 4, fixtureStream(
+		rowTransaction("71", "test.t1", "Write_rows", 60),
+	))
+	masterCursor := newFixtureCursor("mysql-bin.000234", 4, fixtureStream(
+		rowTransaction("81", "test.t1", "Write_rows", 60),
+		rowTransaction("82", "test.t2", "Write_rows", 60),
+	))
+	errantEvent, slaveCoordinates, masterCoordinates, err := findErrantBinlogEvent(&slaveCursor, &masterCursor)
+	c.Assert(err, IsNil)
+	c.Assert(errantEvent, IsNil)
+	c.Assert(slaveCoordinates.LogPos, Equals, int64(4+170+80+52+60+31))
+	c.Assert(masterCoordinates.LogPos, Equals, int64(4+170+80+52+60+31))
+}
@@ -17,6 +17,7 @@
 package inst
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -70,13 +71,23 @@ func ScanInstanceRow(instanceKey *InstanceKey, query string, dest ...interface{}
 	if err != nil {
 		return err
 	}
-	err = db.QueryRow(query).Scan(dest...)
+	err = scanTopologyRow(context.Background(), db, query, dest...)
 	return err
 }
 
 // ReadTopologyInstance connects to a topology MySQL instance and reads its configuration and
 // replication status. It writes read info into orchestrator's backend.
 func ReadTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
+	return readTopologyInstance(instanceKey, false)
+}
+
+// PollTopologyInstance is ReadTopologyInstance as done by a discovery poll, which also samples the instance's
+// history. Reads made in the course of refactorings are not sampled.
+func PollTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
+	return readTopologyInstance(instanceKey, true)
+}
+
+func readTopologyInstance(instanceKey *InstanceKey, writeHistory bool) (*Instance, error) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Errorf("Unexpected error: %+v", err)
@@ -85,10 +96,11 @@ func ReadTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
 
 	instance := NewInstance()
 	instanceFound := false
-	foundBySlaveHosts := false
 	longRunningProcesses := []Process{}
 	resolvedHostname := ""
 	var resolveErr error
+	ctx, cancel := newProbeContext()
+	defer cancel()
 
 	_ = UpdateInstanceLastAttemptedCheck(instanceKey)
 
@@ -99,7 +111,7 @@ func ReadTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
 	}
 
 	instance.Key = *instanceKey
-	err = db.QueryRow("select @@hostname, @@global.server_id, @@global.version, @@global.read_only, @@global.binlog_format, @@global.log_bin, @@global.log_slave_updates").Scan(
+	err = scanTopologyRow(ctx, db, "select @@hostname, @@global.server_id, @@global.version, @@global.read_only, @@global.binlog_format, @@global.log_bin, @@global.log_slave_updates",
 		&resolvedHostname, &instance.ServerID, &instance.Version, &instance.ReadOnly, &instance.Binlog_format, &instance.LogBinEnabled, &instance.LogSlaveUpdatesEnabled)
 	if err != nil {
 		goto Cleanup
@@ -109,15 +121,27 @@ func ReadTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
 		instance.Key.Hostname = resolvedHostname
 	}
 	instanceFound = true
-	err = sqlutils.QueryRowsMap(db, "show slave status", func(m sqlutils.RowMap) error {
+	// gtid_mode is only known on MySQL 5.6 and above; on earlier versions this yields no rows
+	err = queryTopologyRowsMap(ctx, db, "show global variables like 'gtid_mode'", func(m sqlutils.RowMap) error {
+		instance.GTIDMode = m.GetString("Value")
+		return nil
+	})
+	if err != nil {
+		goto Cleanup
+	}
+	err = queryTopologyRowsMap(ctx, db, "show slave status", func(m sqlutils.RowMap) error {
 		instance.Slave_IO_Running = (m.GetString("Slave_IO_Running") == "Yes")
 		instance.Slave_SQL_Running = (m.GetString("Slave_SQL_Running") == "Yes")
 		instance.ReadBinlogCoordinates.LogFile = m.GetString("Master_Log_File")
 		instance.ReadBinlogCoordinates.LogPos = m.GetInt64("Read_Master_Log_Pos")
 		instance.ExecBinlogCoordinates.LogFile = m.GetString("Relay_Master_Log_File")
 		instance.ExecBinlogCoordinates.LogPos = m.GetInt64("Exec_Master_Log_Pos")
+		instance.RelaylogCoordinates.LogFile = m.GetString("Relay_Log_File")
+		instance.RelaylogCoordinates.LogPos = m.GetInt64("Relay_Log_Pos")
 		instance.LastSQLError = m.GetString("Last_SQL_Error")
 		instance.LastIOError = m.GetString("Last_IO_Error")
+		instance.RetrievedGtidSet = m.GetString("Retrieved_Gtid_Set")
+		instance.UsingGTIDAutoPosition = (m.GetString("Auto_Position") == "1")
 
 		masterKey, err := NewInstanceKeyFromStrings(m.GetString("Master_Host"), m.GetString("Master_Port"))
 		if err != nil {
@@ -140,17 +164,18 @@ func ReadTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
 	}
 
 	if config.Config.SlaveLagQuery != "" {
-		err = db.QueryRow(config.Config.SlaveLagQuery).Scan(&instance.SlaveLagSeconds)
+		err = scanTopologyRow(ctx, db, config.Config.SlaveLagQuery, &instance.SlaveLagSeconds)
 		if err != nil {
 			goto Cleanup
 		}
 	}
 
 	if instance.LogBinEnabled {
-		err = sqlutils.QueryRowsMap(db, "show master status", func(m sqlutils.RowMap) error {
+		err = queryTopologyRowsMap(ctx, db, "show master status", func(m sqlutils.RowMap) error {
 			var err error
 			instance.SelfBinlogCoordinates.LogFile = m.GetString("File")
 			instance.SelfBinlogCoordinates.LogPos = m.GetInt64("Position")
+			instance.ExecutedGtidSet = m.GetString("Executed_Gtid_Set")
 			return err
 		})
 		if err != nil {
@@ -158,52 +183,26 @@ func ReadTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
 		}
 	}
 
-	// Get slaves, either by SHOW SLAVE HOSTS or via PROCESSLIST
-	if config.Config.DiscoverByShowSlaveHosts {
-		err := sqlutils.QueryRowsMap(db, `show slave hosts`,
-			func(m sqlutils.RowMap) error {
-				slaveKey, err := NewInstanceKeyFromStrings(m.GetString("Host"), m.GetString("Port"))
-				slaveKey.Hostname, resolveErr = ResolveHostname(slaveKey.Hostname)
-				if err == nil {
-					instance.AddSlaveKey(slaveKey)
-					foundBySlaveHosts = true
-				}
-				return err
-			})
-
-		if err != nil {
-			goto Cleanup
-		}
+	instance.ClusterName, err = ReadClusterNameByMaster(&instance.Key, &instance.MasterKey)
+	if err != nil {
+		goto Cleanup
 	}
-	if !foundBySlaveHosts {
-		// Either not configured to read SHOW SLAVE HOSTS or nothing was there.
-		// Discover by processlist
-		err := sqlutils.QueryRowsMap(db, `
-        	select 
-        		substring_index(host, ':', 1) as slave_hostname 
-        	from 
-        		information_schema.processlist 
-        	where 
-        		command='Binlog Dump'`,
-			func(m sqlutils.RowMap) error {
-				cname, resolveErr := ResolveHostname(m.GetString("slave_hostname"))
-				if resolveErr != nil {
-					log.Errore(resolveErr)
-				}
-				slaveKey := InstanceKey{Hostname: cname, Port: instance.Key.Port}
-				instance.AddSlaveKey(&slaveKey)
-				return err
-			})
-
-		if err != nil {
-			goto Cleanup
+	{
+		// Get slaves, by the discovery method configured for the cluster.
+		// Failing to discover slaves does not fail the read of the instance itself.
+		slaveKeys, discoveryErr := discoverSlaves(ctx, instance)
+		if discoveryErr != nil {
+			log.Errorf("Cannot discover slaves of %+v: %+v", instance.Key, discoveryErr)
+		}
+		for i := range slaveKeys {
+			instance.AddSlaveKey(&slaveKeys[i])
 		}
 	}
 	{
 		binlogs := []string{}
 		if instance.LogBinEnabled {
 			// Get binary (master) logs
-			err = sqlutils.QueryRowsMap(db, "show binary logs", func(m sqlutils.RowMap) error {
+			err = queryTopologyRowsMap(ctx, db, "show binary logs", func(m sqlutils.RowMap) error {
 				binlogs = append(binlogs, m.GetString("Log_name"))
 				return nil
 			})
@@ -215,7 +214,7 @@ func ReadTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
 	}
 	{
 		// Get long running processes
-		err := sqlutils.QueryRowsMap(db, `
+		err = queryTopologyRowsMap(ctx, db, `
 				  select 
 				    id,
 				    user,
@@ -259,18 +258,20 @@ func ReadTopologyInstance(instanceKey *InstanceKey) (*Instance, error) {
 		}
 	}
 
-	instance.ClusterName, err = ReadClusterNameByMaster(&instance.Key, &instance.MasterKey)
-	if err != nil {
-		goto Cleanup
-	}
-
 Cleanup:
+	// An instance which was not found may not even have its key set
+	checkedKey := instanceKey
 	if instanceFound {
+		checkedKey = &instance.Key
 		_ = WriteInstance(instance, err)
 		WriteLongRunningProcesses(&instance.Key, longRunningProcesses)
 	} else {
-		_ = UpdateInstanceLastChecked(&instance.Key)
+		_ = UpdateInstanceLastChecked(instanceKey)
+	}
+	if writeHistory {
+		_ = writeInstanceHistory(newInstanceHistoryEntry(instanceKey, instance, instanceFound, checkOutcome(err)))
 	}
+	_ = UpdateInstanceLastCheckOutcome(checkedKey, checkOutcome(err))
 	if err != nil {
 		log.Errore(err)
 	}
@@ -322,6 +323,10 @@ func readInstanceRow(m sqlutils.RowMap) *Instance {
 	instance.Binlog_format = m.GetString("binlog_format")
 	instance.LogBinEnabled = m.GetBool("log_bin")
 	instance.LogSlaveUpdatesEnabled = m.GetBool("log_slave_updates")
+	instance.GTIDMode = m.GetString("gtid_mode")
+	instance.ExecutedGtidSet = m.GetString("executed_gtid_set")
+	instance.RetrievedGtidSet = m.GetString("retrieved_gtid_set")
+	instance.UsingGTIDAutoPosition = m.GetBool("using_gtid_auto_position")
 	instance.MasterKey.Hostname = m.GetString("master_host")
 	instance.MasterKey.Port = m.GetInt("master_port")
 	instance.Slave_SQL_Running = m.GetBool("slave_sql_running")
@@ -332,8 +337,14 @@ func readInstanceRow(m sqlutils.RowMap) *Instance {
 	instance.ReadBinlogCoordinates.LogPos = m.GetInt64("read_master_log_pos")
 	instance.ExecBinlogCoordinates.LogFile = m.GetString("relay_master_log_file")
 	instance.ExecBinlogCoordinates.LogPos = m.GetInt64("exec_master_log_pos")
+	instance.RelaylogCoordinates.LogFile = m.GetString("relay_log_file")
+	instance.RelaylogCoordinates.LogPos = m.GetInt64("relay_log_pos")
+	instance.HasErrantTransactions = m.GetBool("has_errant_transactions")
+	instance.ErrantBinlogCoordinates.LogFile = m.GetString("errant_binlog_file")
+	instance.ErrantBinlogCoordinates.LogPos = m.GetInt64("errant_binlog_pos")
 	instance.LastSQLError = m.GetString("last_sql_error")
 	instance.LastIOError = m.GetString("last_io_error")
+	instance.LastCheckOutcome = m.GetString("last_check_outcome")
 	instance.SecondsBehindMaster = m.GetNullInt64("seconds_behind_master")
 	instance.SlaveLagSeconds = m.GetNullInt64("slave_lag_seconds")
 	slaveHostsJson := m.GetString("slave_hosts")
@@ -420,6 +431,20 @@ func ReadSlaveInstances(masterKey *InstanceKey) ([](*Instance), error) {
 	return readInstancesByCondition(condition)
 }
 
+// ReadMasterInstances reads all instances which have no known master in the backend database; these are the
+// masters of their topologies (or otherwise standalone instances)
+func ReadMasterInstances() ([](*Instance), error) {
+	condition := `
+			not exists (
+				select 1 from database_instance master_instance 
+				where 
+					master_instance.hostname = database_instance.master_host 
+					and master_instance.port = database_instance.master_port
+			)
+		`
+	return readInstancesByCondition(condition)
+}
+
 // ReadProblemInstances reads all instances with problems
 func ReadProblemInstances() ([](*Instance), error) {
 	condition := fmt.Sprintf(`
@@ -428,6 +453,7 @@ func ReadProblemInstances() ([](*Instance), error) {
 			or (not slave_sql_running)
 			or (not slave_io_running)
 			or (seconds_behind_master > 10)
+			or (has_errant_transactions)
 		`, config.Config.InstancePollSeconds)
 	return readInstancesByCondition(condition)
 }
@@ -580,10 +606,10 @@ func ReadOutdatedInstanceKeys() ([]InstanceKey, error) {
 			if (
 				last_attempted_check <= last_checked,
 				last_checked < now() - interval %d second,
-				last_checked < now() - interval (%d * 20) second
+				last_attempted_check < now() - interval %d second
 			)
 			`,
-		config.Config.InstancePollSeconds, config.Config.InstancePollSeconds)
+		config.Config.InstancePollSeconds, config.Config.InstanceProbeTimeoutSeconds)
 	db, err := db.OpenOrchestrator()
 	if err != nil {
 		goto Cleanup
@@ -617,18 +643,39 @@ func WriteInstance(instance *Instance, lastError error) error {
 			return log.Errore(err)
 		}
 
+		// The instance as known before it is overwritten, for detecting topology changes
+		var known *Instance
+		knownRead := false
+		if lastError == nil {
+			if knownInstance, found, rerr := ReadInstance(&instance.Key); rerr != nil {
+				log.Errore(rerr)
+			} else {
+				knownRead = true
+				if found {
+					known = knownInstance
+				}
+			}
+		}
+
+		// last_read_progress notes down the last time slave's read coordinates were seen to advance.
+		// It must be evaluated before master_log_file & read_master_log_pos are updated.
 		_, err = sqlutils.Exec(db, `
-        	replace into database_instance (
+        	insert into database_instance (
         		hostname,
         		port,
         		last_checked,
         		last_attempted_check,
+        		last_read_progress,
         		server_id,
 				version,
 				read_only,
 				binlog_format,
 				log_bin,
 				log_slave_updates,
+				gtid_mode,
+				executed_gtid_set,
+				retrieved_gtid_set,
+				using_gtid_auto_position,
 				binary_log_file,
 				binary_log_pos,
 				master_host,
@@ -639,6 +686,8 @@ func WriteInstance(instance *Instance, lastError error) error {
 				read_master_log_pos,
 				relay_master_log_file,
 				exec_master_log_pos,
+				relay_log_file,
+				relay_log_pos,
 				last_sql_error,
 				last_io_error,
 				seconds_behind_master,
@@ -646,7 +695,45 @@ func WriteInstance(instance *Instance, lastError error) error {
 				num_slave_hosts,
 				slave_hosts,
 				cluster_name
-			) values (?, ?, NOW(), NOW(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			) values (?, ?, NOW(), NOW(), NOW(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			on duplicate key update
+				last_read_progress = if(
+					master_log_file != values(master_log_file) or read_master_log_pos != values(read_master_log_pos),
+					values(last_read_progress),
+					last_read_progress
+				),
+				last_checked = values(last_checked),
+				last_attempted_check = values(last_attempted_check),
+				server_id = values(server_id),
+				version = values(version),
+				read_only = values(read_only),
+				binlog_format = values(binlog_format),
+				log_bin = values(log_bin),
+				log_slave_updates = values(log_slave_updates),
+				gtid_mode = values(gtid_mode),
+				executed_gtid_set = values(executed_gtid_set),
+				retrieved_gtid_set = values(retrieved_gtid_set),
+				using_gtid_auto_position = values(using_gtid_auto_position),
+				binary_log_file = values(binary_log_file),
+				binary_log_pos = values(binary_log_pos),
+				master_host = values(master_host),
+				master_port = values(master_port),
+				slave_sql_running = values(slave_sql_running),
+				slave_io_running = values(slave_io_running),
+				master_log_file = values(master_log_file),
+				read_master_log_pos = values(read_master_log_pos),
+				relay_master_log_file = values(relay_master_log_file),
+				exec_master_log_pos = values(exec_master_log_pos),
+				relay_log_file = values(relay_log_file),
+				relay_log_pos = values(relay_log_pos),
+				last_sql_error = values(last_sql_error),
+				last_io_error = values(last_io_error),
+				seconds_behind_master = values(seconds_behind_master),
+				slave_lag_seconds = values(slave_lag_seconds),
+				num_slave_hosts = values(num_slave_hosts),
+				slave_hosts = values(slave_hosts),
+				cluster_name = values(cluster_name)
+			`,
 			instance.Key.Hostname,
 			instance.Key.Port,
 			instance.ServerID,
@@ -655,6 +742,10 @@ func WriteInstance(instance *Instance, lastError error) error {
 			instance.Binlog_format,
 			instance.LogBinEnabled,
 			instance.LogSlaveUpdatesEnabled,
+			instance.GTIDMode,
+			instance.ExecutedGtidSet,
+			instance.RetrievedGtidSet,
+			instance.UsingGTIDAutoPosition,
 			instance.SelfBinlogCoordinates.LogFile,
 			instance.SelfBinlogCoordinates.LogPos,
 			instance.MasterKey.Hostname,
@@ -665,6 +756,8 @@ func WriteInstance(instance *Instance, lastError error) error {
 			instance.ReadBinlogCoordinates.LogPos,
 			instance.ExecBinlogCoordinates.LogFile,
 			instance.ExecBinlogCoordinates.LogPos,
+			instance.RelaylogCoordinates.LogFile,
+			instance.RelaylogCoordinates.LogPos,
 			instance.LastSQLError,
 			instance.LastIOError,
 			instance.SecondsBehindMaster,
@@ -682,6 +775,9 @@ func WriteInstance(instance *Instance, lastError error) error {
         	update database_instance set last_seen = NOW() where hostname=? and port=?
         	`, instance.Key.Hostname, instance.Key.Port,
 			)
+			if knownRead {
+				writeTopologyChanges(db, instance, known)
+			}
 		} else {
 			log.Debugf("WriteInstance: will not update database_instance due to error: %+v", lastError)
 		}
@@ -719,6 +815,36 @@ func UpdateInstanceLastChecked(instanceKey *InstanceKey) error {
 	return execDBWriteFunc(writeFunc)
 }
 
+// UpdateInstanceLastCheckOutcome notes down the outcome of the last check of an instance: success, error, or
+// timeout should reading the instance not complete in time.
+func UpdateInstanceLastCheckOutcome(instanceKey *InstanceKey, outcome string) error {
+	writeFunc := func() error {
+		db, err := db.OpenOrchestrator()
+		if err != nil {
+			return log.Errore(err)
+		}
+
+		_, err = sqlutils.Exec(db, `
+        	update 
+        		database_instance 
+        	set
+        		last_check_outcome = ?
+			where 
+				hostname = ?
+				and port = ?`,
+			outcome,
+			instanceKey.Hostname,
+			instanceKey.Port,
+		)
+		if err != nil {
+			return log.Errore(err)
+		}
+
+		return nil
+	}
+	return execDBWriteFunc(writeFunc)
+}
+
 // UpdateInstanceLastAttemptedCheck updates the last_attempted_check timestamp in the orchestrator backed database
 // for a given instance.
 // This is used as a failsafe mechanism in case access to the instance gets hung (it happens), in which case
@@ -762,6 +888,7 @@ func ForgetInstance(instanceKey *InstanceKey) error {
 		return log.Errore(err)
 	}
 
+	writeForgottenInstancesChangeEvents(db, "hostname = ? and port = ?", instanceKey.Hostname, instanceKey.Port)
 	_, err = sqlutils.Exec(db, `
 			delete 
 				from database_instance 
@@ -770,6 +897,7 @@ func ForgetInstance(instanceKey *InstanceKey) error {
 		instanceKey.Hostname,
 		instanceKey.Port,
 	)
+	deleteForgottenInstancesStates(db)
 	AuditOperation("forget", instanceKey, "")
 	return err
 }
@@ -781,6 +909,7 @@ func ForgetLongUnseenInstances() error {
 		return log.Errore(err)
 	}
 
+	writeForgottenInstancesChangeEvents(db, "last_seen < NOW() - interval ? hour", config.Config.UnseenInstanceForgetHours)
 	_, err = sqlutils.Exec(db, `
 			delete 
 				from database_instance 
@@ -788,6 +917,7 @@ func ForgetLongUnseenInstances() error {
 				last_seen < NOW() - interval ? hour`,
 		config.Config.UnseenInstanceForgetHours,
 	)
+	deleteForgottenInstancesStates(db)
 	AuditOperation("forget-unseen", nil, "")
 	return err
 }
@@ -898,6 +1028,12 @@ func StartSlave(instanceKey *InstanceKey) (*Instance, error) {
 	return instance, err
 }
 
+// startSlaveUntilStatement returns the START SLAVE UNTIL statement for given master coordinates
+func startSlaveUntilStatement(masterCoordinates *BinlogCoordinates) string {
+	return fmt.Sprintf("start slave until master_log_file='%s', master_log_pos=%d",
+		masterCoordinates.LogFile, masterCoordinates.LogPos)
+}
+
 // StartSlaveUntilMasterCoordinates issuesa START SLAVE UNTIL... statement on given instance
 func StartSlaveUntilMasterCoordinates(instanceKey *InstanceKey, masterCoordinates *BinlogCoordinates) (*Instance, error) {
 	instance, err := ReadTopologyInstance(instanceKey)
@@ -914,8 +1050,7 @@ func StartSlaveUntilMasterCoordinates(instanceKey *InstanceKey, masterCoordinate
 
 	log.Infof("Will start slave on %+v until coordinates: %+v", instanceKey, masterCoordinates)
 
-	_, err = ExecInstance(instanceKey, fmt.Sprintf("start slave until master_log_file='%s', master_log_pos=%d",
-		masterCoordinates.LogFile, masterCoordinates.LogPos))
+	_, err = ExecInstance(instanceKey, startSlaveUntilStatement(masterCoordinates))
 	if err != nil {
 		return instance, log.Errore(err)
 	}
@@ -944,6 +1079,35 @@ func StartSlaveUntilMasterCoordinates(instanceKey *InstanceKey, masterCoordinate
 	return instance, err
 }
 
+// canUseAutoPosition returns true when both given instance and its designated master have GTID enabled,
+// in which case replication is set up with MASTER_AUTO_POSITION=1 rather than by binlog coordinates.
+func canUseAutoPosition(instance *Instance, masterKey *InstanceKey) bool {
+	if !instance.IsGTIDEnabled() {
+		return false
+	}
+	master, found, err := ReadInstance(masterKey)
+	if err != nil || !found {
+		return false
+	}
+	return master.IsGTIDEnabled()
+}
+
+// changeMasterToStatement returns the CHANGE MASTER TO statement by which given instance is pointed to given master and
+// coordinates. With autoPosition, coordinates are ignored and GTID auto positioning is used instead. Otherwise, auto
+// positioning is turned off should the instance currently use it, as MySQL rejects coordinates along with it.
+func changeMasterToStatement(instance *Instance, masterKey *InstanceKey, masterBinlogCoordinates *BinlogCoordinates, autoPosition bool) string {
+	if autoPosition {
+		return fmt.Sprintf("change master to master_host='%s', master_port=%d, master_auto_position=1",
+			masterKey.Hostname, masterKey.Port)
+	}
+	statement := fmt.Sprintf("change master to master_host='%s', master_port=%d, master_log_file='%s', master_log_pos=%d",
+		masterKey.Hostname, masterKey.Port, masterBinlogCoordinates.LogFile, masterBinlogCoordinates.LogPos)
+	if instance.UsingGTIDAutoPosition {
+		statement = fmt.Sprintf("%s, master_auto_position=0", statement)
+	}
+	return statement
+}
+
 // ChangeMasterTo changes the given instance's master according to given input.
 func ChangeMasterTo(instanceKey *InstanceKey, masterKey *InstanceKey, masterBinlogCoordinates *BinlogCoordinates) (*Instance, error) {
 	instance, err := ReadTopologyInstance(instanceKey)
@@ -955,12 +1119,16 @@ func ChangeMasterTo(instanceKey *InstanceKey, masterKey *InstanceKey, masterBinl
 		return instance, errors.New(fmt.Sprintf("Cannot change master on: %+v because slave is running", instanceKey))
 	}
 
-	_, err = ExecInstance(instanceKey, fmt.Sprintf("change master to master_host='%s', master_port=%d, master_log_file='%s', master_log_pos=%d",
-		masterKey.Hostname, masterKey.Port, masterBinlogCoordinates.LogFile, masterBinlogCoordinates.LogPos))
+	autoPosition := canUseAutoPosition(instance, masterKey)
+	_, err = ExecInstance(instanceKey, changeMasterToStatement(instance, masterKey, masterBinlogCoordinates, autoPosition))
 	if err != nil {
 		return instance, log.Errore(err)
 	}
-	log.Infof("Changed master on %+v to: %+v, %+v", instanceKey, masterKey, masterBinlogCoordinates)
+	if autoPosition {
+		log.Infof("Changed master on %+v to: %+v, using GTID auto positioning", instanceKey, masterKey)
+	} else {
+		log.Infof("Changed master on %+v to: %+v, %+v", instanceKey, masterKey, masterBinlogCoordinates)
+	}
 
 	instance, err = ReadTopologyInstance(instanceKey)
 	return instance, err
@@ -1012,6 +1180,41 @@ func MasterPosWait(instanceKey *InstanceKey, binlogCoordinates *BinlogCoordinate
 	return instance, err
 }
 
+// MasterPosWaitWithTimeout waits, up to given timeout, until given slave has executed its master's events up to given
+// coordinates. Unlike MasterPosWait, it fails when the timeout is reached, or when the slave's SQL thread is not running.
+func MasterPosWaitWithTimeout(instanceKey *InstanceKey, binlogCoordinates *BinlogCoordinates, timeoutSeconds int) (*Instance, error) {
+	instance, err := ReadTopologyInstance(instanceKey)
+	if err != nil {
+		return instance, log.Errore(err)
+	}
+
+	db, err := db.OpenTopology(instanceKey.Hostname, instanceKey.Port)
+	if err != nil {
+		return instance, log.Errore(err)
+	}
+	var eventsWaited sql.NullInt64
+	err = db.QueryRow(fmt.Sprintf("select master_pos_wait('%s', %d, %d)",
+		binlogCoordinates.LogFile, binlogCoordinates.LogPos, timeoutSeconds)).Scan(&eventsWaited)
+	if err != nil {
+		return instance, log.Errore(err)
+	}
+	if !eventsWaited.Valid {
+		return instance, log.Errorf("master_pos_wait on %+v returned NULL: SQL thread is not running", *instanceKey)
+	}
+	if eventsWaited.Int64 < 0 {
+		return instance, log.Errorf("Instance %+v did not reach coordinates %+v within %d seconds", *instanceKey, *binlogCoordinates, timeoutSeconds)
+	}
+	log.Infof("Instance %+v has reached coordinates: %+v", instanceKey, binlogCoordinates)
+
+	instance, err = ReadTopologyInstance(instanceKey)
+	return instance, err
+}
+
+// setReadOnlyStatement returns the statement setting or clearing the global read_only variable
+func setReadOnlyStatement(readOnly bool) string {
+	return fmt.Sprintf("set global read_only = %t", readOnly)
+}
+
 // SetReadOnly sets or clears the instance's global read_only variable
 func SetReadOnly(instanceKey *InstanceKey, readOnly bool) (*Instance, error) {
 	instance, err := ReadTopologyInstance(instanceKey)
@@ -1019,7 +1222,7 @@ func SetReadOnly(instanceKey *InstanceKey, readOnly bool) (*Instance, error) {
 		return instance, log.Errore(err)
 	}
 
-	_, err = ExecInstance(instanceKey, fmt.Sprintf("set global read_only = %t", readOnly))
+	_, err = ExecInstance(instanceKey, setReadOnlyStatement(readOnly))
 	if err != nil {
 		return instance, log.Errore(err)
 	}
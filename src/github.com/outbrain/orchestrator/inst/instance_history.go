@@ -0,0 +1,35 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"database/sql"
+)
+
+// InstanceHistoryEntry is a snapshot of an instance's replication status, as sampled on a single poll
+type InstanceHistoryEntry struct {
+	Key                   InstanceKey
+	SnapshotTimestamp     string
+	CheckOutcome          string
+	Slave_SQL_Running     bool
+	Slave_IO_Running      bool
+	SecondsBehindMaster   sql.NullInt64
+	SlaveLagSeconds       sql.NullInt64
+	SelfBinlogCoordinates BinlogCoordinates
+	ReadBinlogCoordinates BinlogCoordinates
+	ExecBinlogCoordinates BinlogCoordinates
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/db"
+)
+
+// isInstanceHistoryEnabled checks whether instance status snapshots are kept
+func isInstanceHistoryEnabled() bool {
+	return config.Config.InstanceHistoryRetentionHours > 0
+}
+
+// newInstanceHistoryEntry samples the replication status of an instance, as just read, along with the outcome of
+// the check. When the instance could not be read at all, only the outcome is sampled.
+func newInstanceHistoryEntry(instanceKey *InstanceKey, instance *Instance, instanceFound bool, checkOutcome string) InstanceHistoryEntry {
+	entry := InstanceHistoryEntry{Key: *instanceKey, CheckOutcome: checkOutcome}
+	if !instanceFound {
+		return entry
+	}
+	entry.Key = instance.Key
+	entry.Slave_SQL_Running = instance.Slave_SQL_Running
+	entry.Slave_IO_Running = instance.Slave_IO_Running
+	entry.SecondsBehindMaster = instance.SecondsBehindMaster
+	entry.SlaveLagSeconds = instance.SlaveLagSeconds
+	entry.SelfBinlogCoordinates = instance.SelfBinlogCoordinates
+	entry.ReadBinlogCoordinates = instance.ReadBinlogCoordinates
+	entry.ExecBinlogCoordinates = instance.ExecBinlogCoordinates
+	return entry
+}
+
+// writeInstanceHistory writes given status snapshot, taking its time as now
+func writeInstanceHistory(entry InstanceHistoryEntry) error {
+	if !isInstanceHistoryEnabled() {
+		return nil
+	}
+	writeFunc := func() error {
+		db, err := db.OpenOrchestrator()
+		if err != nil {
+			return log.Errore(err)
+		}
+
+		_, err = sqlutils.Exec(db, `
+			insert into database_instance_history (
+				hostname,
+				port,
+				snapshot_timestamp,
+				check_outcome,
+				slave_sql_running,
+				slave_io_running,
+				seconds_behind_master,
+				slave_lag_seconds,
+				binary_log_file,
+				binary_log_pos,
+				master_log_file,
+				read_master_log_pos,
+				relay_master_log_file,
+				exec_master_log_pos
+			) values (?, ?, NOW(), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			`,
+			entry.Key.Hostname,
+			entry.Key.Port,
+			entry.CheckOutcome,
+			entry.Slave_SQL_Running,
+			entry.Slave_IO_Running,
+			entry.SecondsBehindMaster,
+			entry.SlaveLagSeconds,
+			entry.SelfBinlogCoordinates.LogFile,
+			entry.SelfBinlogCoordinates.LogPos,
+			entry.ReadBinlogCoordinates.LogFile,
+			entry.ReadBinlogCoordinates.LogPos,
+			entry.ExecBinlogCoordinates.LogFile,
+			entry.ExecBinlogCoordinates.LogPos,
+		)
+		return log.Errore(err)
+	}
+	return execDBWriteFunc(writeFunc)
+}
+
+// ReadInstanceHistory returns the status snapshots of given instance, oldest first, taken since given time
+// (formatted as "2006-01-02 15:04:05"). With an empty since, snapshots of the last hour are returned.
+func ReadInstanceHistory(instanceKey *InstanceKey, since string) ([]InstanceHistoryEntry, error) {
+	res := []InstanceHistoryEntry{}
+	sinceCondition := "snapshot_timestamp >= now() - interval 1 hour"
+	args := []interface{}{instanceKey.Hostname, instanceKey.Port}
+	if since != "" {
+		sinceCondition = "snapshot_timestamp >= ?"
+		args = append(args, since)
+	}
+	query := `
+		select 
+			hostname,
+			port,
+			snapshot_timestamp,
+			check_outcome,
+			slave_sql_running,
+			slave_io_running,
+			seconds_behind_master,
+			slave_lag_seconds,
+			binary_log_file,
+			binary_log_pos,
+			master_log_file,
+			read_master_log_pos,
+			relay_master_log_file,
+			exec_master_log_pos
+		from 
+			database_instance_history
+		where
+			hostname = ?
+			and port = ?
+			and ` + sinceCondition + `
+		order by
+			snapshot_timestamp asc, history_id asc
+		`
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return res, log.Errore(err)
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		entry := InstanceHistoryEntry{}
+		entry.Key.Hostname = m.GetString("hostname")
+		entry.Key.Port = m.GetInt("port")
+		entry.SnapshotTimestamp = m.GetString("snapshot_timestamp")
+		entry.CheckOutcome = m.GetString("check_outcome")
+		entry.Slave_SQL_Running = m.GetBool("slave_sql_running")
+		entry.Slave_IO_Running = m.GetBool("slave_io_running")
+		entry.SecondsBehindMaster = m.GetNullInt64("seconds_behind_master")
+		entry.SlaveLagSeconds = m.GetNullInt64("slave_lag_seconds")
+		entry.SelfBinlogCoordinates.LogFile = m.GetString("binary_log_file")
+		entry.SelfBinlogCoordinates.LogPos = m.GetInt64("binary_log_pos")
+		entry.ReadBinlogCoordinates.LogFile = m.GetString("master_log_file")
+		entry.ReadBinlogCoordinates.LogPos = m.GetInt64("read_master_log_pos")
+		entry.ExecBinlogCoordinates.LogFile = m.GetString("relay_master_log_file")
+		entry.ExecBinlogCoordinates.LogPos = m.GetInt64("exec_master_log_pos")
+
+		res = append(res, entry)
+		return nil
+	}, args...)
+	if err != nil {
+		return res, log.Errore(err)
+	}
+	return res, nil
+}
+
+// PurgeInstanceHistory removes status snapshots older than the configured retention
+func PurgeInstanceHistory() error {
+	if !isInstanceHistoryEnabled() {
+		return nil
+	}
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	_, err = sqlutils.Exec(db, `
+			delete 
+				from database_instance_history 
+			where 
+				snapshot_timestamp < NOW() - interval ? hour`,
+		config.Config.InstanceHistoryRetentionHours,
+	)
+	return log.Errore(err)
+}
@@ -0,0 +1,69 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"database/sql"
+	"github.com/outbrain/orchestrator/config"
+	. "gopkg.in/check.v1"
+)
+
+type InstanceHistoryTestSuite struct{}
+
+var _ = Suite(&InstanceHistoryTestSuite{})
+
+func (s *InstanceHistoryTestSuite) TestHistoryEntryOfReadInstance(c *C) {
+	instanceKey := InstanceKey{Hostname: "db-slave", Port: 3306}
+	instance := NewInstance()
+	instance.Key = instanceKey
+	instance.Slave_SQL_Running = true
+	instance.SecondsBehindMaster = sql.NullInt64{Int64: 7, Valid: true}
+	instance.SelfBinlogCoordinates = BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 400}
+	instance.ExecBinlogCoordinates = BinlogCoordinates{LogFile: "mysql-bin.000034", LogPos: 800}
+
+	entry := newInstanceHistoryEntry(&instanceKey, instance, true, CheckOutcomeTimeout)
+	c.Assert(entry.Key, Equals, instanceKey)
+	c.Assert(entry.CheckOutcome, Equals, CheckOutcomeTimeout)
+	c.Assert(entry.Slave_SQL_Running, Equals, true)
+	c.Assert(entry.Slave_IO_Running, Equals, false)
+	c.Assert(entry.SecondsBehindMaster, Equals, instance.SecondsBehindMaster)
+	c.Assert(entry.SelfBinlogCoordinates, Equals, instance.SelfBinlogCoordinates)
+	c.Assert(entry.ExecBinlogCoordinates, Equals, instance.ExecBinlogCoordinates)
+}
+
+func (s *InstanceHistoryTestSuite) TestHistoryEntryOfUnreachableInstance(c *C) {
+	instanceKey := InstanceKey{Hostname: "db-slave", Port: 3306}
+	instance := NewInstance()
+	instance.Slave_SQL_Running = true
+
+	entry := newInstanceHistoryEntry(&instanceKey, instance, false, CheckOutcomeError)
+	c.Assert(entry.Key, Equals, instanceKey)
+	c.Assert(entry.CheckOutcome, Equals, CheckOutcomeError)
+	c.Assert(entry.Slave_SQL_Running, Equals, false)
+	c.Assert(entry.SecondsBehindMaster.Valid, Equals, false)
+	c.Assert(entry.SelfBinlogCoordinates, Equals, BinlogCoordinates{})
+}
+
+func (s *InstanceHistoryTestSuite) TestDisabledHistoryIsNotWrittenNorPurged(c *C) {
+	retentionHours := config.Config.InstanceHistoryRetentionHours
+	defer func() { config.Config.InstanceHistoryRetentionHours = retentionHours }()
+	config.Config.InstanceHistoryRetentionHours = 0
+
+	// Neither touches the backend database, which is unavailable here
+	c.Assert(writeInstanceHistory(InstanceHistoryEntry{CheckOutcome: CheckOutcomeSuccess}), IsNil)
+	c.Assert(PurgeInstanceHistory(), IsNil)
+}
@@ -0,0 +1,280 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/db"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// relaylogEvent is an event as read from a relay log. The coordinates of the embedded BinlogEvent refer to the relay log.
+// In addition, the event carries the server id it originates from, and its end position within the originating
+// binary log (this is what End_log_pos stands for in a relay log).
+type relaylogEvent struct {
+	BinlogEvent
+	ServerID       uint
+	OriginalEndPos int64
+}
+
+// isLogNotFoundError checks whether given error is the server's way of saying a binary or relay log does not exist,
+// e.g. has been purged
+func isLogNotFoundError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Could not find target log")
+}
+
+// parseRelaylogIndex returns the relay log names listed in the content of a relay log index file, in order.
+// The index lists paths (e.g. "./relay-bin.000012"); names are returned without their directory.
+func parseRelaylogIndex(content string) []string {
+	relaylogs := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		relaylogs = append(relaylogs, path.Base(line))
+	}
+	return relaylogs
+}
+
+// readRelaylogIndex lists the existing relay logs of an instance, as per its relay log index file.
+// Reading the index file requires the FILE privilege; an error is returned if the index cannot be read.
+func readRelaylogIndex(instance *Instance) ([]string, error) {
+	db, err := db.OpenTopology(instance.Key.Hostname, instance.Key.Port)
+	if err != nil {
+		return []string{}, err
+	}
+	var content sql.NullString
+	err = scanTopologyRow(context.Background(), db, "select load_file(@@global.relay_log_index)", &content)
+	if err != nil {
+		return []string{}, err
+	}
+	if !content.Valid {
+		return []string{}, errors.New(fmt.Sprintf("Cannot read relay log index of %+v", instance.Key))
+	}
+	return parseRelaylogIndex(content.String), nil
+}
+
+// getSiblingRelaylog returns the name of the relay log which is delta files away from given relay log.
+// When the relay logs are known (as read from the relay log index) the sibling is looked up among them, and is not
+// found beyond either end. Otherwise the sibling is deduced from the numeric suffix of the name, e.g. for
+// "relay-bin.000012" and delta -1 this is "relay-bin.000011"; whether it exists is then up to the caller to find out.
+func getSiblingRelaylog(relaylogs []string, relaylog string, delta int) (string, bool, error) {
+	if len(relaylogs) > 0 {
+		for i := range relaylogs {
+			if relaylogs[i] == relaylog {
+				if i+delta < 0 || i+delta >= len(relaylogs) {
+					return "", false, nil
+				}
+				return relaylogs[i+delta], true, nil
+			}
+		}
+		return "", false, errors.New(fmt.Sprintf("Relay log %s is not listed in relay log index", relaylog))
+	}
+	fileNum, err := logFileNumber(relaylog)
+	if err != nil {
+		return "", false, err
+	}
+	if fileNum+delta <= 0 {
+		return "", false, nil
+	}
+	suffix := relaylog[strings.LastIndex(relaylog, ".")+1:]
+	return fmt.Sprintf("%s.%0*d", relaylog[:len(relaylog)-len(suffix)-1], len(suffix), fileNum+delta), true, nil
+}
+
+// readRelaylogEventsChunk reads a chunk of relay log events starting the given coordinates, and up to the relay log
+// execution coordinates of the instance.
+func readRelaylogEventsChunk(instance *Instance, startingCoordinates BinlogCoordinates) ([]relaylogEvent, error) {
+	events := []relaylogEvent{}
+	db, err := db.OpenTopology(instance.Key.Hostname, instance.Key.Port)
+	if err != nil {
+		return events, err
+	}
+	query := fmt.Sprintf("show relaylog events in '%s' FROM %d LIMIT %d", startingCoordinates.LogFile, startingCoordinates.LogPos, binlogEventsChunkSize+1)
+	err = queryTopologyRowsMap(context.Background(), db, query, func(m sqlutils.RowMap) error {
+		event := relaylogEvent{}
+		event.Coordinates.LogFile = m.GetString("Log_name")
+		event.Coordinates.LogPos = m.GetInt64("Pos")
+		event.EventType = m.GetString("Event_type")
+		event.Info = m.GetString("Info")
+		event.ServerID = m.GetUint("Server_id")
+		event.OriginalEndPos = m.GetInt64("End_log_pos")
+		events = append(events, event)
+		return nil
+	})
+	if err != nil {
+		return events, err
+	}
+	return completeRelaylogEventsChunk(instance, startingCoordinates, events), nil
+}
+
+// completeRelaylogEventsChunk takes up to binlogEventsChunkSize+1 events as read from given coordinates, and returns
+// those of the first binlogEventsChunkSize which the instance has executed.
+// In a relay log End_log_pos refers to the master's binary log, hence NextEventPos is deduced by the position of the
+// following event. When the chunk ends with the last event of a rotated relay log file, that event has NextEventPos 0.
+func completeRelaylogEventsChunk(instance *Instance, startingCoordinates BinlogCoordinates, events []relaylogEvent) []relaylogEvent {
+	for i := 1; i < len(events); i++ {
+		events[i-1].NextEventPos = events[i].Coordinates.LogPos
+	}
+	if len(events) > binlogEventsChunkSize {
+		// The extra event was only read so as to tell the end position of its predecessor
+		events = events[:binlogEventsChunkSize]
+	} else if len(events) > 0 && startingCoordinates.LogFile == instance.RelaylogCoordinates.LogFile {
+		// Last event in the executed relay log. It necessarily ends at the execution position
+		events[len(events)-1].NextEventPos = instance.RelaylogCoordinates.LogPos
+	}
+	// Events not yet executed by the instance are of no interest
+	for i := range events {
+		if !events[i].Coordinates.SmallerThan(&instance.RelaylogCoordinates) {
+			return events[:i]
+		}
+	}
+	return events
+}
+
+// getNextRelaylogEventsChunk is the relay log counterpart of getNextBinlogEventsChunk: it returns the next chunk of
+// relay log events, skipping to next relay log file if need be, and an empty result upon reaching the relay log
+// execution coordinates of the instance.
+func getNextRelaylogEventsChunk(instance *Instance, startingCoordinates BinlogCoordinates) ([]BinlogEvent, error) {
+	events := []BinlogEvent{}
+	if !startingCoordinates.SmallerThan(&instance.RelaylogCoordinates) {
+		return events, nil
+	}
+	relayEvents, err := readRelaylogEventsChunk(instance, startingCoordinates)
+	if err != nil {
+		return events, err
+	}
+	for _, relayEvent := range relayEvents {
+		events = append(events, relayEvent.BinlogEvent)
+	}
+	if len(events) > 0 && events[len(events)-1].NextEventPos != 0 {
+		return events, nil
+	}
+	// Reached end of a rotated relay log file. We make sure not to return its last event as the last of the chunk,
+	// since the position following it can only be found in the next relay log file.
+	relaylogs, err := readRelaylogIndex(instance)
+	if err != nil {
+		// Relay logs are then deduced by name
+		relaylogs = []string{}
+	}
+	nextRelaylog, found, err := getSiblingRelaylog(relaylogs, startingCoordinates.LogFile, 1)
+	if err != nil {
+		return events, err
+	}
+	if !found {
+		return events, errors.New(fmt.Sprintf("Cannot find relay log following %s on %+v", startingCoordinates.LogFile, instance.Key))
+	}
+	nextEvents, err := getNextRelaylogEventsChunk(instance, BinlogCoordinates{LogFile: nextRelaylog, LogPos: binlogFirstEventPos})
+	if err != nil {
+		return events, err
+	}
+	return append(events, nextEvents...), nil
+}
+
+// searchLastPseudoGTIDEntryInRelaylog scans a single relay log file for the last executed pseudo-GTID entry.
+// It returns the relay log coordinates of the entry, as well as its coordinates in the master's binary log,
+// which are deduced from the master's rotate events and the End_log_pos of the entry.
+// An error is returned when the relay log cannot be read (e.g. it has been purged).
+// readEventsChunk is expected to behave like readRelaylogEventsChunk
+func searchLastPseudoGTIDEntryInRelaylog(instance *Instance, relaylog string, pseudoGTIDRegexp *regexp.Regexp, readEventsChunk func(BinlogCoordinates) ([]relaylogEvent, error)) (*relaylogEvent, BinlogCoordinates, error) {
+	var entry *relaylogEvent
+	masterCoordinates := BinlogCoordinates{}
+	masterLogFile := ""
+	coordinates := BinlogCoordinates{LogFile: relaylog, LogPos: binlogFirstEventPos}
+	for coordinates.SmallerThan(&instance.RelaylogCoordinates) {
+		events, err := readEventsChunk(coordinates)
+		if err != nil {
+			return nil, masterCoordinates, err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for i := range events {
+			event := events[i]
+			if event.EventType == "Rotate" && event.ServerID != instance.ServerID {
+				// Master's rotate event, e.g. "mysql-bin.000012;pos=4"
+				masterLogFile = strings.Split(event.Info, ";")[0]
+			}
+			if pseudoGTIDRegexp.MatchString(event.Info) {
+				entry = &event
+				masterCoordinates = BinlogCoordinates{}
+				if masterLogFile != "" && event.NextEventPos > event.Coordinates.LogPos {
+					masterCoordinates.LogFile = masterLogFile
+					masterCoordinates.LogPos = event.OriginalEndPos - (event.NextEventPos - event.Coordinates.LogPos)
+				}
+			}
+			coordinates = event.NextBinlogCoordinates()
+		}
+		if coordinates.LogPos == 0 {
+			// End of rotated relay log file
+			break
+		}
+	}
+	return entry, masterCoordinates, nil
+}
+
+// GetLastPseudoGTIDEntryInRelaylogs finds the last pseudo-GTID entry executed by an instance, by reading its relay logs.
+// This serves instances which do not log replicated events into their own binary logs.
+// Along with the relay log coordinates and the text of the entry, it returns the coordinates of the same entry
+// in the master's binary logs, or empty coordinates if these could not be deduced.
+func GetLastPseudoGTIDEntryInRelaylogs(instance *Instance) (*BinlogCoordinates, BinlogCoordinates, string, error) {
+	pseudoGTIDRegexp, err := regexp.Compile(config.Config.PseudoGTIDPattern)
+	if err != nil {
+		return nil, BinlogCoordinates{}, "", err
+	}
+	relaylogs, err := readRelaylogIndex(instance)
+	if err != nil {
+		log.Debugf("Cannot read relay log index of %+v; relay logs are deduced by name. Error: %+v", instance.Key, err)
+		relaylogs = []string{}
+	}
+	readEventsChunk := func(coordinates BinlogCoordinates) ([]relaylogEvent, error) {
+		return readRelaylogEventsChunk(instance, coordinates)
+	}
+	relaylog := instance.RelaylogCoordinates.LogFile
+	for relaylog != "" {
+		log.Debugf("Searching for latest pseudo gtid entry in relay log %+v of %+v", relaylog, instance.Key)
+		entry, masterCoordinates, err := searchLastPseudoGTIDEntryInRelaylog(instance, relaylog, pseudoGTIDRegexp, readEventsChunk)
+		if err != nil {
+			if len(relaylogs) == 0 && relaylog != instance.RelaylogCoordinates.LogFile && isLogNotFoundError(err) {
+				// Relay logs are purged once executed. Deducing relay logs by name, this is where they end.
+				break
+			}
+			return nil, BinlogCoordinates{}, "", log.Errore(err)
+		}
+		if entry != nil {
+			log.Debugf("Found pseudo gtid entry in %+v: %+v, master coordinates: %+v", instance.Key, entry.Coordinates, masterCoordinates)
+			return &entry.Coordinates, masterCoordinates, entry.Info, nil
+		}
+		previousRelaylog, found, err := getSiblingRelaylog(relaylogs, relaylog, -1)
+		if err != nil {
+			return nil, BinlogCoordinates{}, "", log.Errore(err)
+		}
+		if !found {
+			break
+		}
+		relaylog = previousRelaylog
+	}
+	return nil, BinlogCoordinates{}, "", log.Errorf("Cannot find pseudo GTID entry in relay logs of %+v", instance.Key)
+}
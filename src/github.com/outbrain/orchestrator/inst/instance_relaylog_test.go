@@ -0,0 +1,170 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"errors"
+	. "gopkg.in/check.v1"
+	"regexp"
+)
+
+type RelaylogTestSuite struct{}
+
+var _ = Suite(&RelaylogTestSuite{})
+
+var relaylogTestPseudoGTIDRegexp = regexp.MustCompile(`^drop view if exists .*?`)
+
+// newTestRelaylogEvents returns the events of a relay log as read by an instance with server_id 2, replicating
+// from a master with server_id 1.
+func newTestRelaylogEvents(relaylog string) []relaylogEvent {
+	event := func(pos int64, eventType string, serverID uint, originalEndPos int64, info string) relaylogEvent {
+		return relaylogEvent{
+			BinlogEvent:    BinlogEvent{Coordinates: BinlogCoordinates{LogFile: relaylog, LogPos: pos}, EventType: eventType, Info: info},
+			ServerID:       serverID,
+			OriginalEndPos: originalEndPos,
+		}
+	}
+	return []relaylogEvent{
+		event(4, "Format_desc", 2, 120, "Server ver: 5.6.22-log, Binlog ver: 4"),
+		event(120, "Rotate", 1, 0, "mysql-bin.000012;pos=4"),
+		event(167, "Format_desc", 1, 0, "Server ver: 5.6.22-log, Binlog ver: 4"),
+		event(280, "Query", 1, 1260, "BEGIN"),
+		event(400, "Query", 1, 1500, "drop view if exists `meta`.`_pseudo_gtid_hint__1`"),
+		event(520, "Query", 1, 1680, "insert into test.t values (1)"),
+	}
+}
+
+// readTestRelaylogEventsChunk behaves like readRelaylogEventsChunk, over given events of a single relay log
+func readTestRelaylogEventsChunk(instance *Instance, events []relaylogEvent) func(BinlogCoordinates) ([]relaylogEvent, error) {
+	return func(coordinates BinlogCoordinates) ([]relaylogEvent, error) {
+		if len(events) == 0 || coordinates.LogFile != events[0].Coordinates.LogFile {
+			return nil, errors.New("Error when executing command SHOW BINLOG EVENTS: Could not find target log")
+		}
+		chunk := []relaylogEvent{}
+		for _, event := range events {
+			if event.Coordinates.LogPos >= coordinates.LogPos {
+				chunk = append(chunk, event)
+			}
+		}
+		return completeRelaylogEventsChunk(instance, coordinates, chunk), nil
+	}
+}
+
+func (s *RelaylogTestSuite) TestParseRelaylogIndex(c *C) {
+	c.Assert(parseRelaylogIndex("./relay-bin.000011\n./relay-bin.000012\n"), DeepEquals, []string{"relay-bin.000011", "relay-bin.000012"})
+	c.Assert(parseRelaylogIndex("/var/lib/mysql/relay-bin.000012\n\n"), DeepEquals, []string{"relay-bin.000012"})
+	c.Assert(parseRelaylogIndex(""), DeepEquals, []string{})
+}
+
+func (s *RelaylogTestSuite) TestGetSiblingRelaylog(c *C) {
+	relaylogs := []string{"relay-bin.999999", "relay-bin.1000000"}
+
+	relaylog, found, err := getSiblingRelaylog(relaylogs, "relay-bin.1000000", -1)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(relaylog, Equals, "relay-bin.999999")
+
+	_, found, err = getSiblingRelaylog(relaylogs, "relay-bin.999999", -1)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+
+	_, found, err = getSiblingRelaylog(relaylogs, "relay-bin.1000000", 1)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+
+	_, _, err = getSiblingRelaylog(relaylogs, "relay-bin.000003", -1)
+	c.Assert(err, NotNil)
+
+	relaylog, found, err = getSiblingRelaylog([]string{}, "relay-bin.000012", -1)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, true)
+	c.Assert(relaylog, Equals, "relay-bin.000011")
+
+	_, found, err = getSiblingRelaylog([]string{}, "relay-bin.000001", -1)
+	c.Assert(err, IsNil)
+	c.Assert(found, Equals, false)
+
+	_, _, err = getSiblingRelaylog([]string{}, "relay-bin", -1)
+	c.Assert(err, NotNil)
+}
+
+func (s *RelaylogTestSuite) TestIsLogNotFoundError(c *C) {
+	c.Assert(isLogNotFoundError(errors.New("Error 1220: Error when executing command SHOW BINLOG EVENTS: Could not find target log")), Equals, true)
+	c.Assert(isLogNotFoundError(errors.New("invalid connection")), Equals, false)
+	c.Assert(isLogNotFoundError(nil), Equals, false)
+}
+
+func (s *RelaylogTestSuite) TestCompleteRelaylogEventsChunk(c *C) {
+	instance := NewInstance()
+	instance.RelaylogCoordinates = BinlogCoordinates{LogFile: "relay-bin.000003", LogPos: 700}
+
+	events := completeRelaylogEventsChunk(instance, BinlogCoordinates{LogFile: "relay-bin.000003", LogPos: 4}, newTestRelaylogEvents("relay-bin.000003"))
+	c.Assert(len(events), Equals, 6)
+	c.Assert(events[0].NextEventPos, Equals, int64(120))
+	c.Assert(events[4].NextEventPos, Equals, int64(520))
+	c.Assert(events[5].NextEventPos, Equals, int64(700))
+
+	// Rotated relay log: the last event's end is unknown
+	events = completeRelaylogEventsChunk(instance, BinlogCoordinates{LogFile: "relay-bin.000002", LogPos: 4}, newTestRelaylogEvents("relay-bin.000002"))
+	c.Assert(len(events), Equals, 6)
+	c.Assert(events[5].NextEventPos, Equals, int64(0))
+
+	// Events not yet executed are left out
+	instance.RelaylogCoordinates.LogPos = 400
+	events = completeRelaylogEventsChunk(instance, BinlogCoordinates{LogFile: "relay-bin.000003", LogPos: 4}, newTestRelaylogEvents("relay-bin.000003"))
+	c.Assert(len(events), Equals, 4)
+}
+
+func (s *RelaylogTestSuite) TestSearchLastPseudoGTIDEntryInRelaylog(c *C) {
+	instance := NewInstance()
+	instance.ServerID = 2
+	instance.RelaylogCoordinates = BinlogCoordinates{LogFile: "relay-bin.000003", LogPos: 700}
+	readEventsChunk := readTestRelaylogEventsChunk(instance, newTestRelaylogEvents("relay-bin.000003"))
+
+	entry, masterCoordinates, err := searchLastPseudoGTIDEntryInRelaylog(instance, "relay-bin.000003", relaylogTestPseudoGTIDRegexp, readEventsChunk)
+	c.Assert(err, IsNil)
+	c.Assert(entry, NotNil)
+	c.Assert(entry.Coordinates, Equals, BinlogCoordinates{LogFile: "relay-bin.000003", LogPos: 400})
+	// The entry ends at 1500 in the master's binary log, and is 120 bytes long
+	c.Assert(masterCoordinates, Equals, BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 1380})
+
+	_, _, err = searchLastPseudoGTIDEntryInRelaylog(instance, "relay-bin.000002", relaylogTestPseudoGTIDRegexp, readEventsChunk)
+	c.Assert(isLogNotFoundError(err), Equals, true)
+}
+
+func (s *RelaylogTestSuite) TestSearchLastPseudoGTIDEntryInRelaylogNoMasterRotate(c *C) {
+	instance := NewInstance()
+	instance.ServerID = 2
+	instance.RelaylogCoordinates = BinlogCoordinates{LogFile: "relay-bin.000003", LogPos: 700}
+	events := newTestRelaylogEvents("relay-bin.000003")
+	events = append(events[:1], events[3:]...)
+
+	entry, masterCoordinates, err := searchLastPseudoGTIDEntryInRelaylog(instance, "relay-bin.000003", relaylogTestPseudoGTIDRegexp, readTestRelaylogEventsChunk(instance, events))
+	c.Assert(err, IsNil)
+	c.Assert(entry, NotNil)
+	c.Assert(masterCoordinates, Equals, BinlogCoordinates{})
+}
+
+func (s *RelaylogTestSuite) TestSearchLastPseudoGTIDEntryInRelaylogNotExecuted(c *C) {
+	instance := NewInstance()
+	instance.ServerID = 2
+	instance.RelaylogCoordinates = BinlogCoordinates{LogFile: "relay-bin.000003", LogPos: 400}
+
+	entry, _, err := searchLastPseudoGTIDEntryInRelaylog(instance, "relay-bin.000003", relaylogTestPseudoGTIDRegexp, readTestRelaylogEventsChunk(instance, newTestRelaylogEvents("relay-bin.000003")))
+	c.Assert(err, IsNil)
+	c.Assert(entry, IsNil)
+}
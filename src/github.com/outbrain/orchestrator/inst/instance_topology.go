@@ -20,6 +20,8 @@ import (
 	"errors"
 	"fmt"
 	"github.com/outbrain/golib/log"
+	"github.com/outbrain/orchestrator/config"
+	"regexp"
 	"strings"
 )
 
@@ -110,31 +112,44 @@ func InstanceIsMasterOf(instance0, instance1 *Instance) bool {
 	return instance0.Key.Equals(&instance1.MasterKey)
 }
 
-// MoveUp will attempt moving instance indicated by instanceKey up the topology hierarchy.
-// It will perform all safety and sanity checks and will tamper with this instance's replication
-// as well as its master.
-func MoveUp(instanceKey *InstanceKey) (*Instance, error) {
-	instance, err := ReadTopologyInstance(instanceKey)
+// instanceReader reads an instance for validation of a refactoring operation. Operations read fresh from the
+// topology (ReadTopologyInstance); dry runs read from the backend (readPlannedInstance).
+type instanceReader func(instanceKey *InstanceKey) (*Instance, error)
+
+// validateMoveUp runs all checks for moving given instance up the topology. It returns the instance and its master.
+func validateMoveUp(instanceKey *InstanceKey, readInstance instanceReader) (*Instance, *Instance, error) {
+	instance, err := readInstance(instanceKey)
 	if err != nil {
-		return instance, err
+		return instance, nil, err
 	}
 	if !instance.IsSlave() {
-		return instance, errors.New(fmt.Sprintf("instance is not a slave: %+v", instanceKey))
+		return instance, nil, errors.New(fmt.Sprintf("instance is not a slave: %+v", instanceKey))
 	}
 	rinstance, _, _ := ReadInstance(&instance.Key)
 	if canMove, merr := rinstance.CanMove(); !canMove {
-		return instance, merr
+		return instance, nil, merr
 	}
-	master, err := GetInstanceMaster(instance)
+	master, err := readInstance(&instance.MasterKey)
 	if err != nil {
-		return instance, log.Errorf("Cannot GetInstanceMaster() for %+v. error=%+v", instance, err)
+		return instance, nil, log.Errorf("Cannot GetInstanceMaster() for %+v. error=%+v", instance, err)
 	}
 
 	if !master.IsSlave() {
-		return instance, errors.New(fmt.Sprintf("master is not a slave itself: %+v", master.Key))
+		return instance, nil, errors.New(fmt.Sprintf("master is not a slave itself: %+v", master.Key))
 	}
 
 	if canReplicate, err := instance.CanReplicateFrom(master); canReplicate == false {
+		return instance, master, err
+	}
+	return instance, master, nil
+}
+
+// MoveUp will attempt moving instance indicated by instanceKey up the topology hierarchy.
+// It will perform all safety and sanity checks and will tamper with this instance's replication
+// as well as its master.
+func MoveUp(instanceKey *InstanceKey) (*Instance, error) {
+	instance, master, err := validateMoveUp(instanceKey, ReadTopologyInstance)
+	if err != nil {
 		return instance, err
 	}
 
@@ -185,32 +200,41 @@ Cleanup:
 	return instance, err
 }
 
-// MoveBelow will attempt moving instance indicated by instanceKey below its supposed sibling indicated by sinblingKey.
-// It will perform all safety and sanity checks and will tamper with this instance's replication
-// as well as its sibling.
-func MoveBelow(instanceKey, siblingKey *InstanceKey) (*Instance, error) {
-	instance, err := ReadTopologyInstance(instanceKey)
+// validateMoveBelow runs all checks for moving given instance below given sibling. It returns both instances.
+func validateMoveBelow(instanceKey, siblingKey *InstanceKey, readInstance instanceReader) (*Instance, *Instance, error) {
+	instance, err := readInstance(instanceKey)
 	if err != nil {
-		return instance, err
+		return instance, nil, err
 	}
-	sibling, err := ReadTopologyInstance(siblingKey)
+	sibling, err := readInstance(siblingKey)
 	if err != nil {
-		return instance, err
+		return instance, nil, err
 	}
 
 	rinstance, _, _ := ReadInstance(&instance.Key)
 	if canMove, merr := rinstance.CanMove(); !canMove {
-		return instance, merr
+		return instance, sibling, merr
 	}
 	rinstance, _, _ = ReadInstance(&sibling.Key)
 	if canMove, merr := rinstance.CanMove(); !canMove {
-		return instance, merr
+		return instance, sibling, merr
 	}
 	if !InstancesAreSiblings(instance, sibling) {
-		return instance, errors.New(fmt.Sprintf("instances are not siblings: %+v, %+v", *instanceKey, *siblingKey))
+		return instance, sibling, errors.New(fmt.Sprintf("instances are not siblings: %+v, %+v", *instanceKey, *siblingKey))
 	}
 
 	if canReplicate, err := instance.CanReplicateFrom(sibling); !canReplicate {
+		return instance, sibling, err
+	}
+	return instance, sibling, nil
+}
+
+// MoveBelow will attempt moving instance indicated by instanceKey below its supposed sibling indicated by sinblingKey.
+// It will perform all safety and sanity checks and will tamper with this instance's replication
+// as well as its sibling.
+func MoveBelow(instanceKey, siblingKey *InstanceKey) (*Instance, error) {
+	instance, sibling, err := validateMoveBelow(instanceKey, siblingKey, ReadTopologyInstance)
+	if err != nil {
 		return instance, err
 	}
 	log.Infof("Will move %+v below its sibling %+v", instanceKey, siblingKey)
@@ -268,34 +292,43 @@ Cleanup:
 	return instance, err
 }
 
-// MakeCoMaster will attempt to make an instance co-master with its master, by making its master a slave of its own.
-// This only works out if the master is not replicating; the master does not have a known master (it may have an unknown master).
-func MakeCoMaster(instanceKey *InstanceKey) (*Instance, error) {
-	instance, err := ReadTopologyInstance(instanceKey)
+// validateMakeCoMaster runs all checks for making given instance co-master with its master. It returns the instance and its master.
+func validateMakeCoMaster(instanceKey *InstanceKey, readInstance instanceReader) (*Instance, *Instance, error) {
+	instance, err := readInstance(instanceKey)
 	if err != nil {
-		return instance, err
+		return instance, nil, err
 	}
-	master, err := GetInstanceMaster(instance)
+	master, err := readInstance(&instance.MasterKey)
 	if err != nil {
-		return instance, err
+		return instance, nil, err
 	}
 
 	rinstance, _, _ := ReadInstance(&master.Key)
 	if canMove, merr := rinstance.CanMoveAsCoMaster(); !canMove {
-		return instance, merr
+		return instance, master, merr
 	}
 	rinstance, _, _ = ReadInstance(instanceKey)
 	if canMove, merr := rinstance.CanMove(); !canMove {
-		return instance, merr
+		return instance, master, merr
 	}
 
 	if instanceKey.Equals(&master.MasterKey) {
-		return instance, errors.New(fmt.Sprintf("instance  %+v is already co master of %+v", instanceKey, master.Key))
+		return instance, master, errors.New(fmt.Sprintf("instance  %+v is already co master of %+v", instanceKey, master.Key))
 	}
 	if _, found, _ := ReadInstance(&master.MasterKey); found {
-		return instance, errors.New(fmt.Sprintf("master %+v already has known master: %+v", master.Key, master.MasterKey))
+		return instance, master, errors.New(fmt.Sprintf("master %+v already has known master: %+v", master.Key, master.MasterKey))
 	}
 	if canReplicate, err := master.CanReplicateFrom(instance); !canReplicate {
+		return instance, master, err
+	}
+	return instance, master, nil
+}
+
+// MakeCoMaster will attempt to make an instance co-master with its master, by making its master a slave of its own.
+// This only works out if the master is not replicating; the master does not have a known master (it may have an unknown master).
+func MakeCoMaster(instanceKey *InstanceKey) (*Instance, error) {
+	instance, master, err := validateMakeCoMaster(instanceKey, ReadTopologyInstance)
+	if err != nil {
 		return instance, err
 	}
 	log.Infof("Will make %+v co-master of %+v", instanceKey, master.Key)
@@ -372,37 +405,137 @@ Cleanup:
 	return instance, err
 }
 
-// MatchBelow will attempt moving instance indicated by instanceKey below its the one indicated by otherKey.
-// The refactoring is based on matching binlog entries, not on "classic" positions comparisons.
-// The "other instance" could be the sibling of the moving instance any of its ancestors. It may actuall be
-// a cousing of some sort (though unlikely). The only important thing is that the "other instance" is more
-// advanced in replication than given instance.
-func MatchBelow(instanceKey, otherKey *InstanceKey, requireInstanceMaintenance bool, requireOtherMaintenance bool) (*Instance, error) {
-	instance, err := ReadTopologyInstance(instanceKey)
+// verifyNoErrantTransactions refuses to match below an instance (as known to the backend) which has errant
+// transactions, unless forced
+func verifyNoErrantTransactions(instance *Instance, force bool) error {
+	if instance.HasErrantTransactions && !force {
+		return errors.New(fmt.Sprintf("MatchBelow: %+v has errant transactions at %+v; use force to match it anyhow", instance.Key, instance.ErrantBinlogCoordinates))
+	}
+	return nil
+}
+
+// validateMatchBelow runs all checks for matching given instance below the other given instance. It returns both instances.
+func validateMatchBelow(instanceKey, otherKey *InstanceKey, readInstance instanceReader) (*Instance, *Instance, error) {
+	instance, err := readInstance(instanceKey)
 	if err != nil {
-		return instance, err
+		return instance, nil, err
 	}
 	if instanceKey.Equals(otherKey) {
-		return instance, errors.New(fmt.Sprintf("MatchBelow: attempt to match an instance below itself %+v", *instanceKey))
+		return instance, nil, errors.New(fmt.Sprintf("MatchBelow: attempt to match an instance below itself %+v", *instanceKey))
 	}
-	otherInstance, err := ReadTopologyInstance(otherKey)
+	otherInstance, err := readInstance(otherKey)
 	if err != nil {
-		return instance, err
+		return instance, nil, err
 	}
 
 	rinstance, _, _ := ReadInstance(&instance.Key)
 	if canMove, merr := rinstance.CanMoveViaMatch(); !canMove {
-		return instance, merr
+		return instance, otherInstance, merr
 	}
 
 	if canReplicate, err := instance.CanReplicateFrom(otherInstance); !canReplicate {
+		return instance, otherInstance, err
+	}
+	return instance, otherInstance, nil
+}
+
+// getMatchBelowCoordinates finds the coordinates within otherInstance at which instance is to continue
+// replicating, by matching the latest pseudo-GTID entry of instance in otherInstance.
+// When both instances have GTID enabled, no matching is required: replication is set up via GTID auto positioning,
+// and the returned coordinates are merely informational.
+func getMatchBelowCoordinates(instance *Instance, otherInstance *Instance) (*BinlogCoordinates, error) {
+	if instance.IsGTIDEnabled() && otherInstance.IsGTIDEnabled() {
+		log.Debugf("Both %+v and %+v have GTID enabled; skipping pseudo-GTID matching", instance.Key, otherInstance.Key)
+		return &otherInstance.SelfBinlogCoordinates, nil
+	}
+	if !instance.HasReplicatedEventsInBinlogs() {
+		return getMatchBelowCoordinatesViaRelaylogs(instance, otherInstance)
+	}
+	return matchBinlogEventsSources(&instanceBinlogEvents{instance: instance}, &instanceBinlogEvents{instance: otherInstance})
+}
+
+// matchBinlogEventsSources finds the coordinates in otherEvents at which the instance whose binary logs are
+// instanceEvents would continue replicating
+func matchBinlogEventsSources(instanceEvents binlogEventsSource, otherEvents binlogEventsSource) (*BinlogCoordinates, error) {
+	instancePseudoGtidCoordinates, instancePseudoGtidText, err := instanceEvents.GetLastPseudoGTIDEntry()
+	if err != nil {
+		return nil, err
+	}
+	otherInstancePseudoGtidCoordinates, err := otherEvents.SearchPseudoGTIDEntry(instancePseudoGtidText)
+	if err != nil {
+		return nil, err
+	}
+
+	// We've found a match: the latest Pseudo GTID position within instance and its identical twin in otherInstance
+	// We now iterate the events in both, up to the completion of events in instance (recall that we looked for
+	// the last entry in instance, hence, assuming pseudo GTID entries are frequent, the amount of entries to read
+	// from instance is not long)
+	// The result of the iteration will be either:
+	// - bad conclusion that instance is actually more advanced than otherInstance (we find more entries in instance
+	//   following the pseudo gtid than we can match in otherInstance), hence we cannot ask instance to replicate
+	//   from otherInstance
+	// - good result: both instances are exactly in same shape (have replicated the exact same number of events since
+	//   the last pseudo gtid). Since they are identical, it is easy to point instance into otherInstance.
+	// - good result: the first position within otherInstance where instance has not replicated yet. It is easy to point
+	//   instance into otherInstance.
+	return getNextBinlogCoordinatesToMatch(instanceEvents, *instancePseudoGtidCoordinates,
+		otherEvents, *otherInstancePseudoGtidCoordinates)
+}
+
+// getMatchBelowCoordinatesViaRelaylogs is the counterpart of getMatchBelowCoordinates for an instance which does not
+// log replicated events into its own binary logs (no log_bin or no log_slave_updates). The instance's latest pseudo-GTID
+// entry is read from its relay logs. When otherInstance is the instance's own master, the entry's position in the
+// master's binary logs is known from the relay log, and is merely verified rather than searched for.
+func getMatchBelowCoordinatesViaRelaylogs(instance *Instance, otherInstance *Instance) (*BinlogCoordinates, error) {
+	instancePseudoGtidCoordinates, masterPseudoGtidCoordinates, instancePseudoGtidText, err := GetLastPseudoGTIDEntryInRelaylogs(instance)
+	if err != nil {
+		return nil, err
+	}
+	var otherInstancePseudoGtidCoordinates *BinlogCoordinates
+	if otherInstance.Key.Equals(&instance.MasterKey) && masterPseudoGtidCoordinates.LogFile != "" {
+		events, err := readBinlogEventsFrom(&otherInstance.Key, masterPseudoGtidCoordinates, 1)
+		if err == nil && len(events) > 0 && events[0].Info == instancePseudoGtidText {
+			otherInstancePseudoGtidCoordinates = &masterPseudoGtidCoordinates
+		}
+	}
+	if otherInstancePseudoGtidCoordinates == nil {
+		otherInstancePseudoGtidCoordinates, err = SearchPseudoGTIDEntryInInstance(otherInstance, instancePseudoGtidText)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return GetNextBinlogCoordinatesToMatch(instance, *instancePseudoGtidCoordinates,
+		otherInstance, *otherInstancePseudoGtidCoordinates)
+}
+
+// MatchBelow will attempt moving instance indicated by instanceKey below its the one indicated by otherKey.
+// The refactoring is based on matching binlog entries, not on "classic" positions comparisons.
+// The "other instance" could be the sibling of the moving instance any of its ancestors. It may actuall be
+// a cousing of some sort (though unlikely). The only important thing is that the "other instance" is more
+// advanced in replication than given instance.
+// An instance known to have errant transactions is not moved; see ForceMatchBelow.
+func MatchBelow(instanceKey, otherKey *InstanceKey, requireInstanceMaintenance bool, requireOtherMaintenance bool) (*Instance, error) {
+	return matchBelow(instanceKey, otherKey, requireInstanceMaintenance, requireOtherMaintenance, false)
+}
+
+// ForceMatchBelow is the same as MatchBelow, but also moves an instance known to have errant transactions.
+// Such transactions are then retained on the instance, without being applied on its new master.
+func ForceMatchBelow(instanceKey, otherKey *InstanceKey, requireInstanceMaintenance bool, requireOtherMaintenance bool) (*Instance, error) {
+	return matchBelow(instanceKey, otherKey, requireInstanceMaintenance, requireOtherMaintenance, true)
+}
+
+func matchBelow(instanceKey, otherKey *InstanceKey, requireInstanceMaintenance bool, requireOtherMaintenance bool, force bool) (*Instance, error) {
+	instance, otherInstance, err := validateMatchBelow(instanceKey, otherKey, ReadTopologyInstance)
+	if err != nil {
 		return instance, err
 	}
+	if rinstance, _, _ := ReadInstance(&instance.Key); rinstance != nil {
+		if err := verifyNoErrantTransactions(rinstance, force); err != nil {
+			return instance, err
+		}
+	}
 	log.Infof("Will match %+v below %+v", *instanceKey, *otherKey)
 
-	var instancePseudoGtidText string
-	var instancePseudoGtidCoordinates *BinlogCoordinates
-	var otherInstancePseudoGtidCoordinates *BinlogCoordinates
 	var nextBinlogCoordinatesToMatch *BinlogCoordinates
 
 	if requireInstanceMaintenance {
@@ -428,29 +561,7 @@ func MatchBelow(instanceKey, otherKey *InstanceKey, requireInstanceMaintenance b
 		goto Cleanup
 	}
 
-	instancePseudoGtidCoordinates, instancePseudoGtidText, err = GetLastPseudoGTIDEntryInInstance(instance)
-	if err != nil {
-		goto Cleanup
-	}
-	otherInstancePseudoGtidCoordinates, err = SearchPseudoGTIDEntryInInstance(otherInstance, instancePseudoGtidText)
-	if err != nil {
-		goto Cleanup
-	}
-
-	// We've found a match: the latest Pseudo GTID position within instance and its identical twin in otherInstance
-	// We now iterate the events in both, up to the completion of events in instance (recall that we looked for
-	// the last entry in instance, hence, assuming pseudo GTID entries are frequent, the amount of entries to read
-	// from instance is not long)
-	// The result of the iteration will be either:
-	// - bad conclusion that instance is actually more advanced than otherInstance (we find more entries in instance
-	//   following the pseudo gtid than we can match in otherInstance), hence we cannot ask instance to replicate
-	//   from otherInstance
-	// - good result: both instances are exactly in same shape (have replicated the exact same number of events since
-	//   the last pseudo gtid). Since they are identical, it is easy to point instance into otherInstance.
-	// - good result: the first position within otherInstance where instance has not replicated yet. It is easy to point
-	//   instance into otherInstance.
-	nextBinlogCoordinatesToMatch, err = GetNextBinlogCoordinatesToMatch(instance, *instancePseudoGtidCoordinates,
-		otherInstance, *otherInstancePseudoGtidCoordinates)
+	nextBinlogCoordinatesToMatch, err = getMatchBelowCoordinates(instance, otherInstance)
 	if err != nil {
 		goto Cleanup
 	}
@@ -499,34 +610,295 @@ func enslaveSiblings(instanceKey *InstanceKey, siblings [](*Instance)) error {
 	return nil
 }
 
-// MakeMaster will take an instance, make all its siblings its slaves (via pseudo-GTID) and make it master
-// (stop its replicaiton, make writeable).
-func MakeMaster(instanceKey *InstanceKey) (*Instance, error) {
-	instance, err := ReadTopologyInstance(instanceKey)
+// SlaveRelocationResult reports the outcome of relocating a single slave via RelocateSlaves
+type SlaveRelocationResult struct {
+	Key     InstanceKey
+	Method  string
+	Success bool
+	Error   string
+}
+
+// RelocateSlaves will move all slaves of given instance below given target instance, optionally filtering
+// slaves by given regexp pattern on their host:port. Each slave is moved by classic binlog coordinates
+// where possible: via MoveBelow when target is a sibling of the slaves, or MoveUp when target is the slaves'
+// grandparent. Otherwise the slave is relocated by pseudo-GTID via MatchBelow; such slaves are moved in parallel.
+// A result is returned for each slave; the returned error indicates that at least one slave failed to relocate.
+func RelocateSlaves(instanceKey, targetKey *InstanceKey, pattern string) ([]SlaveRelocationResult, error) {
+	results := []SlaveRelocationResult{}
+
+	instance, found, err := ReadInstance(instanceKey)
+	if err != nil || !found {
+		return results, errors.New(fmt.Sprintf("RelocateSlaves: cannot read instance %+v: %+v", *instanceKey, err))
+	}
+	target, found, err := ReadInstance(targetKey)
+	if err != nil || !found {
+		return results, errors.New(fmt.Sprintf("RelocateSlaves: cannot read target %+v: %+v", *targetKey, err))
+	}
+	slaves, err := ReadSlaveInstances(instanceKey)
 	if err != nil {
-		return instance, err
+		return results, err
+	}
+	if pattern != "" {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return results, err
+		}
 	}
-	masterInstance, err := ReadTopologyInstance(&instance.MasterKey)
+
+	pseudoGTIDSlaves := [](*Instance){}
+	for _, slave := range slaves {
+		if slave.Key.Equals(targetKey) {
+			continue
+		}
+		if matched, _ := regexp.MatchString(pattern, slave.Key.DisplayString()); !matched {
+			continue
+		}
+		result := SlaveRelocationResult{Key: slave.Key}
+		var merr error
+		switch {
+		case target.MasterKey.Equals(instanceKey):
+			result.Method = "move-below"
+			_, merr = MoveBelow(&slave.Key, targetKey)
+		case instance.MasterKey.Equals(targetKey):
+			result.Method = "move-up"
+			_, merr = MoveUp(&slave.Key)
+		default:
+			pseudoGTIDSlaves = append(pseudoGTIDSlaves, slave)
+			continue
+		}
+		result.Success = (merr == nil)
+		if merr != nil {
+			result.Error = merr.Error()
+		}
+		results = append(results, result)
+	}
+
+	completedOperations := make(chan SlaveRelocationResult)
+	for _, slave := range pseudoGTIDSlaves {
+		slaveKey := slave.Key
+		go func() {
+			result := SlaveRelocationResult{Key: slaveKey, Method: "match-below"}
+			_, merr := MatchBelow(&slaveKey, targetKey, true, false)
+			result.Success = (merr == nil)
+			if merr != nil {
+				result.Error = merr.Error()
+			}
+			completedOperations <- result
+		}()
+	}
+	for i := 0; i < len(pseudoGTIDSlaves); i++ {
+		results = append(results, <-completedOperations)
+	}
+
+	countFailed := 0
+	for _, result := range results {
+		if !result.Success {
+			countFailed++
+		}
+	}
+	AuditOperation("relocate-slaves", instanceKey, fmt.Sprintf("relocated %d slaves of %+v below %+v; %d failed", len(results)-countFailed, *instanceKey, *targetKey, countFailed))
+	if countFailed > 0 {
+		return results, log.Errorf("RelocateSlaves: %d of %d slaves of %+v failed to relocate below %+v", countFailed, len(results), *instanceKey, *targetKey)
+	}
+	return results, nil
+}
+
+// RelocationStep is a single refactoring operation within a relocation plan
+type RelocationStep struct {
+	Operation   string
+	InstanceKey InstanceKey
+	TargetKey   InstanceKey
+}
+
+// RelocationPlan lists the operations by which an instance is to be relocated below a target instance,
+// along with an explanation of the chosen strategy
+type RelocationPlan struct {
+	InstanceKey InstanceKey
+	TargetKey   InstanceKey
+	Steps       []RelocationStep
+	Explanation string
+}
+
+// getInstanceAncestry returns the known masters of given instance, up the topology, nearest first.
+// Co-master loops are broken.
+func getInstanceAncestry(instance *Instance) [](*Instance) {
+	ancestry := [](*Instance){}
+	visited := map[InstanceKey]bool{instance.Key: true}
+	for masterKey := instance.MasterKey; !visited[masterKey]; {
+		ancestor, found, err := ReadInstance(&masterKey)
+		if err != nil || !found {
+			break
+		}
+		visited[masterKey] = true
+		ancestry = append(ancestry, ancestor)
+		masterKey = ancestor.MasterKey
+	}
+	return ancestry
+}
+
+// GetRelocationPlan inspects the relationship between given instance and target, and computes the operations
+// by which the instance is to be moved below the target. Where the two share a common ancestor, the instance is moved
+// via classic binlog coordinates: up the topology (MoveUp) to the common ancestor, then down (MoveBelow) the target's
+// ancestry till below the target. Otherwise, or if any instance along the way cannot serve as master, relocation is
+// planned via pseudo-GTID (MatchBelow).
+// No change is made to the topology.
+func GetRelocationPlan(instanceKey, targetKey *InstanceKey) (*RelocationPlan, error) {
+	plan := &RelocationPlan{InstanceKey: *instanceKey, TargetKey: *targetKey, Steps: []RelocationStep{}}
+	if instanceKey.Equals(targetKey) {
+		return plan, errors.New(fmt.Sprintf("Relocate: attempt to relocate an instance below itself %+v", *instanceKey))
+	}
+	instance, found, err := ReadInstance(instanceKey)
+	if err != nil || !found {
+		return plan, errors.New(fmt.Sprintf("Relocate: cannot read instance %+v: %+v", *instanceKey, err))
+	}
+	target, found, err := ReadInstance(targetKey)
+	if err != nil || !found {
+		return plan, errors.New(fmt.Sprintf("Relocate: cannot read target %+v: %+v", *targetKey, err))
+	}
+	if instance.MasterKey.Equals(targetKey) {
+		return plan, errors.New(fmt.Sprintf("Relocate: %+v already replicates from %+v", *instanceKey, *targetKey))
+	}
+	targetAncestry := getInstanceAncestry(target)
+	for _, targetAncestor := range targetAncestry {
+		if targetAncestor.Key.Equals(instanceKey) {
+			return plan, errors.New(fmt.Sprintf("Relocate: %+v is itself below %+v", *targetKey, *instanceKey))
+		}
+	}
+	instanceAncestry := getInstanceAncestry(instance)
+
+	// Find the nearest common ancestor. The path down from the common ancestor to the target
+	// is listed top-down, ending with the target itself.
+	var commonAncestor *Instance
+	var countMoveUp int
+	var pathDown [](*Instance)
+	for i, ancestor := range instanceAncestry {
+		if ancestor.Key.Equals(targetKey) {
+			commonAncestor, countMoveUp = ancestor, i
+			break
+		}
+		for j, targetAncestor := range targetAncestry {
+			if ancestor.Key.Equals(&targetAncestor.Key) {
+				commonAncestor, countMoveUp = ancestor, i
+				for k := j - 1; k >= 0; k-- {
+					pathDown = append(pathDown, targetAncestry[k])
+				}
+				pathDown = append(pathDown, target)
+				break
+			}
+		}
+		if commonAncestor != nil {
+			break
+		}
+	}
+
+	classicPathError := errors.New(fmt.Sprintf("%+v and %+v have no common ancestor", *instanceKey, *targetKey))
+	if commonAncestor != nil {
+		classicPathError = nil
+		for i := 1; i <= countMoveUp && classicPathError == nil; i++ {
+			if canReplicate, err := instance.CanReplicateFrom(instanceAncestry[i]); !canReplicate {
+				classicPathError = err
+			}
+			plan.Steps = append(plan.Steps, RelocationStep{Operation: "move-up", InstanceKey: *instanceKey, TargetKey: instanceAncestry[i].Key})
+		}
+		for _, node := range pathDown {
+			if classicPathError != nil {
+				break
+			}
+			if canReplicate, err := instance.CanReplicateFrom(node); !canReplicate {
+				classicPathError = err
+			}
+			plan.Steps = append(plan.Steps, RelocationStep{Operation: "move-below", InstanceKey: *instanceKey, TargetKey: node.Key})
+		}
+	}
+	if classicPathError == nil {
+		switch {
+		case countMoveUp == 0 && len(pathDown) == 1:
+			plan.Explanation = fmt.Sprintf("%+v is a sibling of %+v; will move below it via binlog coordinates", *targetKey, *instanceKey)
+		case countMoveUp == 1 && len(pathDown) == 0:
+			plan.Explanation = fmt.Sprintf("%+v is the grandparent of %+v; will move up via binlog coordinates", *targetKey, *instanceKey)
+		default:
+			plan.Explanation = fmt.Sprintf("%+v and %+v share common ancestor %+v; will move up %d level(s) and down %d level(s) via binlog coordinates", *instanceKey, *targetKey, commonAncestor.Key, countMoveUp, len(pathDown))
+		}
+		return plan, nil
+	}
+
+	plan.Steps = []RelocationStep{}
+	if config.Config.PseudoGTIDPattern == "" && !(instance.IsGTIDEnabled() && target.IsGTIDEnabled()) {
+		return plan, errors.New(fmt.Sprintf("Relocate: cannot relocate %+v below %+v via binlog coordinates (%+v), and neither pseudo-GTID is configured nor GTID enabled", *instanceKey, *targetKey, classicPathError))
+	}
+	if canReplicate, err := instance.CanReplicateFrom(target); !canReplicate {
+		return plan, err
+	}
+	plan.Steps = append(plan.Steps, RelocationStep{Operation: "match-below", InstanceKey: *instanceKey, TargetKey: *targetKey})
+	plan.Explanation = fmt.Sprintf("Cannot relocate via binlog coordinates: %+v; will match %+v below %+v via (pseudo) GTID", classicPathError, *instanceKey, *targetKey)
+	return plan, nil
+}
+
+// Relocate will move given instance below given target instance, wherever the two are in the topology.
+// The strategy is chosen by GetRelocationPlan, and the plan's steps are executed in order.
+func Relocate(instanceKey, targetKey *InstanceKey) (*Instance, error) {
+	plan, err := GetRelocationPlan(instanceKey, targetKey)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	log.Infof("Will relocate %+v below %+v: %s", *instanceKey, *targetKey, plan.Explanation)
+
+	var instance *Instance
+	for _, step := range plan.Steps {
+		switch step.Operation {
+		case "move-up":
+			instance, err = MoveUp(&step.InstanceKey)
+		case "move-below":
+			instance, err = MoveBelow(&step.InstanceKey, &step.TargetKey)
+		case "match-below":
+			instance, err = MatchBelow(&step.InstanceKey, &step.TargetKey, true, true)
+		}
+		if err != nil {
+			return instance, log.Errore(err)
+		}
+	}
+	AuditOperation("relocate", instanceKey, fmt.Sprintf("relocated %+v below %+v: %s", *instanceKey, *targetKey, plan.Explanation))
+
+	return instance, err
+}
+
+// validateMakeMaster runs all checks for making given instance the master of its siblings. It returns the
+// instance and its siblings.
+func validateMakeMaster(instanceKey *InstanceKey, readInstance instanceReader) (*Instance, [](*Instance), error) {
+	instance, err := readInstance(instanceKey)
+	if err != nil {
+		return instance, nil, err
+	}
+	masterInstance, err := readInstance(&instance.MasterKey)
 	if err != nil {
 		if masterInstance.IsSlave() {
-			return instance, errors.New(fmt.Sprintf("MakeMaster: instance's master %+v seems to be replicating", masterInstance.Key))
+			return instance, nil, errors.New(fmt.Sprintf("MakeMaster: instance's master %+v seems to be replicating", masterInstance.Key))
 		}
 		if masterInstance.IsLastCheckValid {
-			return instance, errors.New(fmt.Sprintf("MakeMaster: instance's master %+v seems to be accessible", masterInstance.Key))
+			return instance, nil, errors.New(fmt.Sprintf("MakeMaster: instance's master %+v seems to be accessible", masterInstance.Key))
 		}
 	}
 	if !instance.SQLThreadUpToDate() {
-		return instance, errors.New(fmt.Sprintf("MakeMaster: instance's SQL thread must be up-to-date with I/O thread for %+v", *instanceKey))
+		return instance, nil, errors.New(fmt.Sprintf("MakeMaster: instance's SQL thread must be up-to-date with I/O thread for %+v", *instanceKey))
 	}
 	siblings, err := ReadSlaveInstances(&masterInstance.Key)
 	if err != nil {
-		return instance, err
+		return instance, nil, err
 	}
 	for _, sibling := range siblings {
 		if instance.ExecBinlogCoordinates.SmallerThan(&sibling.ExecBinlogCoordinates) {
-			return instance, errors.New(fmt.Sprintf("MakeMaster: instance %+v has more advanced sibling: %+v", *instanceKey, sibling.Key))
+			return instance, siblings, errors.New(fmt.Sprintf("MakeMaster: instance %+v has more advanced sibling: %+v", *instanceKey, sibling.Key))
 		}
 	}
+	return instance, siblings, nil
+}
+
+// MakeMaster will take an instance, make all its siblings its slaves (via pseudo-GTID) and make it master
+// (stop its replicaiton, make writeable).
+func MakeMaster(instanceKey *InstanceKey) (*Instance, error) {
+	instance, siblings, err := validateMakeMaster(instanceKey, ReadTopologyInstance)
+	if err != nil {
+		return instance, err
+	}
 
 	if maintenanceToken, merr := BeginMaintenance(instanceKey, "orchestrator", fmt.Sprintf("siblings match below this", *instanceKey)); merr != nil {
 		err = errors.New(fmt.Sprintf("Cannot begin maintenance on %+v", *instanceKey))
@@ -609,3 +981,172 @@ Cleanup:
 
 	return instance, err
 }
+
+// GracefulMasterTakeover will demote the master of given designated instance and promote the designated instance in its place,
+// in a planned, lossless manner. The master is set read-only, its slaves are let to catch up with it, then the designated
+// instance's siblings are repointed below the designated instance, as is the old master itself. The designated instance
+// is then detached and made writeable.
+// Should any step fail, whatever was changed is rolled back to its original state: the old master is made writeable
+// only if it was writeable to begin with, and the designated instance replicates again only if it was replicating.
+// There is no rolling back once the designated instance may have accepted writes.
+func GracefulMasterTakeover(designatedKey *InstanceKey) (*Instance, error) {
+	designated, err := ReadTopologyInstance(designatedKey)
+	if err != nil {
+		return designated, err
+	}
+	if !designated.IsSlave() {
+		return designated, errors.New(fmt.Sprintf("GracefulMasterTakeover: designated instance is not a slave: %+v", *designatedKey))
+	}
+	master, err := ReadTopologyInstance(&designated.MasterKey)
+	if err != nil {
+		return designated, err
+	}
+	if master.IsSlave() {
+		return designated, errors.New(fmt.Sprintf("GracefulMasterTakeover: master %+v is itself a slave; only a topology's master can be taken over", master.Key))
+	}
+	if canReplicate, err := master.CanReplicateFrom(designated); !canReplicate {
+		return designated, err
+	}
+	slaves, err := ReadSlaveInstances(&master.Key)
+	if err != nil {
+		return designated, err
+	}
+	for _, slave := range slaves {
+		if canMove, merr := slave.CanMove(); !canMove {
+			return designated, merr
+		}
+		if slave.Key.Equals(designatedKey) {
+			continue
+		}
+		if canReplicate, err := slave.CanReplicateFrom(designated); !canReplicate {
+			return designated, err
+		}
+	}
+	log.Infof("Will make %+v master in place of %+v", *designatedKey, master.Key)
+
+	var masterCoordinates BinlogCoordinates
+	var designatedCoordinates BinlogCoordinates
+	// Instances are re-read along the way; a failed read leaves them blank
+	masterKey := master.Key
+	masterWasReadOnly := master.ReadOnly
+	designatedWasReadOnly := designated.ReadOnly
+	designatedWasReplicating := designated.SlaveRunning()
+	repointedSiblings := [](*Instance){}
+	masterMadeReadOnly := false
+	designatedStopped := false
+	masterRepointed := false
+	designatedDetached := false
+	designatedWriteable := false
+
+	if maintenanceToken, merr := BeginMaintenance(designatedKey, "orchestrator", fmt.Sprintf("graceful takeover of %+v", master.Key)); merr != nil {
+		err = errors.New(fmt.Sprintf("Cannot begin maintenance on %+v", *designatedKey))
+		goto Cleanup
+	} else {
+		defer EndMaintenance(maintenanceToken)
+	}
+	if maintenanceToken, merr := BeginMaintenance(&master.Key, "orchestrator", fmt.Sprintf("taken over by %+v", *designatedKey)); merr != nil {
+		err = errors.New(fmt.Sprintf("Cannot begin maintenance on %+v", master.Key))
+		goto Cleanup
+	} else {
+		defer EndMaintenance(maintenanceToken)
+	}
+
+	// Marked ahead, since read_only may be set even if the call fails on re-reading the master
+	masterMadeReadOnly = true
+	master, err = SetReadOnly(&masterKey, true)
+	if err != nil {
+		goto Cleanup
+	}
+	// No more writes on the master. All slaves are now to catch up with its final coordinates
+	masterCoordinates = master.SelfBinlogCoordinates
+	for _, slave := range slaves {
+		caughtUpSlave, werr := MasterPosWaitWithTimeout(&slave.Key, &masterCoordinates, config.Config.MasterPosWaitTimeoutSeconds)
+		if werr != nil {
+			err = werr
+			goto Cleanup
+		}
+		if !caughtUpSlave.ExecBinlogCoordinates.Equals(&masterCoordinates) {
+			err = errors.New(fmt.Sprintf("GracefulMasterTakeover: %+v executed up to %+v; expected %+v", slave.Key, caughtUpSlave.ExecBinlogCoordinates, masterCoordinates))
+			goto Cleanup
+		}
+	}
+	designatedStopped = true
+	designated, err = StopSlave(designatedKey)
+	if err != nil {
+		goto Cleanup
+	}
+	designatedCoordinates = designated.SelfBinlogCoordinates
+
+	for _, sibling := range slaves {
+		if sibling.Key.Equals(designatedKey) {
+			continue
+		}
+		if _, err = StopSlave(&sibling.Key); err != nil {
+			goto Cleanup
+		}
+		repointedSiblings = append(repointedSiblings, sibling)
+		if _, err = ChangeMasterTo(&sibling.Key, designatedKey, &designatedCoordinates); err != nil {
+			goto Cleanup
+		}
+		if _, err = StartSlave(&sibling.Key); err != nil {
+			goto Cleanup
+		}
+	}
+
+	masterRepointed = true
+	if _, err = ChangeMasterTo(&masterKey, designatedKey, &designatedCoordinates); err != nil {
+		goto Cleanup
+	}
+	if _, err = StartSlave(&masterKey); err != nil {
+		goto Cleanup
+	}
+
+	designatedDetached = true
+	if _, err = ResetSlave(designatedKey); err != nil {
+		goto Cleanup
+	}
+	designated, err = SetReadOnly(designatedKey, false)
+	if err != nil {
+		goto Cleanup
+	}
+	designatedWriteable = true
+
+Cleanup:
+	if err != nil && designatedWriteable {
+		// The designated instance may already have taken writes; the old topology cannot be restored without losing them
+		AuditOperation("graceful-master-takeover", designatedKey, fmt.Sprintf("takeover of %+v failed after designated instance was made writeable; not rolling back: %+v", masterKey, err))
+		return designated, log.Errore(err)
+	}
+	if err != nil {
+		log.Errore(err)
+		log.Infof("GracefulMasterTakeover: rolling back takeover of %+v by %+v", masterKey, *designatedKey)
+		if masterRepointed {
+			StopSlave(&masterKey)
+			ResetSlave(&masterKey)
+		}
+		for _, sibling := range repointedSiblings {
+			StopSlave(&sibling.Key)
+			ChangeMasterTo(&sibling.Key, &masterKey, &masterCoordinates)
+			StartSlave(&sibling.Key)
+		}
+		if designatedDetached {
+			if designatedWasReadOnly {
+				SetReadOnly(designatedKey, true)
+			}
+			ChangeMasterTo(designatedKey, &masterKey, &masterCoordinates)
+		}
+		if designatedStopped && designatedWasReplicating {
+			designated, _ = StartSlave(designatedKey)
+		}
+		if masterMadeReadOnly && !masterWasReadOnly {
+			SetReadOnly(&masterKey, false)
+		}
+
+		AuditOperation("graceful-master-takeover", designatedKey, fmt.Sprintf("takeover of %+v failed and was rolled back: %+v", masterKey, err))
+		return designated, err
+	}
+	// and we're done (pending deferred functions)
+	AuditOperation("graceful-master-takeover", designatedKey, fmt.Sprintf("%+v took over %+v", *designatedKey, masterKey))
+
+	return designated, err
+}
@@ -0,0 +1,215 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PlannedStatement is a statement a refactoring operation would execute on a given instance
+type PlannedStatement struct {
+	Key       InstanceKey
+	Statement string
+}
+
+// The Plan* functions below run the same validations as their respective refactoring operations, and
+// list the statements the operations would execute, in order, without executing any of them.
+// Instances are read from orchestrator's backend, hence are as fresh as the latest discovery poll.
+// Binlog coordinates are computed as of planning time; the operations themselves compute coordinates
+// after replication is stopped, hence actual positions may differ on a live topology.
+
+// moveUpStatements lists the statements by which given instance is moved up below its master's master
+func moveUpStatements(instance, master *Instance) []PlannedStatement {
+	return []PlannedStatement{
+		PlannedStatement{Key: master.Key, Statement: "stop slave"},
+		PlannedStatement{Key: instance.Key, Statement: "stop slave"},
+		PlannedStatement{Key: instance.Key, Statement: startSlaveUntilStatement(&master.SelfBinlogCoordinates)},
+		PlannedStatement{Key: instance.Key, Statement: "stop slave"},
+		PlannedStatement{Key: instance.Key, Statement: changeMasterToStatement(instance, &master.MasterKey, &master.ExecBinlogCoordinates, canUseAutoPosition(instance, &master.MasterKey))},
+		PlannedStatement{Key: instance.Key, Statement: "start slave"},
+		PlannedStatement{Key: master.Key, Statement: "start slave"},
+	}
+}
+
+// readPlannedInstance reads an instance as known to orchestrator's backend. Unlike ReadTopologyInstance, it
+// writes nothing, as befits a dry run.
+func readPlannedInstance(instanceKey *InstanceKey) (*Instance, error) {
+	instance, found, err := ReadInstance(instanceKey)
+	if err != nil {
+		return instance, err
+	}
+	if !found {
+		return instance, errors.New(fmt.Sprintf("Unknown instance: %+v", *instanceKey))
+	}
+	return instance, nil
+}
+
+// PlanMoveUp lists the statements MoveUp would execute
+func PlanMoveUp(instanceKey *InstanceKey) ([]PlannedStatement, error) {
+	instance, master, err := validateMoveUp(instanceKey, readPlannedInstance)
+	if err != nil {
+		return []PlannedStatement{}, err
+	}
+	return moveUpStatements(instance, master), nil
+}
+
+// moveBelowStatements lists the statements by which given instance is moved below given sibling
+func moveBelowStatements(instance, sibling *Instance) []PlannedStatement {
+	plan := []PlannedStatement{}
+	plan = append(plan,
+		PlannedStatement{Key: instance.Key, Statement: "stop slave"},
+		PlannedStatement{Key: sibling.Key, Statement: "stop slave"},
+	)
+	if instance.ExecBinlogCoordinates.SmallerThan(&sibling.ExecBinlogCoordinates) {
+		plan = append(plan,
+			PlannedStatement{Key: instance.Key, Statement: startSlaveUntilStatement(&sibling.ExecBinlogCoordinates)},
+			PlannedStatement{Key: instance.Key, Statement: "stop slave"},
+		)
+	} else if sibling.ExecBinlogCoordinates.SmallerThan(&instance.ExecBinlogCoordinates) {
+		plan = append(plan,
+			PlannedStatement{Key: sibling.Key, Statement: startSlaveUntilStatement(&instance.ExecBinlogCoordinates)},
+			PlannedStatement{Key: sibling.Key, Statement: "stop slave"},
+		)
+	}
+	plan = append(plan,
+		PlannedStatement{Key: instance.Key, Statement: changeMasterToStatement(instance, &sibling.Key, &sibling.SelfBinlogCoordinates, canUseAutoPosition(instance, &sibling.Key))},
+		PlannedStatement{Key: instance.Key, Statement: "start slave"},
+		PlannedStatement{Key: sibling.Key, Statement: "start slave"},
+	)
+	return plan
+}
+
+// PlanMoveBelow lists the statements MoveBelow would execute
+func PlanMoveBelow(instanceKey, siblingKey *InstanceKey) ([]PlannedStatement, error) {
+	instance, sibling, err := validateMoveBelow(instanceKey, siblingKey, readPlannedInstance)
+	if err != nil {
+		return []PlannedStatement{}, err
+	}
+	return moveBelowStatements(instance, sibling), nil
+}
+
+// PlanMakeCoMaster lists the statements MakeCoMaster would execute
+func PlanMakeCoMaster(instanceKey *InstanceKey) ([]PlannedStatement, error) {
+	plan := []PlannedStatement{}
+	instance, master, err := validateMakeCoMaster(instanceKey, readPlannedInstance)
+	if err != nil {
+		return plan, err
+	}
+	plan = append(plan,
+		PlannedStatement{Key: master.Key, Statement: changeMasterToStatement(master, &instance.Key, &instance.SelfBinlogCoordinates, canUseAutoPosition(master, &instance.Key))},
+		PlannedStatement{Key: master.Key, Statement: "start slave"},
+	)
+	return plan, nil
+}
+
+// PlanMatchBelow lists the statements MatchBelow would execute. The pseudo-GTID matching is performed
+// (reading binary logs on both instances) so as to compute the target coordinates.
+func PlanMatchBelow(instanceKey, otherKey *InstanceKey) ([]PlannedStatement, error) {
+	return planMatchBelow(instanceKey, otherKey, false)
+}
+
+// PlanForceMatchBelow lists the statements ForceMatchBelow would execute
+func PlanForceMatchBelow(instanceKey, otherKey *InstanceKey) ([]PlannedStatement, error) {
+	return planMatchBelow(instanceKey, otherKey, true)
+}
+
+func planMatchBelow(instanceKey, otherKey *InstanceKey, force bool) ([]PlannedStatement, error) {
+	plan := []PlannedStatement{}
+	instance, otherInstance, err := validateMatchBelow(instanceKey, otherKey, readPlannedInstance)
+	if err != nil {
+		return plan, err
+	}
+	if err := verifyNoErrantTransactions(instance, force); err != nil {
+		return plan, err
+	}
+	nextBinlogCoordinatesToMatch, err := getMatchBelowCoordinates(instance, otherInstance)
+	if err != nil {
+		return plan, err
+	}
+	plan = append(plan,
+		PlannedStatement{Key: instance.Key, Statement: "stop slave"},
+		PlannedStatement{Key: instance.Key, Statement: changeMasterToStatement(instance, otherKey, nextBinlogCoordinatesToMatch, canUseAutoPosition(instance, otherKey))},
+		PlannedStatement{Key: instance.Key, Statement: "start slave"},
+	)
+	return plan, nil
+}
+
+// PlanMakeMaster lists the statements MakeMaster would execute: matching each of the instance's siblings
+// below the instance, and making the instance writeable.
+func PlanMakeMaster(instanceKey *InstanceKey) ([]PlannedStatement, error) {
+	plan := []PlannedStatement{}
+	instance, siblings, err := validateMakeMaster(instanceKey, readPlannedInstance)
+	if err != nil {
+		return plan, err
+	}
+	for _, sibling := range siblings {
+		if sibling.SQLThreadUpToDate() && !sibling.Key.Equals(instanceKey) {
+			siblingPlan, err := PlanMatchBelow(&sibling.Key, instanceKey)
+			if err != nil {
+				return plan, err
+			}
+			plan = append(plan, siblingPlan...)
+		}
+	}
+	plan = append(plan, PlannedStatement{Key: instance.Key, Statement: setReadOnlyStatement(false)})
+	return plan, nil
+}
+
+// PlanRelocate lists the statements Relocate would execute, following the steps of GetRelocationPlan.
+// Successive move-up and move-below steps are planned against the instance's expected replication position
+// after each preceding step.
+func PlanRelocate(instanceKey, targetKey *InstanceKey) ([]PlannedStatement, error) {
+	plan := []PlannedStatement{}
+	relocationPlan, err := GetRelocationPlan(instanceKey, targetKey)
+	if err != nil {
+		return plan, err
+	}
+	instance, found, err := ReadInstance(instanceKey)
+	if err != nil || !found {
+		return plan, errors.New(fmt.Sprintf("Relocate: cannot read instance %+v: %+v", *instanceKey, err))
+	}
+	// relocated is the expected state of the instance as the plan progresses
+	relocated := *instance
+	for _, step := range relocationPlan.Steps {
+		switch step.Operation {
+		case "move-up":
+			master, found, err := ReadInstance(&relocated.MasterKey)
+			if err != nil || !found {
+				return plan, errors.New(fmt.Sprintf("Relocate: cannot read instance %+v: %+v", relocated.MasterKey, err))
+			}
+			plan = append(plan, moveUpStatements(&relocated, master)...)
+			relocated.MasterKey = master.MasterKey
+			relocated.ExecBinlogCoordinates = master.ExecBinlogCoordinates
+		case "move-below":
+			sibling, found, err := ReadInstance(&step.TargetKey)
+			if err != nil || !found {
+				return plan, errors.New(fmt.Sprintf("Relocate: cannot read instance %+v: %+v", step.TargetKey, err))
+			}
+			plan = append(plan, moveBelowStatements(&relocated, sibling)...)
+			relocated.MasterKey = sibling.Key
+			relocated.ExecBinlogCoordinates = sibling.SelfBinlogCoordinates
+		case "match-below":
+			matchBelowPlan, err := PlanMatchBelow(&step.InstanceKey, &step.TargetKey)
+			if err != nil {
+				return plan, err
+			}
+			plan = append(plan, matchBelowPlan...)
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,40 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type TopologyPlanTestSuite struct{}
+
+var _ = Suite(&TopologyPlanTestSuite{})
+
+func (s *TopologyPlanTestSuite) TestChangeMasterToStatement(c *C) {
+	masterKey := InstanceKey{Hostname: "master", Port: 3306}
+	coordinates := BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 1024}
+	instance := NewInstance()
+
+	c.Assert(changeMasterToStatement(instance, &masterKey, &coordinates, true), Equals,
+		"change master to master_host='master', master_port=3306, master_auto_position=1")
+	c.Assert(changeMasterToStatement(instance, &masterKey, &coordinates, false), Equals,
+		"change master to master_host='master', master_port=3306, master_log_file='mysql-bin.000012', master_log_pos=1024")
+
+	instance.UsingGTIDAutoPosition = true
+	c.Assert(changeMasterToStatement(instance, &masterKey, &coordinates, false), Equals,
+		"change master to master_host='master', master_port=3306, master_log_file='mysql-bin.000012', master_log_pos=1024, master_auto_position=0")
+}
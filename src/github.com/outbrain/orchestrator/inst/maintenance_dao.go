@@ -72,6 +72,34 @@ Cleanup:
 
 }
 
+// InMaintenance checks whether given instance is under active maintenance
+func InMaintenance(instanceKey *InstanceKey) (bool, error) {
+	inMaintenance := false
+	query := fmt.Sprintf(`
+		select 
+			count(*) > 0 as in_maintenance
+		from 
+			database_instance_maintenance
+		where
+			hostname = '%s'
+			and port = %d
+			and maintenance_active = 1
+		`, instanceKey.Hostname, instanceKey.Port)
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return inMaintenance, log.Errore(err)
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		inMaintenance = m.GetBool("in_maintenance")
+		return nil
+	})
+	if err != nil {
+		return inMaintenance, log.Errore(err)
+	}
+	return inMaintenance, nil
+}
+
 // BeginMaintenance will make new maintenance entry for given instanceKey.
 func BeginMaintenance(instanceKey *InstanceKey, owner string, reason string) (int64, error) {
 	db, err := db.OpenOrchestrator()
@@ -0,0 +1,355 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/db"
+	"regexp"
+)
+
+// isPseudoGTIDIndexEnabled checks whether pseudo-GTID entries are to be indexed & looked up in the index
+func isPseudoGTIDIndexEnabled() bool {
+	return config.Config.PseudoGTIDIndexEnabled && config.Config.PseudoGTIDPattern != ""
+}
+
+// hasBinaryLog checks whether given binary log is listed in the instance's binary logs
+func hasBinaryLog(instance *Instance, binlog string) bool {
+	for _, current := range instance.GetBinaryLogs() {
+		if current == binlog {
+			return true
+		}
+	}
+	return false
+}
+
+// readPseudoGTIDIndexProgress returns the coordinates up to which the given instance's binary logs have been indexed
+func readPseudoGTIDIndexProgress(instanceKey *InstanceKey) (BinlogCoordinates, bool, error) {
+	coordinates := BinlogCoordinates{}
+	found := false
+	query := fmt.Sprintf(`
+		select 
+			binary_log_file,
+			binary_log_pos
+		from 
+			pseudo_gtid_index_progress
+		where
+			hostname = '%s'
+			and port = %d
+		`, instanceKey.Hostname, instanceKey.Port)
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return coordinates, found, log.Errore(err)
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		coordinates.LogFile = m.GetString("binary_log_file")
+		coordinates.LogPos = m.GetInt64("binary_log_pos")
+		found = true
+		return nil
+	})
+	if err != nil {
+		return coordinates, found, log.Errore(err)
+	}
+	return coordinates, found, nil
+}
+
+// writePseudoGTIDIndexProgress persists the coordinates up to which the given instance's binary logs have been indexed
+func writePseudoGTIDIndexProgress(instanceKey *InstanceKey, coordinates BinlogCoordinates) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	_, err = sqlutils.Exec(db, `
+			insert into pseudo_gtid_index_progress (
+				hostname, port, binary_log_file, binary_log_pos, last_indexed
+			) values (
+				?, ?, ?, ?, NOW()
+			) on duplicate key update
+				binary_log_file=values(binary_log_file), binary_log_pos=values(binary_log_pos), last_indexed=values(last_indexed)
+			`,
+		instanceKey.Hostname,
+		instanceKey.Port,
+		coordinates.LogFile,
+		coordinates.LogPos,
+	)
+	return log.Errore(err)
+}
+
+// writePseudoGTIDIndexEntry persists the location of a single pseudo-GTID entry in the given instance's binary logs
+func writePseudoGTIDIndexEntry(instanceKey *InstanceKey, coordinates BinlogCoordinates, entryText string) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	_, err = sqlutils.Exec(db, `
+			insert into pseudo_gtid_index (
+				hostname, port, entry_hash, binary_log_file, binary_log_pos, entry_text, indexed_timestamp
+			) values (
+				?, ?, md5(?), ?, ?, ?, NOW()
+			) on duplicate key update
+				binary_log_file=values(binary_log_file), binary_log_pos=values(binary_log_pos), entry_text=values(entry_text), indexed_timestamp=values(indexed_timestamp)
+			`,
+		instanceKey.Hostname,
+		instanceKey.Port,
+		entryText,
+		coordinates.LogFile,
+		coordinates.LogPos,
+		entryText,
+	)
+	return log.Errore(err)
+}
+
+// readPseudoGTIDIndexBinlogs returns the distinct binary logs referenced by the given instance's index entries
+func readPseudoGTIDIndexBinlogs(instanceKey *InstanceKey) ([]string, error) {
+	binlogs := []string{}
+	query := fmt.Sprintf(`
+		select distinct
+			binary_log_file
+		from 
+			pseudo_gtid_index
+		where
+			hostname = '%s'
+			and port = %d
+		`, instanceKey.Hostname, instanceKey.Port)
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return binlogs, log.Errore(err)
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		binlogs = append(binlogs, m.GetString("binary_log_file"))
+		return nil
+	})
+	return binlogs, log.Errore(err)
+}
+
+// getPurgedPseudoGTIDIndexBinlogs returns those of the indexed binary logs which precede the oldest of the instance's
+// binary logs, i.e. have been purged from the instance
+func getPurgedPseudoGTIDIndexBinlogs(indexedBinlogs []string, binlogs []string) []string {
+	purgedBinlogs := []string{}
+	if len(binlogs) == 0 {
+		return purgedBinlogs
+	}
+	for _, indexedBinlog := range indexedBinlogs {
+		if logFileSmallerThan(indexedBinlog, binlogs[0]) {
+			purgedBinlogs = append(purgedBinlogs, indexedBinlog)
+		}
+	}
+	return purgedBinlogs
+}
+
+// purgePseudoGTIDIndex removes index entries pointing to binary logs which are no longer present on the instance
+func purgePseudoGTIDIndex(instance *Instance) error {
+	indexedBinlogs, err := readPseudoGTIDIndexBinlogs(&instance.Key)
+	if err != nil {
+		return err
+	}
+	purgedBinlogs := getPurgedPseudoGTIDIndexBinlogs(indexedBinlogs, instance.GetBinaryLogs())
+	if len(purgedBinlogs) == 0 {
+		return nil
+	}
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	_, err = sqlutils.Exec(db, fmt.Sprintf(`
+			delete from pseudo_gtid_index 
+			where 
+				hostname = ? 
+				and port = ? 
+				and binary_log_file in (%s)
+			`, sqlutils.InClauseStringValues(purgedBinlogs)),
+		instance.Key.Hostname,
+		instance.Key.Port,
+	)
+	return log.Errore(err)
+}
+
+// resetPseudoGTIDIndex drops all index entries and indexing progress of the given instance, e.g. once its binary logs
+// are found to have been reset. The index is then rebuilt on next update.
+func resetPseudoGTIDIndex(instanceKey *InstanceKey) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	if _, err = sqlutils.Exec(db, `delete from pseudo_gtid_index where hostname = ? and port = ?`, instanceKey.Hostname, instanceKey.Port); err != nil {
+		return log.Errore(err)
+	}
+	_, err = sqlutils.Exec(db, `delete from pseudo_gtid_index_progress where hostname = ? and port = ?`, instanceKey.Hostname, instanceKey.Port)
+	return log.Errore(err)
+}
+
+// getPseudoGTIDIndexStartCoordinates returns the coordinates from which to continue indexing the instance's binary logs:
+// the stored progress, when its binary log still exists. Otherwise, or for a newly indexed instance, indexing starts
+// with the latest binary log.
+// Progress ahead of the instance's own coordinates means the binary logs have been reset (RESET MASTER, rebuild) and
+// names were reused: the index is stale, and needs to be reset.
+func getPseudoGTIDIndexStartCoordinates(instance *Instance, progressCoordinates BinlogCoordinates, progressFound bool) (coordinates BinlogCoordinates, resetIndex bool) {
+	binlogs := instance.GetBinaryLogs()
+	coordinates = BinlogCoordinates{LogFile: binlogs[len(binlogs)-1], LogPos: 0}
+	if !progressFound || !hasBinaryLog(instance, progressCoordinates.LogFile) {
+		return coordinates, false
+	}
+	selfCoordinates := instance.SelfBinlogCoordinates
+	if logFileSmallerThan(selfCoordinates.LogFile, progressCoordinates.LogFile) ||
+		(selfCoordinates.LogFile == progressCoordinates.LogFile && selfCoordinates.LogPos < progressCoordinates.LogPos) {
+		return coordinates, true
+	}
+	return progressCoordinates, false
+}
+
+// UpdatePseudoGTIDIndex incrementally indexes the pseudo-GTID entries found in the given instance's binary logs,
+// picking up from where the previous indexing left off. For a newly indexed instance, only the latest binary log
+// is indexed.
+// The instance is expected to be freshly read from topology, so that its binary logs and self coordinates are known.
+func UpdatePseudoGTIDIndex(instance *Instance) error {
+	binlogs := instance.GetBinaryLogs()
+	if len(binlogs) == 0 {
+		return nil
+	}
+	pseudoGTIDRegexp, err := regexp.Compile(config.Config.PseudoGTIDPattern)
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	progressCoordinates, found, err := readPseudoGTIDIndexProgress(&instance.Key)
+	if err != nil {
+		return err
+	}
+	coordinates, resetIndex := getPseudoGTIDIndexStartCoordinates(instance, progressCoordinates, found)
+	if resetIndex {
+		log.Warningf("Pseudo gtid index progress of %+v (%+v) is ahead of its binary logs (%+v); resetting index", instance.Key, progressCoordinates, instance.SelfBinlogCoordinates)
+		if err := resetPseudoGTIDIndex(&instance.Key); err != nil {
+			return err
+		}
+	}
+
+	indexedEntries := 0
+	for coordinates.SmallerThan(&instance.SelfBinlogCoordinates) {
+		events, err := getNextBinlogEventsChunk(instance, coordinates)
+		if err != nil {
+			return log.Errore(err)
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			if pseudoGTIDRegexp.MatchString(event.Info) {
+				if err := writePseudoGTIDIndexEntry(&instance.Key, event.Coordinates, event.Info); err != nil {
+					return err
+				}
+				indexedEntries++
+			}
+			coordinates = event.NextBinlogCoordinates()
+		}
+	}
+	if indexedEntries > 0 {
+		log.Debugf("Indexed %d pseudo gtid entries in %+v, up to %+v", indexedEntries, instance.Key, coordinates)
+	}
+	if err := purgePseudoGTIDIndex(instance); err != nil {
+		return err
+	}
+	return writePseudoGTIDIndexProgress(&instance.Key, coordinates)
+}
+
+// readPseudoGTIDIndexEntry reads a single index entry matching the given condition, preferring the latest in the binary logs
+func readPseudoGTIDIndexEntry(instanceKey *InstanceKey, condition string, args ...interface{}) (*BinlogCoordinates, string, bool, error) {
+	var coordinates *BinlogCoordinates
+	entryText := ""
+	query := fmt.Sprintf(`
+		select 
+			binary_log_file,
+			binary_log_pos,
+			entry_text
+		from 
+			pseudo_gtid_index
+		where
+			hostname = '%s'
+			and port = %d
+			%s
+		order by
+			binary_log_file desc, binary_log_pos desc
+		limit 1
+		`, instanceKey.Hostname, instanceKey.Port, condition)
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return coordinates, entryText, false, log.Errore(err)
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		coordinates = &BinlogCoordinates{LogFile: m.GetString("binary_log_file"), LogPos: m.GetInt64("binary_log_pos")}
+		entryText = m.GetString("entry_text")
+		return nil
+	}, args...)
+	if err != nil {
+		return coordinates, entryText, false, log.Errore(err)
+	}
+	return coordinates, entryText, (coordinates != nil), nil
+}
+
+// verifyPseudoGTIDIndexEntry checks that the given index entry is indeed found at its indexed coordinates. A binary log
+// of the same name may be a different one, following RESET MASTER or a rebuild of the instance. A stale index is reset.
+func verifyPseudoGTIDIndexEntry(instance *Instance, coordinates *BinlogCoordinates, entryText string) bool {
+	if !hasBinaryLog(instance, coordinates.LogFile) {
+		return false
+	}
+	events, err := readBinlogEventsFrom(&instance.Key, *coordinates, 1)
+	if err != nil {
+		log.Errore(err)
+		return false
+	}
+	if len(events) == 0 || events[0].Info != entryText {
+		log.Warningf("Pseudo gtid index of %+v is stale: entry not found at %+v; resetting index", instance.Key, *coordinates)
+		resetPseudoGTIDIndex(&instance.Key)
+		return false
+	}
+	return true
+}
+
+// ReadLastIndexedPseudoGTIDEntry returns the latest indexed pseudo-GTID entry of the given instance,
+// provided it is verified to still exist in the instance's binary logs
+func ReadLastIndexedPseudoGTIDEntry(instance *Instance) (*BinlogCoordinates, string, bool, error) {
+	coordinates, entryText, found, err := readPseudoGTIDIndexEntry(&instance.Key, "")
+	if err != nil || !found {
+		return coordinates, entryText, false, err
+	}
+	if !verifyPseudoGTIDIndexEntry(instance, coordinates, entryText) {
+		return coordinates, entryText, false, nil
+	}
+	return coordinates, entryText, true, nil
+}
+
+// ReadIndexedPseudoGTIDEntryCoordinates looks up the coordinates of the given pseudo-GTID entry text
+// in the index of the given instance, provided it is verified to still exist in the instance's binary logs
+func ReadIndexedPseudoGTIDEntryCoordinates(instance *Instance, entryText string) (*BinlogCoordinates, bool, error) {
+	coordinates, indexedEntryText, found, err := readPseudoGTIDIndexEntry(&instance.Key, "and entry_hash = md5(?)", entryText)
+	if err != nil || !found {
+		return coordinates, false, err
+	}
+	if indexedEntryText != entryText || !verifyPseudoGTIDIndexEntry(instance, coordinates, entryText) {
+		return coordinates, false, nil
+	}
+	return coordinates, true, nil
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type PseudoGTIDIndexTestSuite struct{}
+
+var _ = Suite(&PseudoGTIDIndexTestSuite{})
+
+func (s *PseudoGTIDIndexTestSuite) TestLogFileSmallerThan(c *C) {
+	c.Assert(logFileSmallerThan("mysql-bin.000012", "mysql-bin.000013"), Equals, true)
+	c.Assert(logFileSmallerThan("mysql-bin.000013", "mysql-bin.000012"), Equals, false)
+	c.Assert(logFileSmallerThan("mysql-bin.000012", "mysql-bin.000012"), Equals, false)
+	c.Assert(logFileSmallerThan("mysql-bin.999999", "mysql-bin.1000000"), Equals, true)
+	c.Assert(logFileSmallerThan("mysql-bin.1000000", "mysql-bin.999999"), Equals, false)
+}
+
+func (s *PseudoGTIDIndexTestSuite) TestGetPurgedPseudoGTIDIndexBinlogs(c *C) {
+	indexed := []string{"mysql-bin.999998", "mysql-bin.999999", "mysql-bin.1000000", "mysql-bin.1000001"}
+
+	c.Assert(getPurgedPseudoGTIDIndexBinlogs(indexed, []string{"mysql-bin.1000000", "mysql-bin.1000001"}), DeepEquals, []string{"mysql-bin.999998", "mysql-bin.999999"})
+	c.Assert(getPurgedPseudoGTIDIndexBinlogs(indexed, []string{"mysql-bin.999998", "mysql-bin.999999"}), DeepEquals, []string{})
+	c.Assert(getPurgedPseudoGTIDIndexBinlogs(indexed, []string{}), DeepEquals, []string{})
+}
+
+func (s *PseudoGTIDIndexTestSuite) TestGetPseudoGTIDIndexStartCoordinates(c *C) {
+	instance := NewInstance()
+	instance.SetBinaryLogs([]string{"mysql-bin.000011", "mysql-bin.000012"})
+	instance.SelfBinlogCoordinates = BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 4000}
+	latest := BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 0}
+
+	coordinates, reset := getPseudoGTIDIndexStartCoordinates(instance, BinlogCoordinates{}, false)
+	c.Assert(coordinates, Equals, latest)
+	c.Assert(reset, Equals, false)
+
+	progress := BinlogCoordinates{LogFile: "mysql-bin.000011", LogPos: 2000}
+	coordinates, reset = getPseudoGTIDIndexStartCoordinates(instance, progress, true)
+	c.Assert(coordinates, Equals, progress)
+	c.Assert(reset, Equals, false)
+
+	// Progress binlog purged
+	coordinates, reset = getPseudoGTIDIndexStartCoordinates(instance, BinlogCoordinates{LogFile: "mysql-bin.000010", LogPos: 2000}, true)
+	c.Assert(coordinates, Equals, latest)
+	c.Assert(reset, Equals, false)
+
+	// Binary logs reset: progress ahead of master status
+	coordinates, reset = getPseudoGTIDIndexStartCoordinates(instance, BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 5000}, true)
+	c.Assert(coordinates, Equals, latest)
+	c.Assert(reset, Equals, true)
+
+	instance.SetBinaryLogs([]string{"mysql-bin.000001", "mysql-bin.000002"})
+	instance.SelfBinlogCoordinates = BinlogCoordinates{LogFile: "mysql-bin.000002", LogPos: 4000}
+	coordinates, reset = getPseudoGTIDIndexStartCoordinates(instance, BinlogCoordinates{LogFile: "mysql-bin.000001", LogPos: 2000}, true)
+	c.Assert(coordinates, Equals, BinlogCoordinates{LogFile: "mysql-bin.000001", LogPos: 2000})
+	c.Assert(reset, Equals, false)
+}
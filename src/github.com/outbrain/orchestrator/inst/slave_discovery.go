@@ -0,0 +1,305 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/db"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SlaveDiscoverer finds the slaves of a given instance. Discovery is abandoned once given context is done.
+type SlaveDiscoverer interface {
+	DiscoverSlaves(ctx context.Context, instance *Instance) ([]InstanceKey, error)
+}
+
+// discoverSlaves finds the slaves of given instance, by the discovery method configured for its cluster
+func discoverSlaves(ctx context.Context, instance *Instance) ([]InstanceKey, error) {
+	slaveDiscoverer, err := GetSlaveDiscoverer(instance.ClusterName)
+	if err != nil {
+		return []InstanceKey{}, err
+	}
+	return slaveDiscoverer.DiscoverSlaves(ctx, instance)
+}
+
+// ShowSlaveHostsDiscoverer finds slaves via SHOW SLAVE HOSTS. Slaves are only listed when configured with report_host,
+// in which case they are listed with their reported port.
+type ShowSlaveHostsDiscoverer struct{}
+
+func (this *ShowSlaveHostsDiscoverer) DiscoverSlaves(ctx context.Context, instance *Instance) ([]InstanceKey, error) {
+	slaveKeys := []InstanceKey{}
+	db, err := db.OpenTopology(instance.Key.Hostname, instance.Key.Port)
+	if err != nil {
+		return slaveKeys, err
+	}
+	err = queryTopologyRowsMap(ctx, db, `show slave hosts`, func(m sqlutils.RowMap) error {
+		slaveKey, err := NewInstanceKeyFromStrings(m.GetString("Host"), m.GetString("Port"))
+		if err != nil {
+			return err
+		}
+		slaveKeys = append(slaveKeys, *slaveKey)
+		return nil
+	})
+	return slaveKeys, err
+}
+
+// ProcesslistDiscoverer finds slaves via the master's Binlog Dump connections. The processlist only tells the slave's
+// host; ports are taken from the backend for slaves already known as replicating from this master, and are otherwise
+// assumed to be the master's port.
+type ProcesslistDiscoverer struct{}
+
+func (this *ProcesslistDiscoverer) DiscoverSlaves(ctx context.Context, instance *Instance) ([]InstanceKey, error) {
+	slaveHostnames := []string{}
+	db, err := db.OpenTopology(instance.Key.Hostname, instance.Key.Port)
+	if err != nil {
+		return []InstanceKey{}, err
+	}
+	err = queryTopologyRowsMap(ctx, db, `
+        	select 
+        		substring_index(host, ':', 1) as slave_hostname 
+        	from 
+        		information_schema.processlist 
+        	where 
+        		command='Binlog Dump'`,
+		func(m sqlutils.RowMap) error {
+			cname, resolveErr := ResolveHostname(m.GetString("slave_hostname"))
+			if resolveErr != nil {
+				log.Errore(resolveErr)
+			}
+			slaveHostnames = append(slaveHostnames, cname)
+			return nil
+		})
+	if err != nil {
+		return []InstanceKey{}, err
+	}
+	knownSlavePorts := make(map[string][]int)
+	for _, slaveHostname := range slaveHostnames {
+		if _, found := knownSlavePorts[slaveHostname]; !found {
+			knownSlavePorts[slaveHostname] = readKnownSlavePorts(slaveHostname, &instance.Key)
+		}
+	}
+	return resolveProcesslistSlaveKeys(slaveHostnames, knownSlavePorts, instance.Key.Port), nil
+}
+
+// resolveProcesslistSlaveKeys maps the hosts of Binlog Dump connections (a host appears once per connected slave)
+// to slave keys. Each host maps to all slaves on that host known to replicate from the master. Should there be more
+// connections from a host than known slaves on it, the rest are assumed to be on the master's port.
+func resolveProcesslistSlaveKeys(slaveHostnames []string, knownSlavePorts map[string][]int, masterPort int) []InstanceKey {
+	slaveKeys := []InstanceKey{}
+	connectionsCount := make(map[string]int)
+	for _, slaveHostname := range slaveHostnames {
+		connectionsCount[slaveHostname]++
+		if connectionsCount[slaveHostname] > 1 {
+			continue
+		}
+		for _, port := range knownSlavePorts[slaveHostname] {
+			slaveKeys = append(slaveKeys, InstanceKey{Hostname: slaveHostname, Port: port})
+		}
+	}
+	for _, slaveHostname := range slaveHostnames {
+		ports := knownSlavePorts[slaveHostname]
+		if connectionsCount[slaveHostname] > len(ports) {
+			assumedKey := InstanceKey{Hostname: slaveHostname, Port: masterPort}
+			alreadyListed := false
+			for _, slaveKey := range slaveKeys {
+				alreadyListed = alreadyListed || slaveKey.Equals(&assumedKey)
+			}
+			if !alreadyListed {
+				slaveKeys = append(slaveKeys, assumedKey)
+			}
+		}
+	}
+	return slaveKeys
+}
+
+// readKnownSlavePorts returns the ports of slaves on given host, known to replicate from given master
+func readKnownSlavePorts(slaveHostname string, masterKey *InstanceKey) []int {
+	ports := []int{}
+	query := `
+		select 
+			port
+		from 
+			database_instance
+		where
+			hostname = ?
+			and master_host = ?
+			and master_port = ?
+		order by
+			port
+		`
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		log.Errore(err)
+		return ports
+	}
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		ports = append(ports, m.GetInt("port"))
+		return nil
+	}, slaveHostname, masterKey.Hostname, masterKey.Port)
+	if err != nil {
+		log.Errore(err)
+		return []int{}
+	}
+	return ports
+}
+
+// InventoryFileDiscoverer finds slaves in a static JSON inventory file, mapping masters to their slaves,
+// e.g. {"master:3306": ["slave1:3306", "slave2:3307"]}
+type InventoryFileDiscoverer struct {
+	FileName string
+}
+
+func (this *InventoryFileDiscoverer) DiscoverSlaves(ctx context.Context, instance *Instance) ([]InstanceKey, error) {
+	slaveHostPorts, err := readInventoryFileSlaves(this.FileName, &instance.Key)
+	if err != nil {
+		return []InstanceKey{}, err
+	}
+	return parseSlaveHostPorts(slaveHostPorts)
+}
+
+// readInventoryFileSlaves reads the slaves listed for given master in given JSON inventory file
+func readInventoryFileSlaves(fileName string, masterKey *InstanceKey) ([]string, error) {
+	content, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return []string{}, err
+	}
+	inventory := make(map[string][]string)
+	if err := json.Unmarshal(content, &inventory); err != nil {
+		return []string{}, errors.New(fmt.Sprintf("Cannot parse slave inventory file %s: %+v", fileName, err))
+	}
+	return inventory[masterKey.DisplayString()], nil
+}
+
+// InventoryHttpDiscoverer finds slaves via an HTTP inventory service, which lists the slaves of a master as JSON,
+// e.g. ["slave1:3306", "slave2:3307"]. The URL may contain the placeholders {host}, {port}, {clusterName}
+type InventoryHttpDiscoverer struct {
+	URL string
+}
+
+func (this *InventoryHttpDiscoverer) DiscoverSlaves(ctx context.Context, instance *Instance) ([]InstanceKey, error) {
+	url := this.URL
+	url = strings.Replace(url, "{host}", instance.Key.Hostname, -1)
+	url = strings.Replace(url, "{port}", fmt.Sprintf("%d", instance.Key.Port), -1)
+	url = strings.Replace(url, "{clusterName}", instance.ClusterName, -1)
+	slaveHostPorts, err := readInventoryHttpSlaves(ctx, url)
+	if err != nil {
+		return []InstanceKey{}, err
+	}
+	return parseSlaveHostPorts(slaveHostPorts)
+}
+
+// readInventoryHttpSlaves reads the slaves listed by given inventory URL
+func readInventoryHttpSlaves(ctx context.Context, url string) ([]string, error) {
+	slaveHostPorts := []string{}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return slaveHostPorts, err
+	}
+	httpClient := &http.Client{Timeout: time.Duration(config.Config.HttpTimeoutSeconds) * time.Second}
+	res, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return slaveHostPorts, topologyReadError(ctx, url, err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return slaveHostPorts, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return slaveHostPorts, errors.New(fmt.Sprintf("Slave inventory %s responded with status %d", url, res.StatusCode))
+	}
+	if err := json.Unmarshal(body, &slaveHostPorts); err != nil {
+		return slaveHostPorts, errors.New(fmt.Sprintf("Cannot parse slave inventory response from %s: %+v", url, err))
+	}
+	return slaveHostPorts, nil
+}
+
+// parseSlaveHostPorts parses instance keys of the form host:port
+func parseSlaveHostPorts(slaveHostPorts []string) ([]InstanceKey, error) {
+	slaveKeys := []InstanceKey{}
+	for _, slaveHostPort := range slaveHostPorts {
+		slaveKey, err := ParseInstanceKey(slaveHostPort)
+		if err != nil {
+			return slaveKeys, err
+		}
+		slaveKeys = append(slaveKeys, *slaveKey)
+	}
+	return slaveKeys, nil
+}
+
+// SlaveDiscovererChain attempts discoverers in turn, up to the first to find any slaves. A failing discoverer
+// is skipped; an error is only returned when all discoverers fail.
+type SlaveDiscovererChain []SlaveDiscoverer
+
+func (this SlaveDiscovererChain) DiscoverSlaves(ctx context.Context, instance *Instance) ([]InstanceKey, error) {
+	var lastErr error
+	failures := 0
+	for _, discoverer := range this {
+		slaveKeys, err := discoverer.DiscoverSlaves(ctx, instance)
+		if err != nil {
+			lastErr = log.Errorf("Failed discovering slaves of %+v: %+v", instance.Key, err)
+			failures++
+			continue
+		}
+		if len(slaveKeys) > 0 {
+			return slaveKeys, nil
+		}
+	}
+	if len(this) > 0 && failures == len(this) {
+		return []InstanceKey{}, lastErr
+	}
+	return []InstanceKey{}, nil
+}
+
+// NewSlaveDiscoverer creates a discoverer by given method name. See config.SlaveDiscovery
+func NewSlaveDiscoverer(slaveDiscovery *config.SlaveDiscovery) (SlaveDiscoverer, error) {
+	switch slaveDiscovery.Method {
+	case "show-slave-hosts":
+		return &ShowSlaveHostsDiscoverer{}, nil
+	case "processlist":
+		return &ProcesslistDiscoverer{}, nil
+	case "inventory-file":
+		return &InventoryFileDiscoverer{FileName: slaveDiscovery.InventoryFile}, nil
+	case "inventory-http":
+		return &InventoryHttpDiscoverer{URL: slaveDiscovery.InventoryURL}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown slave discovery method: %s", slaveDiscovery.Method))
+}
+
+// GetSlaveDiscoverer returns the discoverer configured for given cluster (see config.SlaveDiscoveries). Clusters
+// not configured otherwise attempt SHOW SLAVE HOSTS (if DiscoverByShowSlaveHosts is set), then the processlist.
+func GetSlaveDiscoverer(clusterName string) (SlaveDiscoverer, error) {
+	for _, slaveDiscovery := range config.Config.SlaveDiscoveries {
+		if matched, _ := regexp.MatchString(slaveDiscovery.ClusterFilter, clusterName); matched {
+			return NewSlaveDiscoverer(&slaveDiscovery)
+		}
+	}
+	if config.Config.DiscoverByShowSlaveHosts {
+		return SlaveDiscovererChain{&ShowSlaveHostsDiscoverer{}, &ProcesslistDiscoverer{}}, nil
+	}
+	return &ProcesslistDiscoverer{}, nil
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"context"
+	"fmt"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+type SlaveDiscoveryTestSuite struct{}
+
+var _ = Suite(&SlaveDiscoveryTestSuite{})
+
+func (s *SlaveDiscoveryTestSuite) TestInventoryFile(c *C) {
+	file, err := ioutil.TempFile("", "orchestrator-inventory")
+	c.Assert(err, IsNil)
+	defer os.Remove(file.Name())
+	file.WriteString(`{"master:3306": ["slave1:3306", "slave2:3307"], "other:3306": ["slave3:3306"]}`)
+	file.Close()
+
+	slaves, err := readInventoryFileSlaves(file.Name(), &InstanceKey{Hostname: "master", Port: 3306})
+	c.Assert(err, IsNil)
+	c.Assert(slaves, DeepEquals, []string{"slave1:3306", "slave2:3307"})
+
+	slaves, err = readInventoryFileSlaves(file.Name(), &InstanceKey{Hostname: "master", Port: 3307})
+	c.Assert(err, IsNil)
+	c.Assert(len(slaves), Equals, 0)
+}
+
+func (s *SlaveDiscoveryTestSuite) TestInventoryFileInvalid(c *C) {
+	file, err := ioutil.TempFile("", "orchestrator-inventory")
+	c.Assert(err, IsNil)
+	defer os.Remove(file.Name())
+	file.WriteString(`["slave1:3306"]`)
+	file.Close()
+
+	_, err = readInventoryFileSlaves(file.Name(), &InstanceKey{Hostname: "master", Port: 3306})
+	c.Assert(err, NotNil)
+}
+
+func (s *SlaveDiscoveryTestSuite) TestInventoryHttp(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/slaves/master/3306" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `["slave1:3306", "slave2:3307"]`)
+	}))
+	defer server.Close()
+
+	slaves, err := readInventoryHttpSlaves(context.Background(), server.URL+"/slaves/master/3306")
+	c.Assert(err, IsNil)
+	c.Assert(slaves, DeepEquals, []string{"slave1:3306", "slave2:3307"})
+
+	_, err = readInventoryHttpSlaves(context.Background(), server.URL+"/slaves/master/3307")
+	c.Assert(err, NotNil)
+}
+
+func (s *SlaveDiscoveryTestSuite) TestInventoryHttpTimeout(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+		fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := readInventoryHttpSlaves(ctx, server.URL)
+	c.Assert(IsTopologyReadTimeout(err), Equals, true)
+	c.Assert(checkOutcome(err), Equals, CheckOutcomeTimeout)
+}
+
+func (s *SlaveDiscoveryTestSuite) TestResolveProcesslistSlaveKeys(c *C) {
+	knownSlavePorts := map[string][]int{
+		"slave1": {3306},
+		"slave2": {3307, 3308},
+	}
+	// Two slaves on slave2, both known; slave3 unknown
+	slaveKeys := resolveProcesslistSlaveKeys([]string{"slave1", "slave2", "slave2", "slave3"}, knownSlavePorts, 3306)
+	c.Assert(slaveKeys, DeepEquals, []InstanceKey{
+		{Hostname: "slave1", Port: 3306},
+		{Hostname: "slave2", Port: 3307},
+		{Hostname: "slave2", Port: 3308},
+		{Hostname: "slave3", Port: 3306},
+	})
+
+	// A second slave on slave1, not yet known
+	slaveKeys = resolveProcesslistSlaveKeys([]string{"slave1", "slave1"}, map[string][]int{"slave1": {3307}}, 3306)
+	c.Assert(slaveKeys, DeepEquals, []InstanceKey{
+		{Hostname: "slave1", Port: 3307},
+		{Hostname: "slave1", Port: 3306},
+	})
+
+	c.Assert(resolveProcesslistSlaveKeys([]string{}, knownSlavePorts, 3306), DeepEquals, []InstanceKey{})
+}
+
+// staticSlaveDiscoverer is a SlaveDiscoverer returning fixed results
+type staticSlaveDiscoverer struct {
+	slaveKeys []InstanceKey
+	err       error
+}
+
+func (this *staticSlaveDiscoverer) DiscoverSlaves(ctx context.Context, instance *Instance) ([]InstanceKey, error) {
+	return this.slaveKeys, this.err
+}
+
+func (s *SlaveDiscoveryTestSuite) TestSlaveDiscovererChain(c *C) {
+	instance := NewInstance()
+	instance.Key = InstanceKey{Hostname: "master", Port: 3306}
+	slaveKeys := []InstanceKey{{Hostname: "slave", Port: 3306}}
+	failing := &staticSlaveDiscoverer{err: fmt.Errorf("show slave hosts failed")}
+	empty := &staticSlaveDiscoverer{slaveKeys: []InstanceKey{}}
+	found := &staticSlaveDiscoverer{slaveKeys: slaveKeys}
+
+	// A failing discoverer falls back to the next
+	keys, err := SlaveDiscovererChain{failing, found}.DiscoverSlaves(context.Background(), instance)
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, slaveKeys)
+
+	keys, err = SlaveDiscovererChain{empty, failing}.DiscoverSlaves(context.Background(), instance)
+	c.Assert(err, IsNil)
+	c.Assert(len(keys), Equals, 0)
+
+	_, err = SlaveDiscovererChain{failing, failing}.DiscoverSlaves(context.Background(), instance)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,149 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Types of topology change events
+const (
+	TopologyChangeInstanceDiscovered = "instance-discovered"
+	TopologyChangeInstanceForgotten  = "instance-forgotten"
+	TopologyChangeMasterChanged      = "master-changed"
+	TopologyChangeBecameReadOnly     = "became-read-only"
+	TopologyChangeBecameWriteable    = "became-writeable"
+	TopologyChangeSlaveStopped       = "slave-stopped"
+	TopologyChangeSlaveStarted       = "slave-started"
+	TopologyChangeVersionUpgraded    = "version-upgraded"
+	TopologyChangeVersionDowngraded  = "version-downgraded"
+	TopologyChangeServerIDChanged    = "server-id-changed"
+)
+
+// TopologyChangeEvent is a change to an instance, as detected by comparing a fresh read of the instance
+// with what orchestrator knew of it. The change may or may not have been made by orchestrator.
+type TopologyChangeEvent struct {
+	EventId        int64
+	EventTimestamp string
+	EventType      string
+	Key            InstanceKey
+	ClusterName    string
+	PreviousValue  string
+	NewValue       string
+}
+
+func newTopologyChangeEvent(eventType string, instance *Instance, previousValue string, newValue string) TopologyChangeEvent {
+	return TopologyChangeEvent{
+		EventType:     eventType,
+		Key:           instance.Key,
+		ClusterName:   instance.ClusterName,
+		PreviousValue: previousValue,
+		NewValue:      newValue,
+	}
+}
+
+// masterDisplayString presents the master of given instance, or an empty string if it has none
+func masterDisplayString(instance *Instance) string {
+	if !instance.IsSlave() {
+		return ""
+	}
+	return instance.MasterKey.DisplayString()
+}
+
+var versionNumberRegexp = regexp.MustCompile("[0-9]+")
+
+// compareVersions compares two MySQL version strings by their numeric tokens (e.g. "5.6.24-72.2-log" reads as
+// 5, 6, 24, 72, 2), returning -1, 0 or 1 as the first version is smaller, equal or greater than the second.
+func compareVersions(version string, otherVersion string) int {
+	tokens := versionNumberRegexp.FindAllString(version, -1)
+	otherTokens := versionNumberRegexp.FindAllString(otherVersion, -1)
+	for i := 0; i < len(tokens) || i < len(otherTokens); i++ {
+		token, otherToken := -1, -1
+		if i < len(tokens) {
+			token, _ = strconv.Atoi(tokens[i])
+		}
+		if i < len(otherTokens) {
+			otherToken, _ = strconv.Atoi(otherTokens[i])
+		}
+		if token < otherToken {
+			return -1
+		}
+		if token > otherToken {
+			return 1
+		}
+	}
+	return 0
+}
+
+// diffInstances lists the changes between the previously known state of an instance and its current state.
+// previous is nil when the instance was not known before.
+func diffInstances(previous *Instance, current *Instance) []TopologyChangeEvent {
+	events := []TopologyChangeEvent{}
+	if previous == nil {
+		return append(events, newTopologyChangeEvent(TopologyChangeInstanceDiscovered, current, "", masterDisplayString(current)))
+	}
+	if masterDisplayString(previous) != masterDisplayString(current) {
+		events = append(events, newTopologyChangeEvent(TopologyChangeMasterChanged, current, masterDisplayString(previous), masterDisplayString(current)))
+	}
+	if !previous.ReadOnly && current.ReadOnly {
+		events = append(events, newTopologyChangeEvent(TopologyChangeBecameReadOnly, current, "", ""))
+	}
+	if previous.ReadOnly && !current.ReadOnly {
+		events = append(events, newTopologyChangeEvent(TopologyChangeBecameWriteable, current, "", ""))
+	}
+	if current.IsSlave() && previous.SlaveRunning() && !current.SlaveRunning() {
+		events = append(events, newTopologyChangeEvent(TopologyChangeSlaveStopped, current,
+			slaveThreadsDisplayString(previous), slaveThreadsDisplayString(current)))
+	}
+	if previous.IsSlave() && !previous.SlaveRunning() && current.SlaveRunning() {
+		events = append(events, newTopologyChangeEvent(TopologyChangeSlaveStarted, current,
+			slaveThreadsDisplayString(previous), slaveThreadsDisplayString(current)))
+	}
+	switch compareVersions(previous.Version, current.Version) {
+	case -1:
+		events = append(events, newTopologyChangeEvent(TopologyChangeVersionUpgraded, current, previous.Version, current.Version))
+	case 1:
+		events = append(events, newTopologyChangeEvent(TopologyChangeVersionDowngraded, current, previous.Version, current.Version))
+	}
+	if previous.ServerID != current.ServerID {
+		events = append(events, newTopologyChangeEvent(TopologyChangeServerIDChanged, current, fmt.Sprintf("%d", previous.ServerID), fmt.Sprintf("%d", current.ServerID)))
+	}
+	return events
+}
+
+// topologyChangesSince lists the changes of given instance since it was last successfully read (lastValid). Instances
+// known (known) from before their last valid state was kept are compared with what is known, if that is valid.
+// lastValid and known are nil when not found.
+func topologyChangesSince(lastValid *Instance, known *Instance, current *Instance) []TopologyChangeEvent {
+	if lastValid != nil {
+		return diffInstances(lastValid, current)
+	}
+	if known == nil {
+		return diffInstances(nil, current)
+	}
+	if known.IsLastCheckValid {
+		return diffInstances(known, current)
+	}
+	return []TopologyChangeEvent{}
+}
+
+// slaveThreadsDisplayString presents the state of the replication threads of given instance
+func slaveThreadsDisplayString(instance *Instance) string {
+	return fmt.Sprintf("io_thread: %t, sql_thread: %t", instance.Slave_IO_Running, instance.Slave_SQL_Running)
+}
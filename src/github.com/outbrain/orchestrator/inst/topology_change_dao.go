@@ -0,0 +1,226 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/db"
+)
+
+// writeTopologyChanges records the topology changes of given, successfully read, instance since it was last
+// successfully read, then records its state as the last valid one. known is the instance as known in the backend
+// before this read, or nil if it was not known. Failed reads in between tell nothing of the instance's state, and
+// are skipped over.
+// This is done in a single transaction, locking the instance's last valid state, so that concurrent reads of the
+// same instance (e.g. a discovery poll and a refactoring) do not record the same changes twice. Where no state is
+// recorded yet, concurrent transactions may deadlock; the one rolled back records nothing.
+func writeTopologyChanges(sqlDB *sql.DB, instance *Instance, known *Instance) error {
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return log.Errore(err)
+	}
+	lastValid, err := readLastValidInstanceStateForUpdate(tx, &instance.Key)
+	if err != nil {
+		tx.Rollback()
+		return log.Errore(err)
+	}
+	events := topologyChangesSince(lastValid, known, instance)
+	if err := writeTopologyChangeEvents(tx, events); err != nil {
+		tx.Rollback()
+		return log.Errore(err)
+	}
+	if err := writeLastValidInstanceState(tx, instance); err != nil {
+		tx.Rollback()
+		return log.Errore(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return log.Errore(err)
+	}
+	for _, event := range events {
+		log.Infof("Topology change on %+v: %s %s %s", event.Key, event.EventType, event.PreviousValue, event.NewValue)
+	}
+	return nil
+}
+
+// readLastValidInstanceStateForUpdate reads, and locks, the state in which given instance was last successfully
+// read, as far as topology changes go. It returns nil when no such state is recorded.
+func readLastValidInstanceStateForUpdate(tx *sql.Tx, instanceKey *InstanceKey) (*Instance, error) {
+	lastValid := NewInstance()
+	lastValid.Key = *instanceKey
+	err := tx.QueryRow(`
+		select
+			server_id,
+			version,
+			read_only,
+			master_host,
+			master_port,
+			master_log_file,
+			slave_sql_running,
+			slave_io_running
+		from
+			topology_change_instance_state
+		where
+			hostname = ?
+			and port = ?
+		for update
+		`, instanceKey.Hostname, instanceKey.Port,
+	).Scan(
+		&lastValid.ServerID,
+		&lastValid.Version,
+		&lastValid.ReadOnly,
+		&lastValid.MasterKey.Hostname,
+		&lastValid.MasterKey.Port,
+		&lastValid.ReadBinlogCoordinates.LogFile,
+		&lastValid.Slave_SQL_Running,
+		&lastValid.Slave_IO_Running,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return lastValid, nil
+}
+
+// writeTopologyChangeEvents persists given change events
+func writeTopologyChangeEvents(tx *sql.Tx, events []TopologyChangeEvent) error {
+	for _, event := range events {
+		_, err := tx.Exec(`
+			insert into topology_change_event (
+				event_timestamp, event_type, hostname, port, cluster_name, previous_value, new_value
+			) values (
+				NOW(), ?, ?, ?, ?, ?, ?
+			)
+			`,
+			event.EventType,
+			event.Key.Hostname,
+			event.Key.Port,
+			event.ClusterName,
+			event.PreviousValue,
+			event.NewValue,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeLastValidInstanceState records the state of given, successfully read, instance for later change detection
+func writeLastValidInstanceState(tx *sql.Tx, instance *Instance) error {
+	_, err := tx.Exec(`
+			replace into topology_change_instance_state (
+				hostname, port, server_id, version, read_only, master_host, master_port, master_log_file,
+				slave_sql_running, slave_io_running
+			) values (
+				?, ?, ?, ?, ?, ?, ?, ?, ?, ?
+			)
+			`,
+		instance.Key.Hostname,
+		instance.Key.Port,
+		instance.ServerID,
+		instance.Version,
+		instance.ReadOnly,
+		instance.MasterKey.Hostname,
+		instance.MasterKey.Port,
+		instance.ReadBinlogCoordinates.LogFile,
+		instance.Slave_SQL_Running,
+		instance.Slave_IO_Running,
+	)
+	return err
+}
+
+// deleteForgottenInstancesStates removes the recorded states of instances no longer in database_instance
+func deleteForgottenInstancesStates(sqlDB *sql.DB) error {
+	_, err := sqlutils.Exec(sqlDB, `
+			delete topology_change_instance_state
+			from
+				topology_change_instance_state
+				left join database_instance using (hostname, port)
+			where
+				database_instance.hostname is null
+			`)
+	return log.Errore(err)
+}
+
+// writeForgottenInstancesChangeEvents records instances about to be forgotten, as selected by given condition
+// on database_instance
+func writeForgottenInstancesChangeEvents(sqlDB *sql.DB, condition string, args ...interface{}) error {
+	query := fmt.Sprintf(`
+			insert into topology_change_event (
+				event_timestamp, event_type, hostname, port, cluster_name, previous_value, new_value
+			) select
+				NOW(), '%s', hostname, port, cluster_name, '', ''
+			from
+				database_instance
+			where
+				%s
+			`, TopologyChangeInstanceForgotten, condition)
+	_, err := sqlutils.Exec(sqlDB, query, args...)
+	return log.Errore(err)
+}
+
+// ReadTopologyChangeEvents returns change events following the given event id (0 for all), oldest first, up to limit
+// events. Clients may follow the stream of changes by passing the id of the last event they have read.
+func ReadTopologyChangeEvents(sinceEventId int64, limit int) ([]TopologyChangeEvent, error) {
+	res := []TopologyChangeEvent{}
+	query := fmt.Sprintf(`
+		select 
+			event_id,
+			event_timestamp,
+			event_type,
+			hostname,
+			port,
+			cluster_name,
+			previous_value,
+			new_value
+		from 
+			topology_change_event
+		where
+			event_id > %d
+		order by
+			event_id asc
+		limit %d
+		`, sinceEventId, limit)
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return res, log.Errore(err)
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		event := TopologyChangeEvent{}
+		event.EventId = m.GetInt64("event_id")
+		event.EventTimestamp = m.GetString("event_timestamp")
+		event.EventType = m.GetString("event_type")
+		event.Key.Hostname = m.GetString("hostname")
+		event.Key.Port = m.GetInt("port")
+		event.ClusterName = m.GetString("cluster_name")
+		event.PreviousValue = m.GetString("previous_value")
+		event.NewValue = m.GetString("new_value")
+
+		res = append(res, event)
+		return nil
+	})
+	if err != nil {
+		return res, log.Errore(err)
+	}
+	return res, nil
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func changeTestSlave() *Instance {
+	slave := NewInstance()
+	slave.Key = InstanceKey{Hostname: "slave", Port: 3306}
+	slave.MasterKey = InstanceKey{Hostname: "master", Port: 3306}
+	slave.ReadBinlogCoordinates = BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 1024}
+	slave.Slave_IO_Running = true
+	slave.Slave_SQL_Running = true
+	slave.ReadOnly = true
+	slave.ServerID = 101
+	slave.Version = "5.6.24-log"
+	return slave
+}
+
+type TopologyChangeTestSuite struct{}
+
+var _ = Suite(&TopologyChangeTestSuite{})
+
+func (s *TopologyChangeTestSuite) TestNoChange(c *C) {
+	events := diffInstances(changeTestSlave(), changeTestSlave())
+	c.Assert(len(events), Equals, 0)
+}
+
+func (s *TopologyChangeTestSuite) TestInstanceDiscovered(c *C) {
+	events := diffInstances(nil, changeTestSlave())
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeInstanceDiscovered)
+	c.Assert(events[0].NewValue, Equals, "master:3306")
+}
+
+func (s *TopologyChangeTestSuite) TestMasterChanged(c *C) {
+	current := changeTestSlave()
+	current.MasterKey = InstanceKey{Hostname: "other-master", Port: 3306}
+	events := diffInstances(changeTestSlave(), current)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeMasterChanged)
+	c.Assert(events[0].PreviousValue, Equals, "master:3306")
+	c.Assert(events[0].NewValue, Equals, "other-master:3306")
+}
+
+func (s *TopologyChangeTestSuite) TestBecameWriteable(c *C) {
+	current := changeTestSlave()
+	current.ReadOnly = false
+	events := diffInstances(changeTestSlave(), current)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeBecameWriteable)
+
+	events = diffInstances(current, changeTestSlave())
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeBecameReadOnly)
+}
+
+func (s *TopologyChangeTestSuite) TestSlaveStopped(c *C) {
+	current := changeTestSlave()
+	current.Slave_SQL_Running = false
+	events := diffInstances(changeTestSlave(), current)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeSlaveStopped)
+	c.Assert(events[0].NewValue, Equals, "io_thread: true, sql_thread: false")
+
+	events = diffInstances(current, changeTestSlave())
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeSlaveStarted)
+}
+
+func (s *TopologyChangeTestSuite) TestVersionUpgradeAndServerIDChange(c *C) {
+	current := changeTestSlave()
+	current.Version = "5.7.9-log"
+	current.ServerID = 102
+	events := diffInstances(changeTestSlave(), current)
+	c.Assert(len(events), Equals, 2)
+	c.Assert(events[0].EventType, Equals, TopologyChangeVersionUpgraded)
+	c.Assert(events[0].NewValue, Equals, "5.7.9-log")
+	c.Assert(events[1].EventType, Equals, TopologyChangeServerIDChanged)
+	c.Assert(events[1].PreviousValue, Equals, "101")
+}
+
+func (s *TopologyChangeTestSuite) TestVersionDowngrade(c *C) {
+	current := changeTestSlave()
+	current.Version = "5.6.9-log"
+	events := diffInstances(changeTestSlave(), current)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeVersionDowngraded)
+	c.Assert(events[0].PreviousValue, Equals, "5.6.24-log")
+
+	// Not a change of version
+	current.Version = "5.6.24"
+	c.Assert(len(diffInstances(changeTestSlave(), current)), Equals, 0)
+}
+
+func (s *TopologyChangeTestSuite) TestCompareVersions(c *C) {
+	c.Assert(compareVersions("5.6.24-log", "5.6.24"), Equals, 0)
+	c.Assert(compareVersions("5.6.9", "5.6.24"), Equals, -1)
+	c.Assert(compareVersions("5.7.1", "5.6.24"), Equals, 1)
+	c.Assert(compareVersions("10.0.21-MariaDB", "5.6.24"), Equals, 1)
+	c.Assert(compareVersions("5.6.24-72.2-log", "5.6.24-72.1-log"), Equals, 1)
+	c.Assert(compareVersions("5.6", "5.6.0"), Equals, -1)
+}
+
+func (s *TopologyChangeTestSuite) TestChangesSinceLastValidRead(c *C) {
+	current := changeTestSlave()
+	current.MasterKey = InstanceKey{Hostname: "other-master", Port: 3306}
+
+	// The last check failed, leaving a partially read instance behind
+	known := NewInstance()
+	known.Key = current.Key
+	known.IsLastCheckValid = false
+
+	events := topologyChangesSince(changeTestSlave(), known, current)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeMasterChanged)
+	c.Assert(events[0].PreviousValue, Equals, "master:3306")
+}
+
+func (s *TopologyChangeTestSuite) TestChangesWithoutLastValidState(c *C) {
+	current := changeTestSlave()
+	current.ReadOnly = false
+
+	events := topologyChangesSince(nil, nil, current)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeInstanceDiscovered)
+
+	known := changeTestSlave()
+	known.IsLastCheckValid = true
+	events = topologyChangesSince(nil, known, current)
+	c.Assert(len(events), Equals, 1)
+	c.Assert(events[0].EventType, Equals, TopologyChangeBecameWriteable)
+
+	known.IsLastCheckValid = false
+	c.Assert(len(topologyChangesSince(nil, known, current)), Equals, 0)
+}
@@ -0,0 +1,141 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/config"
+	"time"
+)
+
+// Outcomes of the last check of an instance
+const (
+	CheckOutcomeSuccess = "success"
+	CheckOutcomeError   = "error"
+	CheckOutcomeTimeout = "timeout"
+)
+
+// TopologyReadTimeoutError indicates a read from a topology instance which did not complete in time, and
+// was cancelled
+type TopologyReadTimeoutError struct {
+	Query string
+}
+
+func (this *TopologyReadTimeoutError) Error() string {
+	return fmt.Sprintf("Timeout reading from topology instance: %s", this.Query)
+}
+
+// IsTopologyReadTimeout returns true when given error is that of a timed out topology read
+func IsTopologyReadTimeout(err error) bool {
+	_, ok := err.(*TopologyReadTimeoutError)
+	return ok
+}
+
+// checkOutcome returns the check outcome implied by the error with which a check completed
+func checkOutcome(err error) string {
+	if err == nil {
+		return CheckOutcomeSuccess
+	}
+	if IsTopologyReadTimeout(err) {
+		return CheckOutcomeTimeout
+	}
+	return CheckOutcomeError
+}
+
+// probeContextKey marks the context of a probe, within which each query is bounded by the per-query timeout
+type probeContextKey struct{}
+
+// newTimeoutContext returns a context bounded by given number of seconds. A non-positive number means no timeout.
+func newTimeoutContext(ctx context.Context, timeoutSeconds int) (context.Context, context.CancelFunc) {
+	if timeoutSeconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+}
+
+// newProbeContext returns a context bounding a whole probe (a complete read) of a topology instance
+func newProbeContext() (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), probeContextKey{}, true)
+	return newTimeoutContext(ctx, config.Config.InstanceProbeTimeoutSeconds)
+}
+
+// newQueryContext returns a context bounding a single query on a topology instance, within given context.
+// Only the queries of a probe are bounded by the per-query timeout; other reads, such as scans of large binary
+// logs, are bounded by given context alone.
+func newQueryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx.Value(probeContextKey{}) == nil {
+		return context.WithCancel(ctx)
+	}
+	return newTimeoutContext(ctx, config.Config.MySQLTopologyQueryTimeoutSeconds)
+}
+
+// topologyReadError translates the error of a read cancelled by its context into a TopologyReadTimeoutError
+func topologyReadError(ctx context.Context, query string, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return &TopologyReadTimeoutError{Query: query}
+	}
+	return err
+}
+
+// queryTopologyRowsMap is the counterpart of sqlutils.QueryRowsMap for topology instances: the query is cancelled
+// once given context is done, or, within a probe, once the configured per-query timeout elapses.
+func queryTopologyRowsMap(ctx context.Context, db *sql.DB, query string, onRow func(sqlutils.RowMap) error, args ...interface{}) error {
+	queryCtx, cancel := newQueryContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(queryCtx, query, args...)
+	if err != nil {
+		return topologyReadError(queryCtx, query, err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return topologyReadError(queryCtx, query, err)
+	}
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		scanArgs := make([]interface{}, len(columns))
+		for i := range values {
+			scanArgs[i] = &values[i]
+		}
+		if err := rows.Scan(scanArgs...); err != nil {
+			return topologyReadError(queryCtx, query, err)
+		}
+		m := make(sqlutils.RowMap)
+		for i, column := range columns {
+			m[column] = sqlutils.CellData(values[i])
+		}
+		if err := onRow(m); err != nil {
+			return err
+		}
+	}
+	return topologyReadError(queryCtx, query, rows.Err())
+}
+
+// scanTopologyRow reads a single row off a topology instance, subject to given context and, within a probe, to the
+// configured per-query timeout.
+func scanTopologyRow(ctx context.Context, db *sql.DB, query string, dest ...interface{}) error {
+	queryCtx, cancel := newQueryContext(ctx)
+	defer cancel()
+
+	err := db.QueryRowContext(queryCtx, query).Scan(dest...)
+	return topologyReadError(queryCtx, query, err)
+}
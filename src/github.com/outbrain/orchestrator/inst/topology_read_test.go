@@ -0,0 +1,73 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package inst
+
+import (
+	"context"
+	"github.com/outbrain/orchestrator/config"
+	. "gopkg.in/check.v1"
+)
+
+type TopologyReadTestSuite struct{}
+
+var _ = Suite(&TopologyReadTestSuite{})
+
+// useTopologyReadTimeouts sets the probe & query timeouts, returning a function restoring them
+func useTopologyReadTimeouts(probeTimeoutSeconds int, queryTimeoutSeconds int) func() {
+	previousProbeTimeoutSeconds := config.Config.InstanceProbeTimeoutSeconds
+	previousQueryTimeoutSeconds := config.Config.MySQLTopologyQueryTimeoutSeconds
+	config.Config.InstanceProbeTimeoutSeconds = probeTimeoutSeconds
+	config.Config.MySQLTopologyQueryTimeoutSeconds = queryTimeoutSeconds
+	return func() {
+		config.Config.InstanceProbeTimeoutSeconds = previousProbeTimeoutSeconds
+		config.Config.MySQLTopologyQueryTimeoutSeconds = previousQueryTimeoutSeconds
+	}
+}
+
+func (s *TopologyReadTestSuite) TestQueryTimeoutWithinProbeOnly(c *C) {
+	defer useTopologyReadTimeouts(30, 10)()
+
+	probeCtx, cancelProbe := newProbeContext()
+	defer cancelProbe()
+	_, hasDeadline := probeCtx.Deadline()
+	c.Assert(hasDeadline, Equals, true)
+
+	queryCtx, cancelQuery := newQueryContext(probeCtx)
+	defer cancelQuery()
+	probeDeadline, _ := probeCtx.Deadline()
+	queryDeadline, hasDeadline := queryCtx.Deadline()
+	c.Assert(hasDeadline, Equals, true)
+	c.Assert(queryDeadline.Before(probeDeadline), Equals, true)
+
+	// e.g. scanning binary logs
+	scanCtx, cancelScan := newQueryContext(context.Background())
+	defer cancelScan()
+	_, hasDeadline = scanCtx.Deadline()
+	c.Assert(hasDeadline, Equals, false)
+}
+
+func (s *TopologyReadTestSuite) TestZeroTimeoutsMeanNoTimeout(c *C) {
+	defer useTopologyReadTimeouts(0, 0)()
+
+	probeCtx, cancelProbe := newProbeContext()
+	defer cancelProbe()
+	queryCtx, cancelQuery := newQueryContext(probeCtx)
+	defer cancelQuery()
+	_, hasDeadline := queryCtx.Deadline()
+	c.Assert(hasDeadline, Equals, false)
+	c.Assert(queryCtx.Err(), IsNil)
+}
@@ -0,0 +1,211 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package orchestrator
+
+import (
+	"github.com/outbrain/orchestrator/inst"
+	"sync"
+	"time"
+)
+
+// DiscoveryMetrics provides counters of the discovery process
+type DiscoveryMetrics struct {
+	QueueDepth                int            // Number of instances waiting to be probed
+	InFlight                  int            // Number of instances being probed
+	InFlightHosts             map[string]int // Number of instances being probed, per host
+	Queued                    int64          // Total number of instances submitted for discovery
+	Deduplicated              int64          // Total number of submissions ignored since the instance was already queued or being probed
+	Probed                    int64          // Total number of completed probes
+	LastProbeLatencyMillis    int64
+	AverageProbeLatencyMillis int64
+	MaxProbeLatencyMillis     int64
+}
+
+// discoveryTree tracks the instances reached by following masters & slaves from a single submitted instance, so that
+// the discovery of that topology may be waited upon regardless of any other discovery going on.
+type discoveryTree struct {
+	pending int
+	visited map[inst.InstanceKey]bool
+}
+
+// discoveryQueue is a FIFO queue of instance keys pending discovery. An instance key which is already queued, or
+// which is being probed, is not queued again. A limited number of instances on a single host are handed out for
+// probing at any given time; other instances on that host wait in queue, without holding back instances on other hosts.
+type discoveryQueue struct {
+	sync.Mutex
+	cond               *sync.Cond
+	keys               []inst.InstanceKey
+	queuedKeys         map[inst.InstanceKey]bool
+	inFlightKeys       map[inst.InstanceKey]bool
+	inFlightHosts      map[string]int
+	keyTrees           map[inst.InstanceKey][]*discoveryTree
+	maxInFlightPerHost int
+	queued             int64
+	deduplicated       int64
+	probed             int64
+	lastProbeLatency   time.Duration
+	totalProbeLatency  time.Duration
+	maxProbeLatency    time.Duration
+}
+
+func newDiscoveryQueue() *discoveryQueue {
+	queue := &discoveryQueue{
+		keys:          []inst.InstanceKey{},
+		queuedKeys:    make(map[inst.InstanceKey]bool),
+		inFlightKeys:  make(map[inst.InstanceKey]bool),
+		inFlightHosts: make(map[string]int),
+		keyTrees:      make(map[inst.InstanceKey][]*discoveryTree),
+	}
+	queue.cond = sync.NewCond(queue)
+	return queue
+}
+
+// SetMaxInFlightPerHost limits the number of instances on a single host handed out for probing at any given time.
+// A non-positive value means no limit.
+func (this *discoveryQueue) SetMaxInFlightPerHost(maxInFlightPerHost int) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.maxInFlightPerHost = maxInFlightPerHost
+	this.cond.Broadcast()
+}
+
+// Push queues given instance key for discovery, unless it is already queued or being probed.
+// It never blocks.
+func (this *discoveryQueue) Push(instanceKey inst.InstanceKey) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.push(instanceKey, nil)
+}
+
+// PushTree queues given instance key for discovery as the root of a new discovery tree, which is returned.
+// See WaitTree.
+func (this *discoveryQueue) PushTree(instanceKey inst.InstanceKey) *discoveryTree {
+	this.Lock()
+	defer this.Unlock()
+
+	tree := &discoveryTree{visited: make(map[inst.InstanceKey]bool)}
+	this.push(instanceKey, []*discoveryTree{tree})
+	return tree
+}
+
+// push queues given instance key, and makes it part of given discovery trees, unless already visited by a tree.
+// The lock must be held.
+func (this *discoveryQueue) push(instanceKey inst.InstanceKey, trees []*discoveryTree) {
+	if !instanceKey.IsValid() {
+		return
+	}
+	for _, tree := range trees {
+		if !tree.visited[instanceKey] {
+			tree.visited[instanceKey] = true
+			tree.pending++
+			this.keyTrees[instanceKey] = append(this.keyTrees[instanceKey], tree)
+		}
+	}
+	if this.queuedKeys[instanceKey] || this.inFlightKeys[instanceKey] {
+		this.deduplicated++
+		return
+	}
+	this.keys = append(this.keys, instanceKey)
+	this.queuedKeys[instanceKey] = true
+	this.queued++
+	this.cond.Broadcast()
+}
+
+// Pop returns the first queued instance key whose host is not at its in-flight limit, and marks it in flight.
+// It blocks until such a key is available.
+func (this *discoveryQueue) Pop() inst.InstanceKey {
+	this.Lock()
+	defer this.Unlock()
+
+	for {
+		for i, instanceKey := range this.keys {
+			if this.maxInFlightPerHost > 0 && this.inFlightHosts[instanceKey.Hostname] >= this.maxInFlightPerHost {
+				continue
+			}
+			this.keys = append(this.keys[:i], this.keys[i+1:]...)
+			delete(this.queuedKeys, instanceKey)
+			this.inFlightKeys[instanceKey] = true
+			this.inFlightHosts[instanceKey.Hostname]++
+			return instanceKey
+		}
+		this.cond.Wait()
+	}
+}
+
+// Done marks given instance key, previously returned by Pop, as probed. The probe found followUpKeys (the instance's
+// master & slaves) to be discovered next; these are queued as part of the discovery trees of the probed instance.
+func (this *discoveryQueue) Done(instanceKey inst.InstanceKey, probeLatency time.Duration, followUpKeys []inst.InstanceKey) {
+	this.Lock()
+	defer this.Unlock()
+
+	trees := this.keyTrees[instanceKey]
+	delete(this.keyTrees, instanceKey)
+	for _, followUpKey := range followUpKeys {
+		this.push(followUpKey, trees)
+	}
+	for _, tree := range trees {
+		tree.pending--
+	}
+	delete(this.inFlightKeys, instanceKey)
+	this.inFlightHosts[instanceKey.Hostname]--
+	if this.inFlightHosts[instanceKey.Hostname] <= 0 {
+		delete(this.inFlightHosts, instanceKey.Hostname)
+	}
+	this.probed++
+	this.lastProbeLatency = probeLatency
+	this.totalProbeLatency += probeLatency
+	if probeLatency > this.maxProbeLatency {
+		this.maxProbeLatency = probeLatency
+	}
+	this.cond.Broadcast()
+}
+
+// WaitTree blocks until no instance of given discovery tree is queued nor being probed
+func (this *discoveryQueue) WaitTree(tree *discoveryTree) {
+	this.Lock()
+	defer this.Unlock()
+
+	for tree.pending > 0 {
+		this.cond.Wait()
+	}
+}
+
+// Metrics returns a snapshot of the queue's counters
+func (this *discoveryQueue) Metrics() DiscoveryMetrics {
+	this.Lock()
+	defer this.Unlock()
+
+	metrics := DiscoveryMetrics{
+		QueueDepth:             len(this.keys),
+		InFlight:               len(this.inFlightKeys),
+		InFlightHosts:          make(map[string]int),
+		Queued:                 this.queued,
+		Deduplicated:           this.deduplicated,
+		Probed:                 this.probed,
+		LastProbeLatencyMillis: int64(this.lastProbeLatency / time.Millisecond),
+		MaxProbeLatencyMillis:  int64(this.maxProbeLatency / time.Millisecond),
+	}
+	for hostname, count := range this.inFlightHosts {
+		metrics.InFlightHosts[hostname] = count
+	}
+	if this.probed > 0 {
+		metrics.AverageProbeLatencyMillis = int64(this.totalProbeLatency/time.Duration(this.probed)) / int64(time.Millisecond)
+	}
+	return metrics
+}
@@ -0,0 +1,174 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package orchestrator
+
+import (
+	"github.com/outbrain/orchestrator/inst"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+type DiscoveryQueueTestSuite struct{}
+
+var _ = Suite(&DiscoveryQueueTestSuite{})
+
+func discoveryQueueTestKey(hostname string, port int) inst.InstanceKey {
+	return inst.InstanceKey{Hostname: hostname, Port: port}
+}
+
+// popAsync pops a key from given queue in the background
+func popAsync(queue *discoveryQueue) chan inst.InstanceKey {
+	popped := make(chan inst.InstanceKey, 1)
+	go func() { popped <- queue.Pop() }()
+	return popped
+}
+
+// receiveWithin reports false if no key is popped within given timeout
+func receiveWithin(popped chan inst.InstanceKey, timeout time.Duration) (inst.InstanceKey, bool) {
+	select {
+	case instanceKey := <-popped:
+		return instanceKey, true
+	case <-time.After(timeout):
+		return inst.InstanceKey{}, false
+	}
+}
+
+// waitTreeWithin waits on given discovery tree, reporting false if it is not done within given timeout
+func waitTreeWithin(queue *discoveryQueue, tree *discoveryTree, timeout time.Duration) bool {
+	done := make(chan bool, 1)
+	go func() {
+		queue.WaitTree(tree)
+		done <- true
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (s *DiscoveryQueueTestSuite) TestDeduplicateQueuedAndInFlight(c *C) {
+	queue := newDiscoveryQueue()
+	key1 := discoveryQueueTestKey("host1", 3306)
+	key2 := discoveryQueueTestKey("host2", 3306)
+
+	queue.Push(key1)
+	queue.Push(key1)
+	queue.Push(key2)
+	queue.Push(inst.InstanceKey{})
+	c.Assert(queue.Metrics().QueueDepth, Equals, 2)
+
+	c.Assert(queue.Pop(), Equals, key1)
+	queue.Push(key1)
+	metrics := queue.Metrics()
+	c.Assert(metrics.QueueDepth, Equals, 1)
+	c.Assert(metrics.InFlight, Equals, 1)
+	c.Assert(metrics.Queued, Equals, int64(2))
+	c.Assert(metrics.Deduplicated, Equals, int64(2))
+
+	queue.Done(key1, time.Millisecond, nil)
+	queue.Push(key1)
+	c.Assert(queue.Metrics().QueueDepth, Equals, 2)
+}
+
+func (s *DiscoveryQueueTestSuite) TestMaxInFlightPerHost(c *C) {
+	queue := newDiscoveryQueue()
+	queue.SetMaxInFlightPerHost(1)
+	key1 := discoveryQueueTestKey("host1", 3306)
+	key2 := discoveryQueueTestKey("host1", 3307)
+	key3 := discoveryQueueTestKey("host2", 3306)
+	queue.Push(key1)
+	queue.Push(key2)
+	queue.Push(key3)
+
+	c.Assert(queue.Pop(), Equals, key1)
+	// host1 is at its limit; host2 is not held back
+	c.Assert(queue.Pop(), Equals, key3)
+	poppedKeys := popAsync(queue)
+	_, popped := receiveWithin(poppedKeys, 50*time.Millisecond)
+	c.Assert(popped, Equals, false)
+
+	queue.Done(key1, time.Millisecond, nil)
+	instanceKey, popped := receiveWithin(poppedKeys, time.Second)
+	c.Assert(popped, Equals, true)
+	c.Assert(instanceKey, Equals, key2)
+}
+
+func (s *DiscoveryQueueTestSuite) TestMetrics(c *C) {
+	queue := newDiscoveryQueue()
+	key1 := discoveryQueueTestKey("host1", 3306)
+	key2 := discoveryQueueTestKey("host1", 3307)
+	key3 := discoveryQueueTestKey("host2", 3306)
+	queue.Push(key1)
+	queue.Push(key2)
+	queue.Push(key3)
+	queue.Pop()
+	queue.Pop()
+
+	metrics := queue.Metrics()
+	c.Assert(metrics.QueueDepth, Equals, 1)
+	c.Assert(metrics.InFlight, Equals, 2)
+	c.Assert(metrics.InFlightHosts, DeepEquals, map[string]int{"host1": 2})
+
+	queue.Done(key1, 10*time.Millisecond, nil)
+	queue.Done(key2, 30*time.Millisecond, nil)
+	metrics = queue.Metrics()
+	c.Assert(metrics.InFlight, Equals, 0)
+	c.Assert(metrics.InFlightHosts, DeepEquals, map[string]int{})
+	c.Assert(metrics.Probed, Equals, int64(2))
+	c.Assert(metrics.LastProbeLatencyMillis, Equals, int64(30))
+	c.Assert(metrics.AverageProbeLatencyMillis, Equals, int64(20))
+	c.Assert(metrics.MaxProbeLatencyMillis, Equals, int64(30))
+}
+
+func (s *DiscoveryQueueTestSuite) TestWaitTreeIgnoresOtherDiscoveries(c *C) {
+	queue := newDiscoveryQueue()
+	masterKey := discoveryQueueTestKey("master", 3306)
+	slaveKey := discoveryQueueTestKey("slave", 3306)
+	otherKey := discoveryQueueTestKey("other", 3306)
+
+	queue.Push(otherKey)
+	tree := queue.PushTree(masterKey)
+	c.Assert(queue.Pop(), Equals, otherKey)
+	c.Assert(queue.Pop(), Equals, masterKey)
+
+	// Follow up keys extend the tree
+	queue.Done(masterKey, time.Millisecond, []inst.InstanceKey{slaveKey})
+	c.Assert(waitTreeWithin(queue, tree, 50*time.Millisecond), Equals, false)
+
+	c.Assert(queue.Pop(), Equals, slaveKey)
+	// The slave's master is already visited by the tree
+	queue.Done(slaveKey, time.Millisecond, []inst.InstanceKey{masterKey})
+	// otherKey is still being probed, and more instances keep being queued
+	queue.Push(discoveryQueueTestKey("another", 3306))
+	c.Assert(waitTreeWithin(queue, tree, time.Second), Equals, true)
+	c.Assert(queue.Metrics().InFlight, Equals, 1)
+}
+
+func (s *DiscoveryQueueTestSuite) TestWaitTreeOnInFlightInstance(c *C) {
+	queue := newDiscoveryQueue()
+	masterKey := discoveryQueueTestKey("master", 3306)
+
+	queue.Push(masterKey)
+	c.Assert(queue.Pop(), Equals, masterKey)
+	tree := queue.PushTree(masterKey)
+	c.Assert(waitTreeWithin(queue, tree, 50*time.Millisecond), Equals, false)
+
+	queue.Done(masterKey, time.Millisecond, nil)
+	c.Assert(waitTreeWithin(queue, tree, time.Second), Equals, true)
+}
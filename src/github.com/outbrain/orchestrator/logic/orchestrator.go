@@ -22,46 +22,87 @@ import (
 	"github.com/outbrain/orchestrator/agent"
 	"github.com/outbrain/orchestrator/config"
 	"github.com/outbrain/orchestrator/inst"
+	"sync"
 	"time"
 )
 
-const (
-	maxConcurrency = 5
-)
-
-// discoveryInstanceKeys is a channel of instanceKey-s that were requested for discovery.
+// discoveryInstanceKeys queues instance keys that were requested for discovery.
 // It can be continuously updated as discovery process progresses.
-var discoveryInstanceKeys chan inst.InstanceKey = make(chan inst.InstanceKey, maxConcurrency)
+var discoveryInstanceKeys = newDiscoveryQueue()
 
-// handleDiscoveryRequests iterates the discoveryInstanceKeys channel and calls upon
-// instance discovery per entry.
-func handleDiscoveryRequests(pendingTokens chan bool, completedTokens chan bool) {
-	for instanceKey := range discoveryInstanceKeys {
-		AccountedDiscoverInstance(instanceKey, pendingTokens, completedTokens)
-	}
+var discoveryWorkersOnce sync.Once
+
+// startDiscoveryWorkers starts (once) a fixed pool of workers, which probe the instances queued for discovery
+func startDiscoveryWorkers() {
+	discoveryWorkersOnce.Do(func() {
+		discoveryInstanceKeys.SetMaxInFlightPerHost(int(config.Config.DiscoveryMaxConcurrencyPerHost))
+		numWorkers := int(config.Config.DiscoveryMaxConcurrency)
+		if numWorkers <= 0 {
+			numWorkers = 1
+		}
+		log.Debugf("Starting %d discovery workers", numWorkers)
+		for i := 0; i < numWorkers; i++ {
+			go handleDiscoveryRequests()
+		}
+	})
 }
 
-// AccountedDiscoverInstance will call upon DiscoverInstance and will keep track of
-// discovery tokens such that management of multiple discoveries can figure out
-// whether all instances in a topology are accounted for.
-func AccountedDiscoverInstance(instanceKey inst.InstanceKey, pendingTokens chan bool, completedTokens chan bool) {
-	if pendingTokens != nil {
-		pendingTokens <- true
+// pseudoGTIDIndexUpdatesInProgress lists instances currently being indexed, so that a lengthy indexing
+// is not kicked off again by the next discovery of the same instance.
+var pseudoGTIDIndexUpdatesInProgress = make(map[inst.InstanceKey]bool)
+var pseudoGTIDIndexUpdatesMutex = &sync.Mutex{}
+
+// updatePseudoGTIDIndex updates the pseudo-GTID index of given instance, unless already being updated
+func updatePseudoGTIDIndex(instance *inst.Instance) {
+	pseudoGTIDIndexUpdatesMutex.Lock()
+	if pseudoGTIDIndexUpdatesInProgress[instance.Key] {
+		pseudoGTIDIndexUpdatesMutex.Unlock()
+		return
 	}
-	go func() {
-		DiscoverInstance(instanceKey)
-		if completedTokens != nil {
-			completedTokens <- true
-		}
+	pseudoGTIDIndexUpdatesInProgress[instance.Key] = true
+	pseudoGTIDIndexUpdatesMutex.Unlock()
+
+	defer func() {
+		pseudoGTIDIndexUpdatesMutex.Lock()
+		defer pseudoGTIDIndexUpdatesMutex.Unlock()
+		delete(pseudoGTIDIndexUpdatesInProgress, instance.Key)
 	}()
+
+	if err := inst.UpdatePseudoGTIDIndex(instance); err != nil {
+		log.Errorf("Failed updating pseudo gtid index of %+v: %+v", instance.Key, err)
+	}
+}
+
+// handleDiscoveryRequests takes instance keys off the discovery queue and calls upon instance discovery per entry
+func handleDiscoveryRequests() {
+	for {
+		instanceKey := discoveryInstanceKeys.Pop()
+		func() {
+			startTime := time.Now()
+			followUpKeys := []inst.InstanceKey{}
+			defer func() {
+				if err := recover(); err != nil {
+					log.Errorf("Unexpected error discovering %+v: %+v", instanceKey, err)
+				}
+				discoveryInstanceKeys.Done(instanceKey, time.Since(startTime), followUpKeys)
+			}()
+			followUpKeys = DiscoverInstance(instanceKey)
+		}()
+	}
+}
+
+// ReadDiscoveryMetrics returns the current counters of the discovery process
+func ReadDiscoveryMetrics() DiscoveryMetrics {
+	return discoveryInstanceKeys.Metrics()
 }
 
 // DiscoverInstance will attempt discovering an instance (unless it is already up to date) and will
 // list down its master and slaves (if any) for further discovery.
-func DiscoverInstance(instanceKey inst.InstanceKey) {
+func DiscoverInstance(instanceKey inst.InstanceKey) (followUpKeys []inst.InstanceKey) {
+	followUpKeys = []inst.InstanceKey{}
 	instanceKey.Formalize()
 	if !instanceKey.IsValid() {
-		return
+		return followUpKeys
 	}
 
 	instance, found, err := inst.ReadInstance(&instanceKey)
@@ -71,7 +112,7 @@ func DiscoverInstance(instanceKey inst.InstanceKey) {
 		goto Cleanup
 	}
 	// First we've ever heard of this instance. Continue investigation:
-	instance, err = inst.ReadTopologyInstance(&instanceKey)
+	instance, err = inst.PollTopologyInstance(&instanceKey)
 	// panic can occur (IO stuff). Therefore it may happen
 	// that instance is nil. Check it.
 	if err != nil || instance == nil {
@@ -81,14 +122,24 @@ func DiscoverInstance(instanceKey inst.InstanceKey) {
 
 	fmt.Printf("host: %+v, master: %+v\n", instance.Key, instance.MasterKey)
 
-	// Investigate slaves:
-	for _, slaveKey := range instance.SlaveHosts.GetInstanceKeys() {
-		discoveryInstanceKeys <- slaveKey
+	if config.Config.PseudoGTIDIndexEnabled && config.Config.PseudoGTIDPattern != "" && instance.LogBinEnabled {
+		// Indexing may scan entire binary logs; it runs off the discovery path.
+		// Failure to index is not a discovery failure; match-below will fall back to scanning binary logs
+		go updatePseudoGTIDIndex(instance)
 	}
+
+	if config.Config.ErrantTransactionsCheckEnabled && config.Config.PseudoGTIDPattern != "" && instance.IsSlave() && instance.HasReplicatedEventsInBinlogs() {
+		// An inconclusive check keeps the previous outcome
+		inst.CheckErrantTransactions(instance)
+	}
+
+	// Investigate slaves:
+	followUpKeys = append(followUpKeys, instance.SlaveHosts.GetInstanceKeys()...)
 	// Investigate master:
-	discoveryInstanceKeys <- instance.MasterKey
+	followUpKeys = append(followUpKeys, instance.MasterKey)
 
 Cleanup:
+	return followUpKeys
 }
 
 // Start discovery begins a one time asynchronuous discovery process for the given
@@ -97,45 +148,41 @@ Cleanup:
 // each and every such found master/slave.
 // In essense, assuming all slaves in a replication topology are running, and given a single instance
 // in such topology, this function will detect the entire topology.
+// The function returns once there is no further instance pending discovery.
 func StartDiscovery(instanceKey inst.InstanceKey) {
 	log.Infof("Starting discovery at %+v", instanceKey)
-	pendingTokens := make(chan bool, maxConcurrency)
-	completedTokens := make(chan bool, maxConcurrency)
+	startDiscoveryWorkers()
+	tree := discoveryInstanceKeys.PushTree(instanceKey)
 
-	AccountedDiscoverInstance(instanceKey, pendingTokens, completedTokens)
-	go handleDiscoveryRequests(pendingTokens, completedTokens)
-
-	// Block until all are complete
-	for {
-		select {
-		case <-pendingTokens:
-			<-completedTokens
-		default:
-			inst.AuditOperation("start-discovery", &instanceKey, "")
-			return
-		}
-	}
+	// Block until all of this topology is discovered. Other discoveries (e.g. continuous discovery) may be going on.
+	discoveryInstanceKeys.WaitTree(tree)
+	inst.AuditOperation("start-discovery", &instanceKey, "")
 }
 
 // ContinuousDiscovery starts an asynchronuous infinite discovery process where instances are
 // periodically investigated and their status captured, and long since unseen instances are
-// purged and forgotten.
+// purged and forgotten. Failed masters are recovered on clusters configured for automated recovery,
+// and pseudo-GTID entries are injected on masters when so configured.
 func ContinuousDiscovery() {
 	log.Infof("Starting continuous discovery")
 	inst.SetContinuousDBWrites()
-	go handleDiscoveryRequests(nil, nil)
+	startDiscoveryWorkers()
+	go ContinuousPseudoGTIDInjection()
 	tick := time.Tick(time.Duration(config.Config.DiscoveryPollSeconds) * time.Second)
 	forgetUnseenTick := time.Tick(time.Minute)
 	for _ = range tick {
 		instanceKeys, _ := inst.ReadOutdatedInstanceKeys()
 		log.Debugf("outdated keys: %+v", instanceKeys)
 		for _, instanceKey := range instanceKeys {
-			discoveryInstanceKeys <- instanceKey
+			discoveryInstanceKeys.Push(instanceKey)
 		}
+		go CheckAndRecover()
+		go CheckAndNotifyProblems()
 		// See if we should also forget objects (lower frequency)
 		select {
 		case <-forgetUnseenTick:
 			inst.ForgetLongUnseenInstances()
+			inst.PurgeInstanceHistory()
 			inst.ForgetExpiredHostnameResolves()
 		default:
 		}
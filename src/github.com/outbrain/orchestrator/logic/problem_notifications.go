@@ -0,0 +1,364 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package orchestrator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/inst"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Problem notification events
+const (
+	ProblemOpened   = "opened"
+	ProblemResolved = "resolved"
+)
+
+// ProblemNotification tells that a problem was found on an instance, or that a previously found problem
+// is gone. Problem names are those presented by the web interface (e.g. "not_replicating")
+type ProblemNotification struct {
+	Event       string
+	Problem     string
+	Key         inst.InstanceKey
+	ClusterName string
+	Timestamp   string
+}
+
+// ProblemNotificationsPayload is the JSON document POSTed to webhooks: the notifications of a single cluster
+type ProblemNotificationsPayload struct {
+	ClusterName   string
+	Notifications []ProblemNotification
+}
+
+// problemNotificationSink is a destination of problem notifications
+type problemNotificationSink interface {
+	Notify(payload *ProblemNotificationsPayload) error
+}
+
+// webhookSink POSTs notifications as JSON to a URL
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(url string, timeout time.Duration) *webhookSink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (this *webhookSink) Notify(payload *ProblemNotificationsPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	response, err := this.client.Post(this.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("webhook %s responded with status %d", this.url, response.StatusCode))
+	}
+	return nil
+}
+
+// smtpSink mails notifications as plain text via an SMTP server. The whole SMTP session is bounded by timeout.
+type smtpSink struct {
+	server  string
+	from    string
+	to      []string
+	timeout time.Duration
+}
+
+func (this *smtpSink) Notify(payload *ProblemNotificationsPayload) error {
+	lines := []string{}
+	for _, notification := range payload.Notifications {
+		lines = append(lines, fmt.Sprintf("%s %s: %s %s", notification.Timestamp, notification.Key.DisplayString(), notification.Problem, notification.Event))
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: orchestrator: %d problem notifications on cluster %s\r\n\r\n%s\r\n",
+		this.from, strings.Join(this.to, ", "), len(payload.Notifications), payload.ClusterName, strings.Join(lines, "\r\n"))
+
+	conn, err := net.DialTimeout("tcp", this.server, this.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(this.timeout)); err != nil {
+		return err
+	}
+	host, _, err := net.SplitHostPort(this.server)
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(this.from); err != nil {
+		return err
+	}
+	for _, to := range this.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// instanceProblems lists the problems of an instance, in the terms and order of the web interface
+func instanceProblems(instance *inst.Instance) []string {
+	problems := []string{}
+	if !instance.IsLastCheckValid {
+		problems = append(problems, "last_check_invalid")
+	}
+	if !instance.IsRecentlyChecked {
+		problems = append(problems, "not_recently_checked")
+	}
+	if instance.IsSlave() && !instance.SlaveRunning() {
+		problems = append(problems, "not_replicating")
+	}
+	if instance.SlaveLagSeconds.Valid && instance.SlaveLagSeconds.Int64 > int64(config.Config.ReasonableReplicationLagSeconds) {
+		problems = append(problems, "replication_lag")
+	}
+	if instance.HasErrantTransactions {
+		problems = append(problems, "errant_transactions")
+	}
+	return problems
+}
+
+// problemNotificationState keeps track of the problems notified as open to a single sink, so that each problem is
+// notified once when found and once when resolved. Notifications are sent per cluster, no more than once per interval;
+// notifications held back, or which failed to be delivered, are reconsidered on the next evaluation.
+type problemNotificationState struct {
+	clusterInterval          time.Duration
+	openProblems             map[string]ProblemNotification
+	lastClusterNotifications map[string]time.Time
+}
+
+func newProblemNotificationState(clusterInterval time.Duration) *problemNotificationState {
+	return &problemNotificationState{
+		clusterInterval:          clusterInterval,
+		openProblems:             make(map[string]ProblemNotification),
+		lastClusterNotifications: make(map[string]time.Time),
+	}
+}
+
+func problemNotificationKey(instanceKey *inst.InstanceKey, problem string) string {
+	return fmt.Sprintf("%s/%s", instanceKey.DisplayString(), problem)
+}
+
+// currentProblems lists the problems of given problem instances, as would be notified when opened. Instances under
+// maintenance are ignored.
+func currentProblems(problemInstances [](*inst.Instance), maintenanceKeys inst.InstanceKeyMap, now time.Time) map[string]ProblemNotification {
+	timestamp := now.Format("2006-01-02 15:04:05")
+	problems := make(map[string]ProblemNotification)
+	for _, instance := range problemInstances {
+		if maintenanceKeys[instance.Key] {
+			continue
+		}
+		for _, problem := range instanceProblems(instance) {
+			problems[problemNotificationKey(&instance.Key, problem)] = ProblemNotification{
+				Event:       ProblemOpened,
+				Problem:     problem,
+				Key:         instance.Key,
+				ClusterName: instance.ClusterName,
+				Timestamp:   timestamp,
+			}
+		}
+	}
+	return problems
+}
+
+// evaluate compares given current problems with the problems notified as open, and returns, per cluster, the
+// notifications due to be sent now. Problems of instances under maintenance are neither opened nor resolved.
+// The state is unchanged; see delivered.
+func (this *problemNotificationState) evaluate(problems map[string]ProblemNotification, maintenanceKeys inst.InstanceKeyMap, now time.Time) map[string][]ProblemNotification {
+	timestamp := now.Format("2006-01-02 15:04:05")
+	pending := make(map[string]map[string]ProblemNotification)
+	addPending := func(key string, notification ProblemNotification) {
+		if _, found := pending[notification.ClusterName]; !found {
+			pending[notification.ClusterName] = make(map[string]ProblemNotification)
+		}
+		pending[notification.ClusterName][key] = notification
+	}
+	for key, notification := range problems {
+		if _, found := this.openProblems[key]; !found {
+			addPending(key, notification)
+		}
+	}
+	for key, notification := range this.openProblems {
+		if _, found := problems[key]; found || maintenanceKeys[notification.Key] {
+			continue
+		}
+		notification.Event = ProblemResolved
+		notification.Timestamp = timestamp
+		addPending(key, notification)
+	}
+
+	due := make(map[string][]ProblemNotification)
+	for clusterName, clusterNotifications := range pending {
+		if lastNotification, found := this.lastClusterNotifications[clusterName]; found && now.Sub(lastNotification) < this.clusterInterval {
+			log.Debugf("Holding back %d problem notifications on cluster %s", len(clusterNotifications), clusterName)
+			continue
+		}
+		keys := []string{}
+		for key := range clusterNotifications {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			due[clusterName] = append(due[clusterName], clusterNotifications[key])
+		}
+	}
+	return due
+}
+
+// delivered updates the open problems with given notifications of a cluster, once sent
+func (this *problemNotificationState) delivered(clusterName string, notifications []ProblemNotification, now time.Time) {
+	for _, notification := range notifications {
+		key := problemNotificationKey(&notification.Key, notification.Problem)
+		if notification.Event == ProblemOpened {
+			this.openProblems[key] = notification
+		} else {
+			delete(this.openProblems, key)
+		}
+	}
+	this.lastClusterNotifications[clusterName] = now
+}
+
+// problemNotifier sends problem notifications to sinks, keeping a notification state per sink, so that a failing
+// sink is retried without the others being notified twice.
+// State is kept in memory: upon startup, currently existing problems are notified as opened.
+type problemNotifier struct {
+	sinks  []problemNotificationSink
+	states []*problemNotificationState
+	mutex  sync.Mutex
+}
+
+func newProblemNotifier(sinks []problemNotificationSink, clusterInterval time.Duration) *problemNotifier {
+	notifier := &problemNotifier{sinks: sinks}
+	for range sinks {
+		notifier.states = append(notifier.states, newProblemNotificationState(clusterInterval))
+	}
+	return notifier
+}
+
+// notifyProblems evaluates given problem instances and sends the due notifications to all sinks.
+// A failing sink does not prevent the others from being notified; its notifications are kept pending, to be
+// retried on the next call. The last error is returned.
+func (this *problemNotifier) notifyProblems(problemInstances [](*inst.Instance), maintenanceKeys inst.InstanceKeyMap) error {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	var err error
+	now := time.Now()
+	problems := currentProblems(problemInstances, maintenanceKeys, now)
+	for i, sink := range this.sinks {
+		state := this.states[i]
+		for clusterName, notifications := range state.evaluate(problems, maintenanceKeys, now) {
+			payload := &ProblemNotificationsPayload{ClusterName: clusterName, Notifications: notifications}
+			if sinkErr := sink.Notify(payload); sinkErr != nil {
+				err = log.Errorf("Failed sending %d problem notifications on cluster %s, will retry: %+v", len(notifications), clusterName, sinkErr)
+				continue
+			}
+			state.delivered(clusterName, notifications, now)
+		}
+	}
+	return err
+}
+
+var problemNotifierInstance *problemNotifier
+var problemNotifierOnce sync.Once
+var problemNotificationsInProgress int32
+
+// getProblemNotifier returns the notifier configured with webhooks & SMTP server, or nil if none is configured
+func getProblemNotifier() *problemNotifier {
+	problemNotifierOnce.Do(func() {
+		timeout := time.Duration(config.Config.ProblemNotificationTimeoutSeconds) * time.Second
+		sinks := []problemNotificationSink{}
+		for _, url := range config.Config.ProblemNotificationWebhooks {
+			sinks = append(sinks, newWebhookSink(url, timeout))
+		}
+		if config.Config.ProblemNotificationSMTPServer != "" && len(config.Config.ProblemNotificationMailTo) > 0 {
+			sinks = append(sinks, &smtpSink{
+				server:  config.Config.ProblemNotificationSMTPServer,
+				from:    config.Config.ProblemNotificationMailFrom,
+				to:      config.Config.ProblemNotificationMailTo,
+				timeout: timeout,
+			})
+		}
+		if len(sinks) > 0 {
+			problemNotifierInstance = newProblemNotifier(sinks, time.Duration(config.Config.ProblemNotificationClusterIntervalSeconds)*time.Second)
+		}
+	})
+	return problemNotifierInstance
+}
+
+// CheckAndNotifyProblems reads the current problem instances and notifies webhooks and mail recipients of
+// problems opened and resolved since last check. It is a no-op while a previous check is still in progress.
+func CheckAndNotifyProblems() error {
+	notifier := getProblemNotifier()
+	if notifier == nil {
+		return nil
+	}
+	if !atomic.CompareAndSwapInt32(&problemNotificationsInProgress, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&problemNotificationsInProgress, 0)
+
+	problemInstances, err := inst.ReadProblemInstances()
+	if err != nil {
+		return log.Errore(err)
+	}
+	maintenances, err := inst.ReadActiveMaintenance()
+	if err != nil {
+		return log.Errore(err)
+	}
+	maintenanceKeys := make(inst.InstanceKeyMap)
+	for _, maintenance := range maintenances {
+		maintenanceKeys[maintenance.Key] = true
+	}
+	return notifier.notifyProblems(problemInstances, maintenanceKeys)
+}
@@ -0,0 +1,224 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package orchestrator
+
+import (
+	"encoding/json"
+	"github.com/outbrain/orchestrator/inst"
+	. "gopkg.in/check.v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+// webhookStandIn is a local HTTP server collecting the payloads POSTed to it
+type webhookStandIn struct {
+	server   *httptest.Server
+	status   int
+	payloads []ProblemNotificationsPayload
+	mutex    sync.Mutex
+}
+
+func newWebhookStandIn(status int) *webhookStandIn {
+	standIn := &webhookStandIn{status: status, payloads: []ProblemNotificationsPayload{}}
+	standIn.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		payload := ProblemNotificationsPayload{}
+		standIn.mutex.Lock()
+		defer standIn.mutex.Unlock()
+		if err := json.NewDecoder(req.Body).Decode(&payload); err == nil {
+			standIn.payloads = append(standIn.payloads, payload)
+		}
+		w.WriteHeader(standIn.status)
+	}))
+	return standIn
+}
+
+func (this *webhookStandIn) setStatus(status int) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	this.status = status
+}
+
+func (this *webhookStandIn) notifications() []ProblemNotification {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	notifications := []ProblemNotification{}
+	for _, payload := range this.payloads {
+		notifications = append(notifications, payload.Notifications...)
+	}
+	return notifications
+}
+
+func notificationTestInstance(hostname string, clusterName string, replicating bool) *inst.Instance {
+	instance := inst.NewInstance()
+	instance.Key = inst.InstanceKey{Hostname: hostname, Port: 3306}
+	instance.ClusterName = clusterName
+	instance.MasterKey = inst.InstanceKey{Hostname: "master-" + clusterName, Port: 3306}
+	instance.ReadBinlogCoordinates = inst.BinlogCoordinates{LogFile: "mysql-bin.000012", LogPos: 1024}
+	instance.Slave_IO_Running = replicating
+	instance.Slave_SQL_Running = replicating
+	instance.IsLastCheckValid = true
+	instance.IsRecentlyChecked = true
+	return instance
+}
+
+type ProblemNotificationsTestSuite struct{}
+
+var _ = Suite(&ProblemNotificationsTestSuite{})
+
+func (s *ProblemNotificationsTestSuite) TestOpenedAndResolvedNotifiedOnce(c *C) {
+	standIn := newWebhookStandIn(http.StatusOK)
+	defer standIn.server.Close()
+	notifier := newProblemNotifier([]problemNotificationSink{newWebhookSink(standIn.server.URL, time.Second)}, 0)
+
+	broken := notificationTestInstance("s1", "c1", false)
+	c.Assert(notifier.notifyProblems([](*inst.Instance){broken}, inst.InstanceKeyMap{}), IsNil)
+	c.Assert(notifier.notifyProblems([](*inst.Instance){broken}, inst.InstanceKeyMap{}), IsNil)
+	notifications := standIn.notifications()
+	c.Assert(len(notifications), Equals, 1)
+	c.Assert(notifications[0].Event, Equals, ProblemOpened)
+	c.Assert(notifications[0].Problem, Equals, "not_replicating")
+	c.Assert(notifications[0].Key, Equals, broken.Key)
+	c.Assert(notifications[0].ClusterName, Equals, "c1")
+
+	c.Assert(notifier.notifyProblems([](*inst.Instance){}, inst.InstanceKeyMap{}), IsNil)
+	c.Assert(notifier.notifyProblems([](*inst.Instance){}, inst.InstanceKeyMap{}), IsNil)
+	notifications = standIn.notifications()
+	c.Assert(len(notifications), Equals, 2)
+	c.Assert(notifications[1].Event, Equals, ProblemResolved)
+	c.Assert(notifications[1].Problem, Equals, "not_replicating")
+}
+
+func (s *ProblemNotificationsTestSuite) TestMaintenanceSuppressesNotifications(c *C) {
+	standIn := newWebhookStandIn(http.StatusOK)
+	defer standIn.server.Close()
+	notifier := newProblemNotifier([]problemNotificationSink{newWebhookSink(standIn.server.URL, time.Second)}, 0)
+
+	broken := notificationTestInstance("s1", "c1", false)
+	maintenanceKeys := inst.InstanceKeyMap{broken.Key: true}
+	c.Assert(notifier.notifyProblems([](*inst.Instance){broken}, maintenanceKeys), IsNil)
+	c.Assert(len(standIn.notifications()), Equals, 0)
+
+	c.Assert(notifier.notifyProblems([](*inst.Instance){broken}, inst.InstanceKeyMap{}), IsNil)
+	c.Assert(len(standIn.notifications()), Equals, 1)
+
+	// Resolving while under maintenance goes unnoticed until maintenance ends
+	c.Assert(notifier.notifyProblems([](*inst.Instance){}, maintenanceKeys), IsNil)
+	c.Assert(len(standIn.notifications()), Equals, 1)
+	c.Assert(notifier.notifyProblems([](*inst.Instance){}, inst.InstanceKeyMap{}), IsNil)
+	c.Assert(len(standIn.notifications()), Equals, 2)
+}
+
+func (s *ProblemNotificationsTestSuite) TestClusterRateLimit(c *C) {
+	state := newProblemNotificationState(time.Minute)
+	now := time.Now()
+	evaluateAndDeliver := func(problemInstances [](*inst.Instance), now time.Time) map[string][]ProblemNotification {
+		due := state.evaluate(currentProblems(problemInstances, inst.InstanceKeyMap{}, now), inst.InstanceKeyMap{}, now)
+		for clusterName, notifications := range due {
+			state.delivered(clusterName, notifications, now)
+		}
+		return due
+	}
+
+	due := evaluateAndDeliver([](*inst.Instance){notificationTestInstance("s1", "c1", false)}, now)
+	c.Assert(len(due["c1"]), Equals, 1)
+
+	problemInstances := [](*inst.Instance){notificationTestInstance("s1", "c1", false), notificationTestInstance("s2", "c1", false), notificationTestInstance("s3", "c2", false)}
+	due = evaluateAndDeliver(problemInstances, now.Add(10*time.Second))
+	c.Assert(len(due["c1"]), Equals, 0)
+	c.Assert(len(due["c2"]), Equals, 1)
+
+	// Held back notifications are sent once the interval has passed
+	due = evaluateAndDeliver(problemInstances, now.Add(time.Minute))
+	c.Assert(len(due["c1"]), Equals, 1)
+	c.Assert(due["c1"][0].Key.Hostname, Equals, "s2")
+	c.Assert(len(due["c2"]), Equals, 0)
+}
+
+func (s *ProblemNotificationsTestSuite) TestUndeliveredNotificationsKeptPending(c *C) {
+	state := newProblemNotificationState(time.Minute)
+	now := time.Now()
+	problems := currentProblems([](*inst.Instance){notificationTestInstance("s1", "c1", false)}, inst.InstanceKeyMap{}, now)
+
+	c.Assert(len(state.evaluate(problems, inst.InstanceKeyMap{}, now)["c1"]), Equals, 1)
+	// Not delivered: neither opened nor rate limited
+	due := state.evaluate(problems, inst.InstanceKeyMap{}, now.Add(time.Second))
+	c.Assert(len(due["c1"]), Equals, 1)
+
+	state.delivered("c1", due["c1"], now.Add(time.Second))
+	c.Assert(len(state.evaluate(problems, inst.InstanceKeyMap{}, now.Add(2*time.Minute))), Equals, 0)
+}
+
+func (s *ProblemNotificationsTestSuite) TestFailingWebhook(c *C) {
+	failing := newWebhookStandIn(http.StatusInternalServerError)
+	defer failing.server.Close()
+	standIn := newWebhookStandIn(http.StatusOK)
+	defer standIn.server.Close()
+	sinks := []problemNotificationSink{newWebhookSink(failing.server.URL, time.Second), newWebhookSink(standIn.server.URL, time.Second)}
+	notifier := newProblemNotifier(sinks, 0)
+
+	problemInstances := [](*inst.Instance){notificationTestInstance("s1", "c1", false)}
+	err := notifier.notifyProblems(problemInstances, inst.InstanceKeyMap{})
+	c.Assert(err, NotNil)
+	c.Assert(len(failing.notifications()), Equals, 1)
+	c.Assert(len(standIn.notifications()), Equals, 1)
+
+	// The failed notification is retried, without notifying the other webhook again
+	c.Assert(notifier.notifyProblems(problemInstances, inst.InstanceKeyMap{}), NotNil)
+	c.Assert(len(failing.notifications()), Equals, 2)
+	failing.setStatus(http.StatusOK)
+	c.Assert(notifier.notifyProblems(problemInstances, inst.InstanceKeyMap{}), IsNil)
+	c.Assert(len(failing.notifications()), Equals, 3)
+	c.Assert(notifier.notifyProblems(problemInstances, inst.InstanceKeyMap{}), IsNil)
+	c.Assert(len(failing.notifications()), Equals, 3)
+	c.Assert(len(standIn.notifications()), Equals, 1)
+}
+
+func (s *ProblemNotificationsTestSuite) TestUnresponsiveSMTPServerTimesOut(c *C) {
+	// Accepts connections, never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	sink := &smtpSink{server: listener.Addr().String(), from: "orchestrator", to: []string{"dba@localhost"}, timeout: 100 * time.Millisecond}
+	notified := make(chan error, 1)
+	go func() {
+		notified <- sink.Notify(&ProblemNotificationsPayload{ClusterName: "c1"})
+	}()
+	timedOut := false
+	select {
+	case err = <-notified:
+	case <-time.After(5 * time.Second):
+		timedOut = true
+	}
+	c.Assert(timedOut, Equals, false)
+	c.Assert(err, NotNil)
+}
@@ -0,0 +1,138 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/inst"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PseudoGTIDInjectionStatus reports the health of pseudo-GTID injection on a single master
+type PseudoGTIDInjectionStatus struct {
+	Key                 inst.InstanceKey
+	LastAttemptAt       string
+	LastInjectedAt      string
+	LastError           string
+	SkipReason          string
+	CountInjections     int64
+	CountFailedAttempts int64
+}
+
+// pseudoGTIDInjectionStatuses maps masters to the status of injection on each, as of this orchestrator process
+var pseudoGTIDInjectionStatuses = make(map[inst.InstanceKey]*PseudoGTIDInjectionStatus)
+var pseudoGTIDInjectionMutex = &sync.Mutex{}
+
+// ReadPseudoGTIDInjectionStatus returns the injection status of given instance, if any injection has been attempted on it
+func ReadPseudoGTIDInjectionStatus(instanceKey *inst.InstanceKey) (PseudoGTIDInjectionStatus, bool) {
+	pseudoGTIDInjectionMutex.Lock()
+	defer pseudoGTIDInjectionMutex.Unlock()
+
+	status, found := pseudoGTIDInjectionStatuses[*instanceKey]
+	if !found {
+		return PseudoGTIDInjectionStatus{}, false
+	}
+	return *status, true
+}
+
+// updatePseudoGTIDInjectionStatus notes down the outcome of an injection attempt on given master:
+// either skipped for given reason, failed with given error, or successful
+func updatePseudoGTIDInjectionStatus(instanceKey *inst.InstanceKey, skipReason string, err error) {
+	pseudoGTIDInjectionMutex.Lock()
+	defer pseudoGTIDInjectionMutex.Unlock()
+
+	status, found := pseudoGTIDInjectionStatuses[*instanceKey]
+	if !found {
+		status = &PseudoGTIDInjectionStatus{Key: *instanceKey}
+		pseudoGTIDInjectionStatuses[*instanceKey] = status
+	}
+	now := time.Now().Format(log.TimeFormat)
+	status.LastAttemptAt = now
+	status.SkipReason = skipReason
+	if skipReason != "" {
+		return
+	}
+	if err != nil {
+		status.LastError = err.Error()
+		status.CountFailedAttempts++
+		return
+	}
+	status.LastError = ""
+	status.LastInjectedAt = now
+	status.CountInjections++
+}
+
+// injectPseudoGTID writes a unique pseudo-GTID entry on given master, unless the master is read-only or in maintenance.
+func injectPseudoGTID(master *inst.Instance) error {
+	if master.ReadOnly {
+		updatePseudoGTIDInjectionStatus(&master.Key, "read-only", nil)
+		return nil
+	}
+	if inMaintenance, err := inst.InMaintenance(&master.Key); err != nil {
+		updatePseudoGTIDInjectionStatus(&master.Key, "", err)
+		return err
+	} else if inMaintenance {
+		updatePseudoGTIDInjectionStatus(&master.Key, "in maintenance", nil)
+		return nil
+	}
+
+	uniqueId := fmt.Sprintf("%016x:%08x", time.Now().UnixNano(), master.ServerID)
+	statement := strings.Replace(config.Config.PseudoGTIDInjectionStatement, "{uniqueId}", uniqueId, -1)
+	_, err := inst.ExecInstance(&master.Key, statement)
+	updatePseudoGTIDInjectionStatus(&master.Key, "", err)
+	if err != nil {
+		return log.Errore(errors.New(fmt.Sprintf("Failed injecting pseudo-GTID on %+v: %+v", master.Key, err)))
+	}
+	log.Debugf("Injected pseudo-GTID on %+v: %s", master.Key, uniqueId)
+	return nil
+}
+
+// InjectPseudoGTIDOnMasters injects a pseudo-GTID entry on all known masters of clusters configured for injection
+func InjectPseudoGTIDOnMasters() {
+	masters, err := inst.ReadMasterInstances()
+	if err != nil {
+		log.Errore(err)
+		return
+	}
+	for _, master := range masters {
+		if !master.IsLastCheckValid {
+			continue
+		}
+		if !clusterMatchesFilters(master.ClusterName, config.Config.PseudoGTIDInjectionClusterFilters) {
+			continue
+		}
+		go injectPseudoGTID(master)
+	}
+}
+
+// ContinuousPseudoGTIDInjection starts an asynchronuous infinite process where pseudo-GTID entries are
+// periodically injected on masters. It does nothing when PseudoGTIDInjectionIntervalSeconds is not set.
+func ContinuousPseudoGTIDInjection() {
+	if config.Config.PseudoGTIDInjectionIntervalSeconds == 0 {
+		return
+	}
+	log.Infof("Starting continuous pseudo-GTID injection")
+	tick := time.Tick(time.Duration(config.Config.PseudoGTIDInjectionIntervalSeconds) * time.Second)
+	for _ = range tick {
+		InjectPseudoGTIDOnMasters()
+	}
+}
@@ -0,0 +1,483 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package orchestrator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/inst"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// TopologyRecovery represents an automated or manual promotion, as recorded in the recovery history
+type TopologyRecovery struct {
+	Id                     int64
+	FailedInstanceKey      inst.InstanceKey
+	ClusterName            string
+	RecoveryType           string
+	IsAutomated            bool
+	RecoveryStartTimestamp string
+	RecoveryEndTimestamp   string
+	SuccessorKey           inst.InstanceKey
+	AffectedSlaveKeys      [](inst.InstanceKey)
+	IsSuccessful           bool
+	Acknowledged           bool
+	AcknowledgedAt         string
+	AcknowledgedBy         string
+	AcknowledgedComment    string
+}
+
+// NewTopologyRecovery creates a recovery entry for given failed instance
+func NewTopologyRecovery(recoveryType string, isAutomated bool, failedInstanceKey inst.InstanceKey, clusterName string) *TopologyRecovery {
+	return &TopologyRecovery{
+		FailedInstanceKey: failedInstanceKey,
+		ClusterName:       clusterName,
+		RecoveryType:      recoveryType,
+		IsAutomated:       isAutomated,
+		AffectedSlaveKeys: [](inst.InstanceKey){},
+	}
+}
+
+// setOutcome notes down the result of the recovery: the successor instance, the slaves of the failed
+// instance other than the successor, and whether the recovery succeeded.
+func (this *TopologyRecovery) setOutcome(successorKey *inst.InstanceKey, slaves [](*inst.Instance), err error) {
+	if successorKey != nil {
+		this.SuccessorKey = *successorKey
+	}
+	for _, slave := range slaves {
+		if !slave.Key.Equals(&this.SuccessorKey) {
+			this.AffectedSlaveKeys = append(this.AffectedSlaveKeys, slave.Key)
+		}
+	}
+	this.IsSuccessful = (err == nil)
+}
+
+// recoveriesInProgress lists clusters currently under recovery, so that a recovery is not
+// kicked off twice on the same cluster.
+var recoveriesInProgress = make(map[string]bool)
+var recoveriesMutex = &sync.Mutex{}
+
+// beginClusterRecovery marks given cluster as being recovered. It returns an error if the cluster
+// is already being recovered, or if it has been recently recovered and that recovery is yet unacknowledged.
+func beginClusterRecovery(clusterName string) error {
+	recoveriesMutex.Lock()
+	defer recoveriesMutex.Unlock()
+
+	if recoveriesInProgress[clusterName] {
+		return errors.New(fmt.Sprintf("Recovery already in progress on cluster %s", clusterName))
+	}
+	blockingRecoveries, err := ReadBlockingRecoveries(clusterName)
+	if err != nil {
+		return err
+	}
+	if len(blockingRecoveries) > 0 {
+		return errors.New(fmt.Sprintf("Cluster %s has been recovered at %s (recovery id %d); will not recover again within %d minutes unless recovery is acknowledged", clusterName, blockingRecoveries[0].RecoveryStartTimestamp, blockingRecoveries[0].Id, config.Config.RecoveryPeriodBlockMinutes))
+	}
+	recoveriesInProgress[clusterName] = true
+	return nil
+}
+
+// endClusterRecovery marks given cluster as no longer being recovered
+func endClusterRecovery(clusterName string) {
+	recoveriesMutex.Lock()
+	defer recoveriesMutex.Unlock()
+
+	delete(recoveriesInProgress, clusterName)
+}
+
+// clusterMatchesFilters checks whether given cluster name matches any of given regexp filters
+func clusterMatchesFilters(clusterName string, filters []string) bool {
+	for _, filter := range filters {
+		if matched, _ := regexp.MatchString(filter, clusterName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// canMatchSlaves checks whether given slaves can be repointed without knowing their master's coordinates:
+// either via pseudo-GTID, or via GTID should all of them have it enabled
+func canMatchSlaves(slaves [](*inst.Instance)) bool {
+	if config.Config.PseudoGTIDPattern != "" {
+		return true
+	}
+	for _, slave := range slaves {
+		if !slave.IsGTIDEnabled() {
+			return false
+		}
+	}
+	return len(slaves) > 0
+}
+
+// getCandidateSlave returns the most advanced slave in given list, in terms of read binlog coordinates.
+// Since all slaves replicate from the same master, a slave which is not most advanced cannot be promoted.
+// Hence, if the most advanced slave is unable to serve as master (i.e. does not have binary logs and
+// log_slave_updates), an error is returned.
+func getCandidateSlave(slaves [](*inst.Instance)) (*inst.Instance, error) {
+	var candidate *inst.Instance
+	for _, slave := range slaves {
+		if !slave.IsLastCheckValid {
+			continue
+		}
+		if candidate == nil || candidate.ReadBinlogCoordinates.SmallerThan(&slave.ReadBinlogCoordinates) {
+			candidate = slave
+		} else if candidate.ReadBinlogCoordinates.Equals(&slave.ReadBinlogCoordinates) {
+			if !candidate.HasReplicatedEventsInBinlogs() {
+				candidate = slave
+			}
+		}
+	}
+	if candidate == nil {
+		return nil, errors.New("No valid slave found as candidate for promotion")
+	}
+	if !candidate.HasReplicatedEventsInBinlogs() {
+		return nil, errors.New(fmt.Sprintf("Most advanced slave %+v does not have binary logs & log_slave_updates enabled", candidate.Key))
+	}
+	return candidate, nil
+}
+
+// executeRecoveryHook runs a single hook command via shell. The command is killed, along with any processes it
+// started, if it exceeds the hook's timeout.
+func executeRecoveryHook(hook config.RecoveryHook, command string) error {
+	cmd := exec.Command("bash", "-c", command)
+	// Run in a process group of its own, so that the whole of it can be killed
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	if hook.TimeoutSeconds <= 0 {
+		return <-done
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Duration(hook.TimeoutSeconds) * time.Second):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return errors.New(fmt.Sprintf("timed out after %d seconds", hook.TimeoutSeconds))
+	}
+}
+
+// executeRecoveryHooks runs given hooks in order, expanding placeholders in their commands. The exit status
+// of each hook is audited. With failOnError, execution stops at the first failing hook and its error is returned.
+func executeRecoveryHooks(hooks []config.RecoveryHook, description string, failedKey *inst.InstanceKey, successorKey *inst.InstanceKey, clusterName string, failOnError bool) error {
+	var err error
+	for _, hook := range hooks {
+		command := hook.Command
+		command = strings.Replace(command, "{failedHost}", failedKey.Hostname, -1)
+		command = strings.Replace(command, "{failedPort}", fmt.Sprintf("%d", failedKey.Port), -1)
+		command = strings.Replace(command, "{successorHost}", successorKey.Hostname, -1)
+		command = strings.Replace(command, "{successorPort}", fmt.Sprintf("%d", successorKey.Port), -1)
+		command = strings.Replace(command, "{clusterName}", clusterName, -1)
+
+		log.Infof("Executing %s hook: %s", description, command)
+		if cmdErr := executeRecoveryHook(hook, command); cmdErr != nil {
+			inst.AuditOperation("recovery-hook", failedKey, fmt.Sprintf("%s hook failed: %s; exit status: %+v", description, command, cmdErr))
+			err = log.Errorf("%s hook failed: %s; error: %+v", description, command, cmdErr)
+			if failOnError {
+				return err
+			}
+		} else {
+			inst.AuditOperation("recovery-hook", failedKey, fmt.Sprintf("%s hook succeeded: %s; exit status: 0", description, command))
+		}
+	}
+	return err
+}
+
+// RecoverDeadMaster attempts recovery of a dead master: it picks the most advanced of its slaves,
+// lets it consume its relay logs, then promotes it via MakeMaster (enslaving its siblings by
+// pseudo-GTID) and detaches it from the dead master.
+// Pre-recovery hooks are executed before promotion, and may abort the recovery. Post-recovery hooks
+// are executed upon successful promotion.
+func RecoverDeadMaster(failedMaster *inst.Instance) (*inst.Instance, error) {
+	if err := beginClusterRecovery(failedMaster.ClusterName); err != nil {
+		return nil, log.Errore(err)
+	}
+	defer endClusterRecovery(failedMaster.ClusterName)
+
+	failedMasterKey := failedMaster.Key
+	inst.AuditOperation("recover-dead-master", &failedMasterKey, fmt.Sprintf("problem found; will recover. cluster: %s", failedMaster.ClusterName))
+	topologyRecovery := NewTopologyRecovery("recover-dead-master", true, failedMasterKey, failedMaster.ClusterName)
+	writeTopologyRecovery(topologyRecovery)
+	defer writeTopologyRecoveryEnd(topologyRecovery)
+
+	var candidate *inst.Instance
+	var promotedInstance *inst.Instance
+	var promotedKey inst.InstanceKey
+	slaves, err := inst.ReadSlaveInstances(&failedMasterKey)
+	if err != nil {
+		goto Cleanup
+	}
+	if !canMatchSlaves(slaves) {
+		err = errors.New("PseudoGTIDPattern not configured and GTID not enabled on all slaves; cannot promote a slave")
+		goto Cleanup
+	}
+	candidate, err = getCandidateSlave(slaves)
+	if err != nil {
+		goto Cleanup
+	}
+	promotedKey = candidate.Key
+	err = executeRecoveryHooks(config.Config.PreRecoveryHooks, "pre-recovery", &failedMasterKey, &promotedKey, failedMaster.ClusterName, true)
+	if err != nil {
+		goto Cleanup
+	}
+	log.Infof("Will promote %+v as master of cluster %s", promotedKey, failedMaster.ClusterName)
+
+	// The IO thread is broken; let the SQL thread consume all relay logs
+	_, err = inst.StopSlaveNicely(&promotedKey)
+	if err != nil {
+		goto Cleanup
+	}
+	promotedInstance, err = inst.MakeMaster(&promotedKey)
+	if err != nil {
+		goto Cleanup
+	}
+	// Detach from the dead master so that it does not get to replicate from it should it return
+	promotedInstance, err = inst.ResetSlaveOperation(&promotedKey)
+	if err != nil {
+		goto Cleanup
+	}
+
+Cleanup:
+	topologyRecovery.setOutcome(&promotedKey, slaves, err)
+	if err != nil {
+		inst.AuditOperation("recover-dead-master", &failedMasterKey, fmt.Sprintf("recovery failed: %+v", err))
+		return nil, log.Errore(err)
+	}
+	inst.AuditOperation("recover-dead-master", &failedMasterKey, fmt.Sprintf("master %+v promoted", promotedKey))
+	executeRecoveryHooks(config.Config.PostRecoveryHooks, "post-recovery", &failedMasterKey, &promotedKey, failedMaster.ClusterName, false)
+	return promotedInstance, nil
+}
+
+// getIntermediateMasterRecoveryTarget finds an instance under which the slaves of a failed intermediate master
+// can be relocated: either the intermediate master's own master (the slaves' grandparent), or one of
+// the intermediate master's siblings.
+func getIntermediateMasterRecoveryTarget(failedInstance *inst.Instance, slaves [](*inst.Instance)) (*inst.Instance, error) {
+	canServeAllSlaves := func(target *inst.Instance) bool {
+		if !target.IsLastCheckValid {
+			return false
+		}
+		for _, slave := range slaves {
+			if canReplicate, _ := slave.CanReplicateFrom(target); !canReplicate {
+				return false
+			}
+		}
+		return true
+	}
+	grandparent, found, err := inst.ReadInstance(&failedInstance.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	if found && canServeAllSlaves(grandparent) {
+		return grandparent, nil
+	}
+	siblings, err := inst.ReadSlaveInstances(&failedInstance.MasterKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, sibling := range siblings {
+		if !sibling.Key.Equals(&failedInstance.Key) && canServeAllSlaves(sibling) {
+			return sibling, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Cannot find a target to relocate slaves of %+v", failedInstance.Key))
+}
+
+// relocateSlavesBelow relocates given slaves below given target via MatchBelow
+func relocateSlavesBelow(slaves [](*inst.Instance), target *inst.Instance) error {
+	var err error
+	for _, slave := range slaves {
+		if _, merr := inst.MatchBelow(&slave.Key, &target.Key, true, false); merr != nil {
+			err = merr
+			log.Errore(merr)
+		}
+	}
+	return err
+}
+
+// RecoverDeadIntermediateMaster attempts recovery of a dead intermediate master. Preferably, its most advanced
+// slave is promoted in its place via MakeLocalMaster. Otherwise its slaves are each relocated via MatchBelow
+// under the grandparent or a sibling of the failed instance.
+// Pre-recovery hooks are executed before any change is made, and may abort the recovery. Post-recovery hooks
+// are executed upon successful recovery.
+func RecoverDeadIntermediateMaster(failedInstance *inst.Instance) (*inst.Instance, error) {
+	if err := beginClusterRecovery(failedInstance.ClusterName); err != nil {
+		return nil, log.Errore(err)
+	}
+	defer endClusterRecovery(failedInstance.ClusterName)
+
+	failedInstanceKey := failedInstance.Key
+	inst.AuditOperation("recover-dead-intermediate-master", &failedInstanceKey, fmt.Sprintf("problem found; will recover. cluster: %s", failedInstance.ClusterName))
+	topologyRecovery := NewTopologyRecovery("recover-dead-intermediate-master", true, failedInstanceKey, failedInstance.ClusterName)
+	writeTopologyRecovery(topologyRecovery)
+	defer writeTopologyRecoveryEnd(topologyRecovery)
+
+	var candidate *inst.Instance
+	var target *inst.Instance
+	var successor *inst.Instance
+	slaves, err := inst.ReadSlaveInstances(&failedInstanceKey)
+	if err != nil {
+		goto Cleanup
+	}
+	if !canMatchSlaves(slaves) {
+		err = errors.New("PseudoGTIDPattern not configured and GTID not enabled on all slaves; cannot relocate slaves")
+		goto Cleanup
+	}
+	if candidate, err = getCandidateSlave(slaves); err != nil {
+		log.Errore(err)
+		// Cannot promote a slave in place of the failed intermediate master. We will relocate all slaves instead
+		target, err = getIntermediateMasterRecoveryTarget(failedInstance, slaves)
+		if err != nil {
+			goto Cleanup
+		}
+		successor = target
+	} else {
+		successor = candidate
+	}
+	err = executeRecoveryHooks(config.Config.PreRecoveryHooks, "pre-recovery", &failedInstanceKey, &successor.Key, failedInstance.ClusterName, true)
+	if err != nil {
+		goto Cleanup
+	}
+
+	if candidate != nil {
+		log.Infof("Will promote %+v in place of %+v", candidate.Key, failedInstanceKey)
+		successor, err = inst.MakeLocalMaster(&candidate.Key)
+		if err == nil {
+			goto Cleanup
+		}
+		log.Errore(err)
+		// Could not promote a slave in place of the failed intermediate master. Relocate all slaves instead
+		target, err = getIntermediateMasterRecoveryTarget(failedInstance, slaves)
+		if err != nil {
+			goto Cleanup
+		}
+	}
+	log.Infof("Will relocate slaves of %+v below %+v", failedInstanceKey, target.Key)
+	err = relocateSlavesBelow(slaves, target)
+	successor = target
+
+Cleanup:
+	if successor != nil {
+		topologyRecovery.setOutcome(&successor.Key, slaves, err)
+	} else {
+		topologyRecovery.setOutcome(nil, slaves, err)
+	}
+	if err != nil {
+		inst.AuditOperation("recover-dead-intermediate-master", &failedInstanceKey, fmt.Sprintf("recovery failed: %+v", err))
+		return nil, log.Errore(err)
+	}
+	inst.AuditOperation("recover-dead-intermediate-master", &failedInstanceKey, fmt.Sprintf("slaves relocated below %+v", successor.Key))
+	executeRecoveryHooks(config.Config.PostRecoveryHooks, "post-recovery", &failedInstanceKey, &successor.Key, failedInstance.ClusterName, false)
+	return successor, nil
+}
+
+// CheckAndRecover runs replication analysis, and attempts recovery on dead masters and dead intermediate
+// masters that belong to clusters configured for automated recovery.
+func CheckAndRecover() {
+	if len(config.Config.RecoverMasterClusterFilters) == 0 && len(config.Config.RecoverIntermediateMasterClusterFilters) == 0 {
+		return
+	}
+	replicationAnalysis, err := inst.GetReplicationAnalysis()
+	if err != nil {
+		log.Errore(err)
+		return
+	}
+	for _, analysisEntry := range replicationAnalysis {
+		var recoverFunc func(*inst.Instance) (*inst.Instance, error)
+		switch analysisEntry.Analysis {
+		case inst.DeadMaster:
+			if clusterMatchesFilters(analysisEntry.ClusterName, config.Config.RecoverMasterClusterFilters) {
+				recoverFunc = RecoverDeadMaster
+			}
+		case inst.DeadIntermediateMaster:
+			if clusterMatchesFilters(analysisEntry.ClusterName, config.Config.RecoverIntermediateMasterClusterFilters) {
+				recoverFunc = RecoverDeadIntermediateMaster
+			}
+		default:
+			continue
+		}
+		if recoverFunc == nil {
+			log.Debugf("%s found on %+v, but cluster %s is not configured for automated recovery", analysisEntry.Analysis, analysisEntry.AnalyzedInstanceKey, analysisEntry.ClusterName)
+			continue
+		}
+		failedInstance, found, err := inst.ReadInstance(&analysisEntry.AnalyzedInstanceKey)
+		if err != nil || !found {
+			log.Errorf("Cannot read analyzed instance %+v: %+v", analysisEntry.AnalyzedInstanceKey, err)
+			continue
+		}
+		go recoverFunc(failedInstance)
+	}
+}
+
+// executeRecordedPromotion runs given promotion function on given instance, and records it in the recovery history
+// as a manual recovery of the instance's master.
+// Pre-recovery hooks are executed before promotion, and may abort it. Post-recovery hooks are executed upon
+// successful promotion. The instance's master is passed to hooks as the failed instance.
+func executeRecordedPromotion(recoveryType string, instanceKey *inst.InstanceKey, promote func(*inst.InstanceKey) (*inst.Instance, error)) (*inst.Instance, error) {
+	instance, found, err := inst.ReadInstance(instanceKey)
+	if err != nil {
+		return nil, log.Errore(err)
+	}
+	if !found {
+		return nil, log.Errore(errors.New(fmt.Sprintf("Cannot find instance %+v", *instanceKey)))
+	}
+	topologyRecovery := NewTopologyRecovery(recoveryType, false, instance.MasterKey, instance.ClusterName)
+	writeTopologyRecovery(topologyRecovery)
+	defer writeTopologyRecoveryEnd(topologyRecovery)
+
+	siblings, _ := inst.ReadSlaveInstances(&instance.MasterKey)
+	err = executeRecoveryHooks(config.Config.PreRecoveryHooks, "pre-recovery", &instance.MasterKey, instanceKey, instance.ClusterName, true)
+	if err != nil {
+		topologyRecovery.setOutcome(nil, siblings, err)
+		inst.AuditOperation(recoveryType, instanceKey, fmt.Sprintf("aborted by pre-recovery hook: %+v", err))
+		return nil, err
+	}
+	promotedInstance, err := promote(instanceKey)
+	topologyRecovery.setOutcome(instanceKey, siblings, err)
+	if err != nil {
+		return promotedInstance, err
+	}
+	executeRecoveryHooks(config.Config.PostRecoveryHooks, "post-recovery", &instance.MasterKey, instanceKey, instance.ClusterName, false)
+	return promotedInstance, nil
+}
+
+// MakeMaster promotes given instance via inst.MakeMaster, recording the promotion in the recovery history
+func MakeMaster(instanceKey *inst.InstanceKey) (*inst.Instance, error) {
+	return executeRecordedPromotion("make-master", instanceKey, inst.MakeMaster)
+}
+
+// MakeLocalMaster promotes given instance via inst.MakeLocalMaster, recording the promotion in the recovery history
+func MakeLocalMaster(instanceKey *inst.InstanceKey) (*inst.Instance, error) {
+	return executeRecordedPromotion("make-local-master", instanceKey, inst.MakeLocalMaster)
+}
+
+// GracefulMasterTakeover promotes given instance in place of its master via inst.GracefulMasterTakeover,
+// recording the promotion in the recovery history
+func GracefulMasterTakeover(designatedKey *inst.InstanceKey) (*inst.Instance, error) {
+	return executeRecordedPromotion("graceful-master-takeover", designatedKey, inst.GracefulMasterTakeover)
+}
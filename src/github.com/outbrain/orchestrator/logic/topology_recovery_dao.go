@@ -0,0 +1,212 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package orchestrator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/outbrain/golib/log"
+	"github.com/outbrain/golib/sqlutils"
+	"github.com/outbrain/orchestrator/config"
+	"github.com/outbrain/orchestrator/db"
+	"github.com/outbrain/orchestrator/inst"
+)
+
+// writeTopologyRecovery registers the beginning of a recovery in the backend database, and
+// assigns the generated recovery id onto given entry
+func writeTopologyRecovery(topologyRecovery *TopologyRecovery) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	res, err := sqlutils.Exec(db, `
+			insert 
+				into topology_recovery (
+					hostname, port, cluster_name, recovery_type, is_automated, start_recovery, affected_slave_keys, acknowledge_comment
+				) VALUES (
+					?, ?, ?, ?, ?, NOW(), '[]', ''
+				)
+			`,
+		topologyRecovery.FailedInstanceKey.Hostname,
+		topologyRecovery.FailedInstanceKey.Port,
+		topologyRecovery.ClusterName,
+		topologyRecovery.RecoveryType,
+		topologyRecovery.IsAutomated,
+	)
+	if err != nil {
+		return log.Errore(err)
+	}
+	topologyRecovery.Id, _ = res.LastInsertId()
+	return nil
+}
+
+// writeTopologyRecoveryEnd registers the outcome of a recovery: successor, affected slaves and success status
+func writeTopologyRecoveryEnd(topologyRecovery *TopologyRecovery) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+	affectedSlaveKeys, err := json.Marshal(topologyRecovery.AffectedSlaveKeys)
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	_, err = sqlutils.Exec(db, `
+			update
+				topology_recovery
+			set  
+				end_recovery = NOW(),
+				successor_hostname = ?,
+				successor_port = ?,
+				affected_slave_keys = ?,
+				is_successful = ?
+			where
+				recovery_id = ?
+			`,
+		topologyRecovery.SuccessorKey.Hostname,
+		topologyRecovery.SuccessorKey.Port,
+		string(affectedSlaveKeys),
+		topologyRecovery.IsSuccessful,
+		topologyRecovery.Id,
+	)
+	if err != nil {
+		return log.Errore(err)
+	}
+	return nil
+}
+
+// readTopologyRecoveries reads recovery entries by given condition & its arguments, ordered chronologically descending
+func readTopologyRecoveries(whereCondition string, limit string, args ...interface{}) ([]TopologyRecovery, error) {
+	res := []TopologyRecovery{}
+	query := fmt.Sprintf(`
+		select 
+			recovery_id,
+			hostname,
+			port,
+			cluster_name,
+			recovery_type,
+			is_automated,
+			start_recovery,
+			ifnull(end_recovery, '') as end_recovery,
+			successor_hostname,
+			successor_port,
+			affected_slave_keys,
+			is_successful,
+			acknowledged,
+			acknowledged_by,
+			ifnull(acknowledged_at, '') as acknowledged_at,
+			acknowledge_comment
+		from 
+			topology_recovery
+		%s
+		order by
+			recovery_id desc
+		%s
+		`, whereCondition, limit)
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		goto Cleanup
+	}
+
+	err = sqlutils.QueryRowsMap(db, query, func(m sqlutils.RowMap) error {
+		topologyRecovery := TopologyRecovery{}
+		topologyRecovery.Id = m.GetInt64("recovery_id")
+		topologyRecovery.FailedInstanceKey.Hostname = m.GetString("hostname")
+		topologyRecovery.FailedInstanceKey.Port = m.GetInt("port")
+		topologyRecovery.ClusterName = m.GetString("cluster_name")
+		topologyRecovery.RecoveryType = m.GetString("recovery_type")
+		topologyRecovery.IsAutomated = m.GetBool("is_automated")
+		topologyRecovery.RecoveryStartTimestamp = m.GetString("start_recovery")
+		topologyRecovery.RecoveryEndTimestamp = m.GetString("end_recovery")
+		topologyRecovery.SuccessorKey.Hostname = m.GetString("successor_hostname")
+		topologyRecovery.SuccessorKey.Port = m.GetInt("successor_port")
+		topologyRecovery.IsSuccessful = m.GetBool("is_successful")
+		topologyRecovery.Acknowledged = m.GetBool("acknowledged")
+		topologyRecovery.AcknowledgedBy = m.GetString("acknowledged_by")
+		topologyRecovery.AcknowledgedAt = m.GetString("acknowledged_at")
+		topologyRecovery.AcknowledgedComment = m.GetString("acknowledge_comment")
+		if merr := json.Unmarshal([]byte(m.GetString("affected_slave_keys")), &topologyRecovery.AffectedSlaveKeys); merr != nil {
+			log.Errore(merr)
+		}
+
+		res = append(res, topologyRecovery)
+		return nil
+	}, args...)
+Cleanup:
+
+	if err != nil {
+		log.Errore(err)
+	}
+	return res, err
+}
+
+// ReadRecentRecoveries returns a list of recovery entries, ordered chronologically descending, using page number.
+func ReadRecentRecoveries(page int) ([]TopologyRecovery, error) {
+	limit := fmt.Sprintf(`
+		limit %d
+		offset %d
+		`, config.Config.AuditPageSize, page*config.Config.AuditPageSize)
+	return readTopologyRecoveries(``, limit)
+}
+
+// ReadBlockingRecoveries returns unacknowledged recoveries on given cluster which took place
+// within the last RecoveryPeriodBlockMinutes. Such recoveries block further automated recoveries on the cluster.
+func ReadBlockingRecoveries(clusterName string) ([]TopologyRecovery, error) {
+	whereCondition := `
+		where
+			cluster_name = ?
+			and acknowledged = 0
+			and start_recovery >= NOW() - INTERVAL ? MINUTE
+		`
+	return readTopologyRecoveries(whereCondition, ``, clusterName, config.Config.RecoveryPeriodBlockMinutes)
+}
+
+// AcknowledgeRecovery marks given recovery as acknowledged by given owner. Once acknowledged, a recovery
+// no longer blocks automated recoveries on its cluster.
+func AcknowledgeRecovery(recoveryId int64, owner string, comment string) error {
+	db, err := db.OpenOrchestrator()
+	if err != nil {
+		return log.Errore(err)
+	}
+
+	res, err := sqlutils.Exec(db, `
+			update
+				topology_recovery
+			set  
+				acknowledged = 1,
+				acknowledged_by = ?,
+				acknowledged_at = NOW(),
+				acknowledge_comment = ?
+			where
+				recovery_id = ?
+				and acknowledged = 0
+			`,
+		owner,
+		comment,
+		recoveryId,
+	)
+	if err != nil {
+		return log.Errore(err)
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return log.Errore(errors.New(fmt.Sprintf("No unacknowledged recovery found with id %d", recoveryId)))
+	}
+	inst.AuditOperation("acknowledge-recovery", nil, fmt.Sprintf("recoveryId: %d, owner: %s, comment: %s", recoveryId, owner, comment))
+	return nil
+}
@@ -0,0 +1,52 @@
+/*
+   Copyright 2014 Outbrain Inc.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package orchestrator
+
+import (
+	"fmt"
+	"github.com/outbrain/orchestrator/config"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+type TopologyRecoveryTestSuite struct{}
+
+var _ = Suite(&TopologyRecoveryTestSuite{})
+
+func (s *TopologyRecoveryTestSuite) TestRecoveryHookTimeoutKillsChildProcesses(c *C) {
+	dir, err := ioutil.TempDir("", "orchestrator-hook")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	touchedFile := path.Join(dir, "touched")
+
+	command := fmt.Sprintf("(sleep 2; touch %s) & wait", touchedFile)
+	err = executeRecoveryHook(config.RecoveryHook{Command: command, TimeoutSeconds: 1}, command)
+	c.Assert(err, NotNil)
+
+	time.Sleep(1500 * time.Millisecond)
+	_, err = os.Stat(touchedFile)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *TopologyRecoveryTestSuite) TestRecoveryHookExitStatus(c *C) {
+	c.Assert(executeRecoveryHook(config.RecoveryHook{TimeoutSeconds: 1}, "true"), IsNil)
+	c.Assert(executeRecoveryHook(config.RecoveryHook{TimeoutSeconds: 1}, "false"), NotNil)
+	c.Assert(executeRecoveryHook(config.RecoveryHook{}, "exit 0"), IsNil)
+}
@@ -26,11 +26,14 @@ import (
 // main is the application's entry point. It will either spawn a CLI or HTTP itnerfaces.
 func main() {
 	configFile := flag.String("config", "", "config file name")
-	command := flag.String("c", "", "command (discover|forget|continuous|move-up|move-below|begin-maintenance|end-maintenance|clusters|topology)")
+	command := flag.String("c", "", "command (discover|forget|continuous|move-up|move-below|relocate|relocate-slaves|match-below-offline|graceful-master-takeover|reset-errant-transactions|begin-maintenance|end-maintenance|clusters|topology|binlog-purge-advice|purge-binary-logs)")
 	instance := flag.String("i", "", "instance, host:port")
 	sibling := flag.String("s", "", "sibling instance, host:port")
 	owner := flag.String("owner", "", "operation owner")
 	reason := flag.String("reason", "", "operation reason")
+	pattern := flag.String("pattern", "", "regular expression pattern")
+	dryRun := flag.Bool("dry-run", false, "only show the planned operation, do not execute")
+	force := flag.Bool("force", false, "proceed even if safety checks fail (e.g. errant transactions on match-below)")
 	discovery := flag.Bool("discovery", true, "auto discovery mode")
 	verbose := flag.Bool("verbose", false, "verbose")
 	debug := flag.Bool("debug", false, "debug mode (very verbose)")
@@ -58,7 +61,7 @@ func main() {
 
 	switch {
 	case len(flag.Args()) == 0 || flag.Arg(0) == "cli":
-		app.Cli(*command, *instance, *sibling, *owner, *reason)
+		app.Cli(*command, *instance, *sibling, *owner, *reason, *pattern, *dryRun, *force)
 	case flag.Arg(0) == "http":
 		app.Http(*discovery)
 	default: